@@ -179,6 +179,14 @@ func (s HeaderFieldSetter) CrossLinks(newCrossLinks []byte) HeaderFieldSetter {
 	return s
 }
 
+// BaseFee sets the base fee per gas of this block.
+//
+// It stores a copy; the caller may freely modify the original.
+func (s HeaderFieldSetter) BaseFee(newBaseFee *big.Int) HeaderFieldSetter {
+	s.h.SetBaseFee(newBaseFee)
+	return s
+}
+
 // Header returns the header whose fields have been set.  Call this at the end
 // of a field setter chain.
 func (s HeaderFieldSetter) Header() *Header {
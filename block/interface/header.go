@@ -236,4 +236,17 @@ type Header interface {
 	// SetSlashes sets the RLP-encoded form of slashes
 	// It stores a copy; the caller may freely modify the original.
 	SetSlashes(newSlashes []byte)
+
+	// BaseFee is the EIP-1559 style base fee per gas of this block, or nil if
+	// the header version does not carry one.
+	//
+	// The returned instance is a copy; the caller may do anything with it.
+	BaseFee() *big.Int
+
+	// SetBaseFee sets the base fee per gas of this block. nil, like zero,
+	// means no base fee, which is all that header versions without one can
+	// store.
+	//
+	// It stores a copy; the caller may freely modify the original.
+	SetBaseFee(newBaseFee *big.Int)
 }
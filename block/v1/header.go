@@ -390,6 +390,21 @@ type headerMarshaling struct {
 	Hash       common.Hash `json:"hash"` // adds call to Hash() in MarshalJSON
 }
 
+// BaseFee is the base fee per gas of this block, which V1 headers do not
+// carry.
+func (h *Header) BaseFee() *big.Int {
+	return nil
+}
+
+// SetBaseFee sets the base fee per gas of this block.
+func (h *Header) SetBaseFee(newBaseFee *big.Int) {
+	if newBaseFee != nil && newBaseFee.Sign() != 0 {
+		h.Logger(utils.Logger()).Warn().
+			Str("baseFee", newBaseFee.String()).
+			Msg("cannot store base fee in V1 header")
+	}
+}
+
 // Hash returns the block hash of the header, which is simply the keccak256 hash of its
 // RLP encoding.
 func (h *Header) Hash() common.Hash {
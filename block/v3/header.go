@@ -380,6 +380,21 @@ func (h *Header) SetSlashes(newSlashes []byte) {
 	h.fields.Slashes = append(newSlashes[:0:0], newSlashes...)
 }
 
+// BaseFee is the base fee per gas of this block, which V3 headers do not
+// carry.
+func (h *Header) BaseFee() *big.Int {
+	return nil
+}
+
+// SetBaseFee sets the base fee per gas of this block.
+func (h *Header) SetBaseFee(newBaseFee *big.Int) {
+	if newBaseFee != nil && newBaseFee.Sign() != 0 {
+		h.Logger(utils.Logger()).Warn().
+			Str("baseFee", newBaseFee.String()).
+			Msg("cannot store base fee in V3 header")
+	}
+}
+
 // Hash returns the block hash of the header, which is simply the keccak256 hash of its
 // RLP encoding.
 func (h *Header) Hash() common.Hash {
@@ -35,6 +35,10 @@ var (
 	// plus one.
 	ErrInvalidNumber = errors.New("invalid block number")
 
+	// ErrInvalidBaseFee is returned if a block's base fee is not the one
+	// computed from its parent.
+	ErrInvalidBaseFee = errors.New("invalid base fee")
+
 	// ErrViewIDNotMatch is returned if the current viewID is not equal message's viewID
 	ErrViewIDNotMatch = errors.New("viewID not match")
 
@@ -1,7 +1,9 @@
 package reward
 
 import (
+	"bytes"
 	"math/big"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/harmony-one/harmony/shard"
@@ -22,8 +24,44 @@ type CompletedRound struct {
 	ShardChainAward  []Payout
 }
 
+// ValidatorPayout is the total amount a validator earned in a round.
+type ValidatorPayout struct {
+	Addr   common.Address
+	Amount *big.Int
+}
+
+// ValidatorPayouts sums up the beacon chain and shard chain awards of the
+// round per validator, ordered by validator address.
+func (r *CompletedRound) ValidatorPayouts() []ValidatorPayout {
+	if r == nil {
+		return []ValidatorPayout{}
+	}
+	totals := map[common.Address]*big.Int{}
+	for _, awards := range [...][]Payout{r.BeaconchainAward, r.ShardChainAward} {
+		for _, award := range awards {
+			total, ok := totals[award.Addr]
+			if !ok {
+				total = big.NewInt(0)
+				totals[award.Addr] = total
+			}
+			total.Add(total, award.NewlyEarned)
+		}
+	}
+	payouts := make([]ValidatorPayout, 0, len(totals))
+	for addr, total := range totals {
+		payouts = append(payouts, ValidatorPayout{addr, total})
+	}
+	sort.Slice(payouts, func(i, j int) bool {
+		return bytes.Compare(payouts[i].Addr[:], payouts[j].Addr[:]) < 0
+	})
+	return payouts
+}
+
 // Reader ..
 type Reader interface {
 	ReadRoundResult() *CompletedRound
 	MissingSigners() shard.SlotList
+	// ValidatorPayouts enumerates what every validator earned in the round.
+	// It is empty before staking, when rewards are not paid per validator.
+	ValidatorPayouts() []ValidatorPayout
 }
@@ -0,0 +1,43 @@
+package reward
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestValidatorPayouts(t *testing.T) {
+	a, b := common.HexToAddress("0x0a"), common.HexToAddress("0x0b")
+	round := &CompletedRound{
+		Total: big.NewInt(10),
+		BeaconchainAward: []Payout{
+			{Addr: b, NewlyEarned: big.NewInt(1)},
+			{Addr: a, NewlyEarned: big.NewInt(2)},
+		},
+		ShardChainAward: []Payout{
+			{ShardID: 1, Addr: b, NewlyEarned: big.NewInt(3)},
+			{ShardID: 1, Addr: b, NewlyEarned: big.NewInt(4)},
+		},
+	}
+	got := round.ValidatorPayouts()
+	want := []ValidatorPayout{{a, big.NewInt(2)}, {b, big.NewInt(8)}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d payouts, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Addr != want[i].Addr || got[i].Amount.Cmp(want[i].Amount) != 0 {
+			t.Errorf("payout %d: got %v %v, want %v %v",
+				i, got[i].Addr.Hex(), got[i].Amount, want[i].Addr.Hex(), want[i].Amount)
+		}
+	}
+	// The awards themselves are left untouched.
+	if round.ShardChainAward[0].NewlyEarned.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("award was modified")
+	}
+
+	var empty *CompletedRound
+	if got := empty.ValidatorPayouts(); len(got) != 0 {
+		t.Errorf("got %d payouts for no round", len(got))
+	}
+}
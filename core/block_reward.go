@@ -0,0 +1,43 @@
+package core
+
+import (
+	"github.com/harmony-one/harmony/block"
+	consensus_engine "github.com/harmony-one/harmony/consensus/engine"
+	"github.com/harmony-one/harmony/consensus/reward"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/internal/chain"
+	"github.com/pkg/errors"
+)
+
+// ComputeBlockReward returns the rewards the block with the given header pays
+// out when it is finalized on top of statedb, without finalizing it: the
+// fixed reward split among the signers of the parent block before the
+// staking era, and the reward of the signers by voting power from then on.
+// The rewards are computed on a copy of statedb, which is left unmodified,
+// and slashes and the epoch transition of the validators are not applied.
+func (p *StateProcessor) ComputeBlockReward(
+	header *block.Header, statedb *state.DB,
+) (reward.Reader, error) {
+	beaconchain := p.engine.Beaconchain()
+	if beaconchain == nil {
+		beaconchain = p.bc
+	}
+	return computeBlockReward(p.bc, beaconchain, header, statedb)
+}
+
+// computeBlockReward computes the rewards of the block with the given header
+// of chain on a copy of statedb, see ComputeBlockReward.
+func computeBlockReward(
+	chainReader, beaconchain consensus_engine.ChainReader,
+	header *block.Header, statedb *state.DB,
+) (reward.Reader, error) {
+	payout, err := chain.AccumulateRewardsAndCountSigs(
+		chainReader, statedb.Copy(), header, beaconchain,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "cannot compute the reward of block %v", header.Number(),
+		)
+	}
+	return payout, nil
+}
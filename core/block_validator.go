@@ -113,7 +113,7 @@ func (v *BlockValidator) ValidateState(block *types.Block, statedb *state.DB, re
 
 	// Validate the state root against the received state root and throw
 	// an error if they don't match.
-	if root := statedb.IntermediateRoot(v.config.IsS3(header.Epoch())); header.Root() != root {
+	if root := statedb.IntermediateRoot(v.config.IsStateClearing(header.Epoch())); header.Root() != root {
 		dump, _ := rlp.EncodeToBytes(header)
 		const msg = "invalid merkle root (remote: %x local: %x, rlp dump %s)"
 		return fmt.Errorf(msg, header.Root(), root, hex.EncodeToString(dump))
@@ -191,12 +191,33 @@ func (v *BlockValidator) ValidateCXReceiptsProof(cxp *types.CXReceiptsProof) err
 		return errors.New("[ValidateCXReceiptsProof] cross shard receipt received before cx fork")
 	}
 
+	if err := verifyCXMerkleProof(cxp); err != nil {
+		return errors.Wrap(err, "[ValidateCXReceiptsProof]")
+	}
+
+	// (4) verify blockHeader with seal
+	return v.engine.VerifyHeaderWithSignature(v.bc, cxp.Header, cxp.CommitSig, cxp.CommitBitmap, true)
+}
+
+// verifyCXMerkleProof checks that the receipts of cxp are the ones the header
+// of their source shard block commits to through the merkle proof of cxp. It
+// does not verify the header itself.
+func verifyCXMerkleProof(cxp *types.CXReceiptsProof) error {
+	if cxp.MerkleProof == nil || cxp.Header == nil {
+		return errors.Wrap(ErrInvalidCXProof, "missing merkle proof or header")
+	}
 	toShardID, err := cxp.GetToShardID()
 	if err != nil {
-		return errors.Wrapf(err, "[ValidateCXReceiptsProof] invalid shardID")
+		return errors.Wrapf(ErrInvalidCXProof, "invalid shardID: %v", err)
 	}
 
 	merkleProof := cxp.MerkleProof
+	if len(merkleProof.ShardIDs) != len(merkleProof.CXShardHashes) {
+		return errors.Wrapf(
+			ErrInvalidCXProof, "%d shard IDs but %d shard hashes",
+			len(merkleProof.ShardIDs), len(merkleProof.CXShardHashes),
+		)
+	}
 	shardRoot := common.Hash{}
 	foundMatchingShardID := false
 	byteBuffer := bytes.Buffer{}
@@ -214,14 +235,16 @@ func (v *BlockValidator) ValidateCXReceiptsProof(cxp *types.CXReceiptsProof) err
 	}
 
 	if !foundMatchingShardID {
-		return errors.New("[ValidateCXReceiptsProof] Didn't find matching toShardID (no receipts for my shard)")
+		return errors.Wrap(
+			ErrInvalidCXProof, "Didn't find matching toShardID (no receipts for my shard)",
+		)
 	}
 
 	sha := types.DeriveSha(cxp.Receipts)
 	// (1) verify the CXReceipts trie root match
 	if sha != shardRoot {
-		return errors.New(
-			"[ValidateCXReceiptsProof] Trie Root of ReadCXReceipts Not Match",
+		return errors.Wrap(
+			ErrInvalidCXProof, "Trie Root of ReadCXReceipts Not Match",
 		)
 	}
 
@@ -231,19 +254,17 @@ func (v *BlockValidator) ValidateCXReceiptsProof(cxp *types.CXReceiptsProof) err
 		outgoingHashFromSourceShard = types.EmptyRootHash
 	}
 	if outgoingHashFromSourceShard != merkleProof.CXReceiptHash {
-		return errors.New(
-			"[ValidateCXReceiptsProof] IncomingReceiptRootHash from source shard not match",
+		return errors.Wrap(
+			ErrInvalidCXProof, "IncomingReceiptRootHash from source shard not match",
 		)
 	}
 
 	// (3) verify the block hash matches
 	if cxp.Header.Hash() != merkleProof.BlockHash ||
 		cxp.Header.OutgoingReceiptHash() != merkleProof.CXReceiptHash {
-		return errors.New(
-			"[ValidateCXReceiptsProof] BlockHash or OutgoingReceiptHash not match in block Header",
+		return errors.Wrap(
+			ErrInvalidCXProof, "BlockHash or OutgoingReceiptHash not match in block Header",
 		)
 	}
-
-	// (4) verify blockHeader with seal
-	return v.engine.VerifyHeaderWithSignature(v.bc, cxp.Header, cxp.CommitSig, cxp.CommitBitmap, true)
+	return nil
 }
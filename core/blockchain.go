@@ -36,6 +36,7 @@ import (
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/common/denominations"
 	consensus_engine "github.com/harmony-one/harmony/consensus/engine"
 	"github.com/harmony-one/harmony/consensus/reward"
 	"github.com/harmony-one/harmony/consensus/votepower"
@@ -93,9 +94,11 @@ const (
 // CacheConfig contains the configuration values for the trie caching/pruning
 // that's resident in a blockchain.
 type CacheConfig struct {
-	Disabled      bool          // Whether to disable trie write caching (archive node)
-	TrieNodeLimit int           // Memory limit (MB) at which to flush the current in-memory trie to disk
-	TrieTimeLimit time.Duration // Time limit after which to flush the current in-memory trie to disk
+	Disabled       bool          // Whether to disable trie write caching (archive node)
+	TrieNodeLimit  int           // Memory limit (MB) at which to flush the current in-memory trie to disk
+	TrieTimeLimit  time.Duration // Time limit after which to flush the current in-memory trie to disk
+	TrieCleanLimit int           // Memory (MB) to cache clean trie nodes in, 0 disables the cache
+	Prefetch       bool          // Whether to prefetch the accounts of transactions while processing blocks
 }
 
 // BlockChain represents the canonical chain given a database with a genesis
@@ -205,7 +208,7 @@ func NewBlockChain(
 		cacheConfig:                   cacheConfig,
 		db:                            db,
 		triegc:                        prque.New(nil),
-		stateCache:                    state.NewDatabase(db),
+		stateCache:                    state.NewDatabaseWithCache(db, cacheConfig.TrieCleanLimit),
 		quit:                          make(chan struct{}),
 		shouldPreserve:                shouldPreserve,
 		bodyCache:                     bodyCache,
@@ -229,7 +232,9 @@ func NewBlockChain(
 		pendingSlashes:                slash.Records{},
 	}
 	bc.SetValidator(NewBlockValidator(chainConfig, bc, engine))
-	bc.SetProcessor(NewStateProcessor(chainConfig, bc, engine))
+	processor := NewStateProcessor(chainConfig, bc, engine)
+	processor.SetPrefetch(cacheConfig.Prefetch)
+	bc.SetProcessor(processor)
 
 	var err error
 	bc.hc, err = NewHeaderChain(db, chainConfig, engine, bc.getProcInterrupt)
@@ -1111,7 +1116,7 @@ func (bc *BlockChain) WriteBlockWithState(
 	}
 
 	// Commit state object changes to in-memory trie
-	root, err := state.Commit(bc.chainConfig.IsS3(block.Epoch()))
+	root, err := state.Commit(bc.chainConfig.IsStateClearing(block.Epoch()))
 	if err != nil {
 		return NonStatTy, err
 	}
@@ -1393,6 +1398,9 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifyHeaders bool) (int,
 		if err != nil {
 			return i, events, coalescedLogs, err
 		}
+		countFeesBurned(bc.chainConfig, block, receipts)
+		countCXReceipts(cxReceipts)
+		countTransactionOutcomes(receipts[:len(block.Transactions())])
 		logger := utils.Logger().With().
 			Str("number", block.Number().String()).
 			Str("hash", block.Hash().Hex()).
@@ -1559,6 +1567,75 @@ func (bc *BlockChain) addBadBlock(block *types.Block, reason error) {
 	bc.badBlocks.Add(block.Hash(), BadBlock{block, reason})
 }
 
+// countFeesBurned adds the fees burned by the transactions of block, see
+// BlockFees, to the counter of the total burned, in whole nanos and exported
+// as hmy_fees_burned_total. It is called once for every block inserted, so
+// that blocks processed otherwise, e.g. replayed or rejected, are not counted.
+func countFeesBurned(
+	config *params.ChainConfig, block *types.Block, receipts types.Receipts,
+) {
+	if !metrics.Enabled {
+		return
+	}
+	_, burned, _ := blockFees(config, block, receipts)
+	nanos := burned.Div(burned, big.NewInt(denominations.Nano))
+	metrics.GetOrRegisterCounter("hmy/fees/burned/total", nil).Inc(nanos.Int64())
+}
+
+// countCXReceipts updates the metrics of the cross-shard receipts created by
+// the transactions of a block: the number of receipts and the total value
+// sent in whole nanos, per source and destination shard pair, which are part
+// of the metric names as the metrics registry has no labels. Failed
+// transactions create no receipt and thus are not counted. Like
+// countFeesBurned, it is called once for every block inserted.
+func countCXReceipts(cxs types.CXReceipts) {
+	if !metrics.Enabled {
+		return
+	}
+	for _, cx := range cxs {
+		metrics.GetOrRegisterCounter(fmt.Sprintf(
+			"cx/receipts/created/%d/%d", cx.ShardID, cx.ToShardID,
+		), nil).Inc(1)
+		if cx.Amount == nil {
+			continue
+		}
+		nanos := new(big.Int).Div(cx.Amount, big.NewInt(denominations.Nano))
+		metrics.GetOrRegisterCounter(fmt.Sprintf(
+			"cx/receipts/value/%d/%d", cx.ShardID, cx.ToShardID,
+		), nil).Inc(nanos.Int64())
+	}
+}
+
+// countTransactionOutcomes updates the metrics of the outcome of the plain
+// transactions of a block from their receipts: the number of successful ones
+// and of the ones whose execution failed, e.g. by reverting, but that are
+// still included with a receipt, and the average gas used by the successful
+// ones. Transactions that cannot be applied at all invalidate the block and
+// are not counted. Like countFeesBurned, it is called once for every block
+// inserted.
+func countTransactionOutcomes(receipts types.Receipts) {
+	if !metrics.Enabled {
+		return
+	}
+	var succeeded, reverted, gas int64
+	for _, receipt := range receipts {
+		if receipt.Status == types.ReceiptStatusFailed {
+			reverted++
+			continue
+		}
+		succeeded++
+		gas += int64(receipt.GasUsed)
+	}
+	metrics.GetOrRegisterCounter("tx/processed/success", nil).Inc(succeeded)
+	metrics.GetOrRegisterCounter("tx/processed/revert", nil).Inc(reverted)
+	average := metrics.GetOrRegisterGaugeFloat64("tx/processed/success/gas", nil)
+	if succeeded == 0 {
+		average.Update(0)
+	} else {
+		average.Update(float64(gas) / float64(succeeded))
+	}
+}
+
 // reportBlock logs a bad block error.
 func (bc *BlockChain) reportBlock(
 	block *types.Block, receipts types.Receipts, err error,
@@ -29,6 +29,7 @@ import (
 	"github.com/harmony-one/harmony/core/state"
 	"github.com/harmony-one/harmony/core/types"
 	"github.com/harmony-one/harmony/core/vm"
+	chain2 "github.com/harmony-one/harmony/internal/chain"
 	"github.com/harmony-one/harmony/internal/params"
 	"github.com/harmony-one/harmony/shard"
 	staking "github.com/harmony-one/harmony/staking/types"
@@ -203,7 +204,7 @@ func GenerateChain(
 			}
 
 			// Write state changes to db
-			root, err := statedb.Commit(config.IsS3(b.header.Epoch()))
+			root, err := statedb.Commit(config.IsStateClearing(b.header.Epoch()))
 			if err != nil {
 				panic(fmt.Sprintf("state write error: %v", err))
 			}
@@ -236,10 +237,11 @@ func makeHeader(chain consensus_engine.ChainReader, parent *types.Block, state *
 	}
 
 	return factory.NewHeader(parent.Epoch()).With().
-		Root(state.IntermediateRoot(chain.Config().IsS3(parent.Epoch()))).
+		Root(state.IntermediateRoot(chain.Config().IsStateClearing(parent.Epoch()))).
 		ParentHash(parent.Hash()).
 		Coinbase(parent.Coinbase()).
 		GasLimit(CalcGasLimit(parent, parent.GasLimit(), parent.GasLimit())).
+		BaseFee(chain2.CalcBaseFee(chain.Config(), parent.Header(), parent.Epoch())).
 		Number(new(big.Int).Add(parent.Number(), common.Big1)).
 		Time(time).
 		Header()
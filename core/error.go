@@ -17,6 +17,9 @@
 package core
 
 import (
+	"fmt"
+	"math/big"
+
 	"github.com/pkg/errors"
 )
 
@@ -37,4 +40,93 @@ var (
 
 	// ErrShardStateNotMatch is returned if the calculated shardState hash not equal that in the block header
 	ErrShardStateNotMatch = errors.New("shard state root hash not match")
+
+	// ErrInvalidTxType is returned if a transaction is neither a same-shard
+	// nor a valid cross-shard transaction for the block it is included in.
+	ErrInvalidTxType = errors.New("Invalid Transaction Type")
+
+	// ErrCrossTxTooEarly is returned if a cross-shard transaction is included
+	// in a block of an epoch before cross-shard transactions are accepted.
+	ErrCrossTxTooEarly = errors.New("cross-shard transaction too early")
+
+	// ErrReceiptAlreadyApplied is returned if an incoming cross-shard receipt
+	// has already been applied to the state.
+	ErrReceiptAlreadyApplied = errors.New("cross-shard receipt already applied")
+
+	// ErrGasPriceBelowBaseFee is returned if the gas price of a transaction is
+	// lower than the base fee of the block it is included in.
+	ErrGasPriceBelowBaseFee = errors.New("gas price below base fee")
+
+	// ErrInvalidSlash is returned if a slash record of a block header does
+	// not refer to a validator and double-sign epoch it can apply to.
+	ErrInvalidSlash = errors.New("invalid slash record")
+
+	// ErrTransactionPanicked is returned if the execution of a transaction
+	// panicked. The state is left as it was before the transaction.
+	ErrTransactionPanicked = errors.New("transaction panicked")
+
+	// ErrInvalidCXProof is returned if the incoming cross-shard receipts of a
+	// proof are not the ones committed to by the header of their source block.
+	ErrInvalidCXProof = errors.New("invalid cross-shard receipts proof")
+
+	// ErrGasCapExceeded is returned by EstimateGas if a message fails even
+	// with the highest gas limit allowed.
+	ErrGasCapExceeded = errors.New("gas required exceeds allowance")
+
+	// ErrTooManyCXReceipts is returned if a block sends more cross-shard
+	// receipts to a destination shard than the chain config allows.
+	ErrTooManyCXReceipts = errors.New("too many cross-shard receipts for a shard")
+
+	// ErrDuplicateTxInBlock is returned if a block includes the same
+	// transaction more than once.
+	ErrDuplicateTxInBlock = errors.New("duplicate transaction in block")
+
+	// ErrInvalidGasLimit is returned if the gas limit of a block is out of the
+	// bounds a gas limit may ever be in.
+	ErrInvalidGasLimit = errors.New("invalid gas limit")
+
+	// ErrUnsupportedTxSigner is returned if a transaction is signed with a
+	// scheme that is not supported in the epoch it is applied in yet.
+	ErrUnsupportedTxSigner = errors.New("transaction signed with an unsupported scheme")
+
+	// ErrGasUsedExceedsLimit is returned if executing a transaction used more
+	// gas than its gas limit, which points to a bug in the gas accounting.
+	ErrGasUsedExceedsLimit = errors.New("gas used exceeds the gas limit of the transaction")
+
+	// ErrBlockTooLarge is returned if a block produces more receipts or logs
+	// than the processor is set to accept, see SetBlockSizeLimits.
+	ErrBlockTooLarge = errors.New("block too large")
+
+	// ErrBundleReverted is returned by SimulateBundle if a transaction of a
+	// bundle that must not revert failed.
+	ErrBundleReverted = errors.New("bundle transaction reverted")
+
+	// ErrGasUintOverflow is returned if the gas used by the transactions of a
+	// block so far would overflow uint64.
+	ErrGasUintOverflow = errors.New("gas uint64 overflow")
 )
+
+// CrossTxTooEarlyError is the error a cross-shard transaction fails with if
+// it is included in a block of an epoch before cross-shard transactions are
+// accepted. Its cause is ErrCrossTxTooEarly.
+type CrossTxTooEarlyError struct {
+	CrossTxEpoch *big.Int // last epoch not accepting cross-shard transactions
+	CurrentEpoch *big.Int // epoch of the block
+}
+
+func (e *CrossTxTooEarlyError) Error() string {
+	return fmt.Sprintf(
+		"cannot handle it until after epoch %v (now %v): %v",
+		e.CrossTxEpoch, e.CurrentEpoch, ErrCrossTxTooEarly,
+	)
+}
+
+// Cause returns ErrCrossTxTooEarly, see errors.Cause.
+func (e *CrossTxTooEarlyError) Cause() error {
+	return ErrCrossTxTooEarly
+}
+
+// Unwrap returns ErrCrossTxTooEarly, see errors.Is.
+func (e *CrossTxTooEarlyError) Unwrap() error {
+	return ErrCrossTxTooEarly
+}
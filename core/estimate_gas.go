@@ -0,0 +1,76 @@
+package core
+
+import (
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/internal/params"
+	"github.com/pkg/errors"
+)
+
+// gasLimitedMessage is a message with its gas limit replaced.
+type gasLimitedMessage struct {
+	Message
+	gas uint64
+}
+
+// Gas returns the replaced gas limit.
+func (m gasLimitedMessage) Gas() uint64 {
+	return m.gas
+}
+
+// EstimateGas returns the smallest gas limit up to cap with which msg
+// executes successfully on top of statedb in the block with the given header,
+// ignoring the gas limit of msg itself. Every attempt runs on a copy of
+// statedb, which is left unmodified.
+//
+// If msg fails even with cap gas, EstimateGas returns vm.ErrExecutionReverted
+// with the revert reason if the execution was reverted, and
+// ErrGasCapExceeded otherwise. Errors that make msg invalid regardless of its
+// gas, e.g. an insufficient balance for the gas, are returned as they are.
+func EstimateGas(
+	config *params.ChainConfig, bc ChainContext, statedb *state.DB,
+	header *block.Header, msg Message, cap uint64,
+) (uint64, error) {
+	coinbase := header.Coinbase()
+	execute := func(gas uint64) (*ExecutionResult, error) {
+		msg := gasLimitedMessage{msg, gas}
+		context := NewEVMContext(msg, header, bc, &coinbase)
+		vmenv := vm.NewEVM(context, statedb.Copy(), config, vm.Config{})
+		result, _, _, err := applyMessage(
+			vmenv, msg, new(GasPool).AddGas(gas), msg.From(), false,
+		)
+		return result, err
+	}
+
+	// Reject messages that cannot succeed at all before searching.
+	result, err := execute(cap)
+	if err != nil {
+		return 0, err
+	}
+	if result.Reverted() {
+		if reason, ok := result.RevertReason(); ok {
+			return 0, errors.Wrap(vm.ErrExecutionReverted, reason)
+		}
+		return 0, vm.ErrExecutionReverted
+	}
+	if result.Failed() {
+		return 0, errors.Wrapf(
+			ErrGasCapExceeded, "gas cap %d: %v", cap, result.VMErr,
+		)
+	}
+
+	// Binary search for the smallest gas limit that succeeds, knowing that
+	// hi does and that nothing below the gas of a plain transfer does.
+	lo, hi := params.TxGas-1, cap
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		result, err := execute(mid)
+		if err != nil || result.Failed() {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/internal/params"
+	"github.com/pkg/errors"
+)
+
+func TestEstimateGas(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	from := crypto.PubkeyToAddress(keys[0].PublicKey)
+	var (
+		recipient = common.HexToAddress("0x1020")
+		reverting = common.HexToAddress("0x1021")
+		looping   = common.HexToAddress("0x1022")
+		cap       = uint64(1000000)
+		// PUSH1 0x01 PUSH1 0x00 SSTORE, then return the runtime code STOP:
+		// PUSH1 0x00 PUSH1 0x00 MSTORE8 PUSH1 0x01 PUSH1 0x00 RETURN
+		initCode = common.FromHex("6001600055600060005360016000f3")
+	)
+	statedb.SetCode(reverting, revertingCode(encodeError("always")))
+	// JUMPDEST PUSH1 0x00 JUMP, looping until it runs out of gas.
+	statedb.SetCode(looping, common.FromHex("5b600056"))
+	root := statedb.IntermediateRoot(true)
+
+	newMsg := func(to *common.Address, value int64, data []byte) types.Message {
+		return types.NewMessage(
+			from, to, 0, big.NewInt(value), 0, big.NewInt(1), data, false,
+		)
+	}
+	succeeds := func(msg types.Message, gas uint64) bool {
+		msg = types.NewMessage(
+			msg.From(), msg.To(), 0, msg.Value(), gas, msg.GasPrice(), msg.Data(), false,
+		)
+		context := NewEVMContext(msg, header, nil, &testCoinbase)
+		vmenv := vm.NewEVM(context, statedb.Copy(), params.TestChainConfig, vm.Config{})
+		_, _, failed, err := ApplyMessage(vmenv, msg, new(GasPool).AddGas(gas))
+		return err == nil && !failed
+	}
+
+	for name, msg := range map[string]types.Message{
+		"transfer": newMsg(&recipient, 1000, nil),
+		"creation": newMsg(nil, 0, initCode),
+	} {
+		gas, err := EstimateGas(params.TestChainConfig, nil, statedb, header, msg, cap)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if name == "transfer" && gas != params.TxGas {
+			t.Errorf("%s: estimated %d gas, want %d", name, gas, params.TxGas)
+		}
+		if !succeeds(msg, gas) || succeeds(msg, gas-1) {
+			t.Errorf("%s: estimated %d gas is not the smallest sufficient gas", name, gas)
+		}
+	}
+
+	_, err := EstimateGas(
+		params.TestChainConfig, nil, statedb, header, newMsg(&reverting, 0, nil), cap,
+	)
+	if errors.Cause(err) != vm.ErrExecutionReverted || !strings.Contains(err.Error(), "always") {
+		t.Errorf("always reverting call: got error %v, want %v with its reason", err, vm.ErrExecutionReverted)
+	}
+	_, err = EstimateGas(
+		params.TestChainConfig, nil, statedb, header, newMsg(&looping, 0, nil), cap,
+	)
+	if errors.Cause(err) != ErrGasCapExceeded {
+		t.Errorf("call exceeding the cap: got error %v, want %v", err, ErrGasCapExceeded)
+	}
+
+	if statedb.IntermediateRoot(true) != root {
+		t.Error("estimating gas modified the state")
+	}
+}
@@ -65,11 +65,23 @@ func NewEVMContext(msg Message, header *block.Header, chain ChainContext, author
 		BlockNumber: header.Number(),
 		EpochNumber: header.Epoch(),
 		Time:        header.Time(),
+		BaseFee:     header.BaseFee(),
+		Random:      vrfRandomness(header),
 		GasLimit:    header.GasLimit(),
 		GasPrice:    new(big.Int).Set(msg.GasPrice()),
 	}
 }
 
+// vrfRandomness returns the VRF output of the block with the given header,
+// which precedes the VRF proof in its Vrf field, or nil if it has none.
+func vrfRandomness(header *block.Header) *big.Int {
+	vrf := header.Vrf()
+	if len(vrf) < 32 {
+		return nil
+	}
+	return new(big.Int).SetBytes(vrf[:32])
+}
+
 // GetHashFn returns a GetHashFunc which retrieves header hashes by number
 func GetHashFn(ref *block.Header, chain ChainContext) func(n uint64) common.Hash {
 	var cache map[uint64]common.Hash
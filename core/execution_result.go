@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/vm"
+)
+
+var (
+	// revertSelector is the selector of Error(string), used by require and
+	// revert with a reason.
+	revertSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+	// panicSelector is the selector of Panic(uint256), used by failed
+	// assertions and checked arithmetic.
+	panicSelector = []byte{0x4e, 0x48, 0x7b, 0x71}
+
+	// panicReasons describes the panic codes emitted by solidity.
+	panicReasons = map[uint64]string{
+		0x00: "generic panic",
+		0x01: "assert(false)",
+		0x11: "arithmetic underflow or overflow",
+		0x12: "division or modulo by zero",
+		0x21: "enum overflow",
+		0x22: "invalid encoded storage byte array accessed",
+		0x31: "out-of-bounds array access; popping on an empty array",
+		0x32: "out-of-bounds access of an array or bytesN",
+		0x41: "out of memory",
+		0x51: "uninitialized function",
+	}
+)
+
+// ExecutionResult is the outcome of the EVM execution of a transaction that
+// is not part of its consensus receipt.
+type ExecutionResult struct {
+	ReturnData []byte // return data of the top level call, or its revert data
+	VMErr      error  // error the execution ended with, if any
+
+	// CallTree is the top level call of the execution with the calls made
+	// within it, if recorded, see vm.Config.CallTree.
+	CallTree *vm.CallFrame
+
+	// OutOfGas is where the execution ran out of gas if it failed that way
+	// and recording it was enabled in debug mode, see
+	// vm.Config.OutOfGasPoint.
+	OutOfGas *vm.OutOfGasPoint
+
+	// StateDiff is the state modified by the transaction before and after
+	// it, if recorded, see ApplyTransactionWithStateDiff.
+	StateDiff state.Diff
+}
+
+// Failed returns whether the execution ended with an error.
+func (r *ExecutionResult) Failed() bool {
+	return r.VMErr != nil
+}
+
+// Reverted returns whether the execution was ended by REVERT, in which case
+// ReturnData holds the revert data.
+func (r *ExecutionResult) Reverted() bool {
+	return r.VMErr == vm.ErrExecutionReverted
+}
+
+// RevertReason decodes the revert data of a reverted execution. It returns
+// false if the execution was not reverted or if its revert data is neither
+// an Error(string) nor a Panic(uint256).
+func (r *ExecutionResult) RevertReason() (string, bool) {
+	if !r.Reverted() {
+		return "", false
+	}
+	return UnpackRevert(r.ReturnData)
+}
+
+// UnpackRevert decodes revert data encoded as Error(string) into its message
+// or encoded as Panic(uint256) into a description of its code.
+func UnpackRevert(data []byte) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	selector, args := data[:4], data[4:]
+	switch {
+	case bytes.Equal(selector, revertSelector):
+		return unpackString(args)
+	case bytes.Equal(selector, panicSelector):
+		if len(args) != 32 {
+			return "", false
+		}
+		code := new(big.Int).SetBytes(args)
+		if code.IsUint64() {
+			if reason, ok := panicReasons[code.Uint64()]; ok {
+				return reason, true
+			}
+		}
+		return fmt.Sprintf("unknown panic code: %#x", code), true
+	}
+	return "", false
+}
+
+// unpackString decodes the ABI encoding of a single string argument.
+func unpackString(args []byte) (string, bool) {
+	if len(args) < 64 {
+		return "", false
+	}
+	offset := new(big.Int).SetBytes(args[:32])
+	if !offset.IsUint64() || offset.Uint64() > uint64(len(args)-32) {
+		return "", false
+	}
+	start := offset.Uint64() + 32
+	length := new(big.Int).SetBytes(args[start-32 : start])
+	if !length.IsUint64() || length.Uint64() > uint64(len(args))-start {
+		return "", false
+	}
+	return string(args[start : start+length.Uint64()]), true
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/internal/params"
+)
+
+// revertingCode returns code reverting with data.
+func revertingCode(data []byte) []byte {
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(data)))
+	// PUSH2 size PUSH2 15 PUSH1 0 CODECOPY PUSH2 size PUSH1 0 REVERT
+	code := []byte{0x61, size[0], size[1], 0x61, 0x00, 0x0f, 0x60, 0x00, 0x39}
+	code = append(code, 0x61, size[0], size[1], 0x60, 0x00, 0xfd)
+	return append(code, data...)
+}
+
+// encodeError returns the encoding of Error(reason).
+func encodeError(reason string) []byte {
+	data := append([]byte{}, revertSelector...)
+	data = append(data, common.LeftPadBytes(big.NewInt(32).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(big.NewInt(int64(len(reason))).Bytes(), 32)...)
+	return append(data, common.RightPadBytes([]byte(reason), (len(reason)+31)/32*32)...)
+}
+
+func TestApplyTransactionWithResult(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+
+	var (
+		requireFalse = common.HexToAddress("0x1018")
+		rawRevert    = common.HexToAddress("0x1019")
+		assertFalse  = common.HexToAddress("0x101a")
+		raw          = common.LeftPadBytes(big.NewInt(42).Bytes(), 32)
+	)
+	statedb.SetCode(requireFalse, revertingCode(encodeError("msg")))
+	statedb.SetCode(rawRevert, revertingCode(raw))
+	statedb.SetCode(assertFalse, revertingCode(append(
+		append([]byte{}, panicSelector...), common.LeftPadBytes([]byte{0x01}, 32)...,
+	)))
+
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	apply := func(nonce uint64, to common.Address) (*types.Receipt, *ExecutionResult) {
+		receipt, _, result, _, err := ApplyTransactionWithResult(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				nonce, to, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != types.ReceiptStatusFailed {
+			t.Errorf("receipt status %d, want failed", receipt.Status)
+		}
+		if !result.Reverted() {
+			t.Errorf("execution not reverted: %v", result.VMErr)
+		}
+		return receipt, result
+	}
+
+	_, result := apply(0, requireFalse)
+	if reason, ok := result.RevertReason(); !ok || reason != "msg" {
+		t.Errorf("revert reason %q (%v), want \"msg\"", reason, ok)
+	}
+
+	_, result = apply(1, rawRevert)
+	if common.Bytes2Hex(result.ReturnData) != common.Bytes2Hex(raw) {
+		t.Errorf("revert data %x, want %x", result.ReturnData, raw)
+	}
+	if reason, ok := result.RevertReason(); ok {
+		t.Errorf("raw revert data decoded as %q", reason)
+	}
+
+	_, result = apply(2, assertFalse)
+	if reason, ok := result.RevertReason(); !ok || reason != "assert(false)" {
+		t.Errorf("revert reason %q (%v), want \"assert(false)\"", reason, ok)
+	}
+}
+
+func TestApplyTransactionCallTree(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	sender := crypto.PubkeyToAddress(keys[0].PublicKey)
+
+	var (
+		root     = common.HexToAddress("0x105a")
+		reverter = common.HexToAddress("0x105b")
+		creator  = common.HexToAddress("0x105c")
+		created  = crypto.CreateAddress(creator, 0)
+		raw      = common.LeftPadBytes(big.NewInt(42).Bytes(), 32)
+	)
+	// Call the reverter, then the creator, with no value and all the gas:
+	//
+	//   PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00
+	//   PUSH20 callee GAS CALL POP
+	call := func(callee common.Address) string {
+		return "60006000600060006000" + "73" + callee.Hex()[2:] + "5af150"
+	}
+	statedb.SetCode(root, common.FromHex(call(reverter)+call(creator)+"00"))
+	statedb.SetCode(reverter, revertingCode(raw))
+	// Create a contract whose code is a single STOP from the init code
+	// PUSH1 0x01 PUSH1 0x00 RETURN:
+	//
+	//   PUSH5 init PUSH1 0x00 MSTORE PUSH1 0x05 PUSH1 0x1b PUSH1 0x00 CREATE
+	//   POP STOP
+	statedb.SetCode(creator, common.FromHex("6460016000f36000526005601b6000f05000"))
+
+	apply := func(nonce uint64, cfg vm.Config) (*types.Receipt, *ExecutionResult) {
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, result, _, err := ApplyTransactionWithResult(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb.Copy(), header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				nonce, root, 0, big.NewInt(0), 200000, big.NewInt(1), nil,
+			)),
+			&usedGas, cfg,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receipt, result
+	}
+
+	if _, result := apply(0, vm.Config{}); result.CallTree != nil {
+		t.Errorf("call tree recorded without being enabled")
+	}
+	receipt, result := apply(0, vm.Config{CallTree: true})
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("transaction failed: %v", result.VMErr)
+	}
+
+	tree := result.CallTree
+	if tree == nil {
+		t.Fatal("no call tree")
+	}
+	check := func(name string, frame *vm.CallFrame, typ vm.OpCode, from, to common.Address, calls int) {
+		if frame.Type != typ || frame.From != from || frame.To != to || len(frame.Calls) != calls {
+			t.Errorf("%s: got %v %s -> %s with %d calls, want %v %s -> %s with %d",
+				name, frame.Type, frame.From.Hex(), frame.To.Hex(), len(frame.Calls),
+				typ, from.Hex(), to.Hex(), calls)
+		}
+		if frame.GasUsed > frame.Gas {
+			t.Errorf("%s: used %d gas out of %d", name, frame.GasUsed, frame.Gas)
+		}
+	}
+	check("top level call", tree, vm.CALL, sender, root, 2)
+	if tree.Gas != 200000-params.TxGas || tree.GasUsed != receipt.GasUsed-params.TxGas {
+		t.Errorf("top level call: got gas %d, used %d", tree.Gas, tree.GasUsed)
+	}
+	if tree.Value == nil || tree.Value.Sign() != 0 || tree.Error != nil {
+		t.Errorf("top level call: got value %v, error %v", tree.Value, tree.Error)
+	}
+	if len(tree.Calls) != 2 {
+		t.FailNow()
+	}
+
+	reverted := tree.Calls[0]
+	check("reverted call", reverted, vm.CALL, root, reverter, 0)
+	if reverted.Error != vm.ErrExecutionReverted {
+		t.Errorf("reverted call: got error %v, want %v", reverted.Error, vm.ErrExecutionReverted)
+	}
+	if !bytes.Equal(reverted.Output, raw) {
+		t.Errorf("reverted call: got output %x, want %x", reverted.Output, raw)
+	}
+
+	creating := tree.Calls[1]
+	check("creating call", creating, vm.CALL, root, creator, 1)
+	if len(creating.Calls) != 1 {
+		t.FailNow()
+	}
+	creation := creating.Calls[0]
+	check("creation", creation, vm.CREATE, creator, created, 0)
+	if !bytes.Equal(creation.Input, common.FromHex("60016000f3")) ||
+		!bytes.Equal(creation.Output, []byte{0x00}) || creation.Error != nil {
+		t.Errorf("creation: got input %x, output %x, error %v",
+			creation.Input, creation.Output, creation.Error)
+	}
+}
+
+func TestApplyTransactionOutOfGasPoint(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// Hash nothing forever, each round costing 50 gas:
+	//
+	//   JUMPDEST PUSH1 0x00 DUP1 SHA3 POP PUSH1 0x00 JUMP
+	loop := common.HexToAddress("0x107b")
+	statedb.SetCode(loop, common.FromHex("5b6000802050600056"))
+	// Ten rounds, then the gas of the operations before SHA3 and some.
+	gas := params.TxGas + 10*50 + 7 + 20
+
+	apply := func(cfg vm.Config) *ExecutionResult {
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, result, _, err := ApplyTransactionWithResult(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb.Copy(), header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, loop, 0, big.NewInt(0), gas, big.NewInt(1), nil,
+			)),
+			&usedGas, cfg,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.VMErr != vm.ErrOutOfGas {
+			t.Fatalf("got error %v, want %v", result.VMErr, vm.ErrOutOfGas)
+		}
+		return result
+	}
+
+	if result := apply(vm.Config{OutOfGasPoint: true}); result.OutOfGas != nil {
+		t.Error("out of gas point recorded outside debug mode")
+	}
+	result := apply(vm.Config{
+		Debug: true, Tracer: vm.NewStructLogger(nil), OutOfGasPoint: true,
+	})
+	want := vm.OutOfGasPoint{Contract: loop, PC: 4, Op: vm.SHA3, Depth: 1, GasLeft: 20}
+	if result.OutOfGas == nil || *result.OutOfGas != want {
+		t.Errorf("got out of gas point %+v, want %+v", result.OutOfGas, want)
+	}
+}
+
+func TestUnpackRevert(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		reason string
+		ok     bool
+	}{
+		{encodeError(""), "", true},
+		{encodeError("a reason longer than one word of thirty-two bytes"),
+			"a reason longer than one word of thirty-two bytes", true},
+		{append(append([]byte{}, panicSelector...), common.LeftPadBytes([]byte{0x11}, 32)...),
+			"arithmetic underflow or overflow", true},
+		{append(append([]byte{}, panicSelector...), common.LeftPadBytes([]byte{0x99}, 32)...),
+			"unknown panic code: 0x99", true},
+		{nil, "", false},
+		{revertSelector, "", false},
+		{encodeError("truncated")[:4+64], "", false},
+		{append(append(append([]byte{}, revertSelector...),
+			common.LeftPadBytes([]byte{0xff}, 32)...), make([]byte, 32)...), "", false},
+	}
+	for i, test := range tests {
+		reason, ok := UnpackRevert(test.data)
+		if reason != test.reason || ok != test.ok {
+			t.Errorf("%d: got %q (%v), want %q (%v)", i, reason, ok, test.reason, test.ok)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/harmony-one/harmony/block"
+	consensus_engine "github.com/harmony-one/harmony/consensus/engine"
+	"github.com/harmony-one/harmony/consensus/reward"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/staking/effective"
+	"github.com/harmony-one/harmony/staking/slash"
+	staking "github.com/harmony-one/harmony/staking/types"
+	"github.com/pkg/errors"
+)
+
+// SlashedValidator is a validator penalized by the slash records of a block.
+type SlashedValidator struct {
+	Address common.Address
+	// Slashed is the stake finalizing the block took from the delegations
+	// of the validator, its own included, and from their undelegations.
+	// Pending rewards taken are not counted, as the block pays out rewards
+	// as well.
+	Slashed      *big.Int
+	StatusBefore effective.Eligibility
+	StatusAfter  effective.Eligibility
+}
+
+// ProcessWithSlashes is like Process but additionally returns the validators
+// accused by the slash records of the block, see ProcessResult.Slashes.
+func (p *StateProcessor) ProcessWithSlashes(
+	block *types.Block, statedb *state.DB, cfg vm.Config,
+) (
+	types.Receipts, types.CXReceipts,
+	[]*types.Log, uint64, reward.Reader, []SlashedValidator, error,
+) {
+	result, err := p.ProcessWithOptions(
+		block, statedb, cfg, ProcessOptions{Slashes: true},
+	)
+	if err != nil {
+		return nil, nil, nil, 0, nil, nil, err
+	}
+	return result.Receipts, result.CXReceipts, result.Logs, result.UsedGas,
+		result.Payout, result.Slashes, nil
+}
+
+// slashTrackingEngine is an engine recording the stake of the validators
+// accused by the slash records of a block before finalizing it.
+type slashTrackingEngine struct {
+	consensus_engine.Engine
+
+	before []*validatorStake
+}
+
+// Finalize records the stake of the accused validators and finalizes the
+// block with the wrapped engine.
+func (e *slashTrackingEngine) Finalize(
+	chain consensus_engine.ChainReader, header *block.Header,
+	state *state.DB, txs []*types.Transaction,
+	receipts []*types.Receipt, outcxs []*types.CXReceipt,
+	incxs []*types.CXReceiptsProof, stks staking.StakingTransactions,
+	doubleSigners slash.Records,
+) (*types.Block, reward.Reader, error) {
+	seen := map[common.Address]bool{}
+	for _, record := range doubleSigners {
+		offender := record.Evidence.Offender
+		if seen[offender] {
+			continue
+		}
+		seen[offender] = true
+		stake, err := stakeOf(state, offender)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.before = append(e.before, stake)
+	}
+	return e.Engine.Finalize(
+		chain, header, state, txs, receipts, outcxs, incxs, stks, doubleSigners,
+	)
+}
+
+// validatorStake is the stake of a validator at some point.
+type validatorStake struct {
+	address       common.Address
+	status        effective.Eligibility
+	delegations   []*big.Int
+	undelegations []map[uint64]*big.Int // by epoch, for every delegation
+}
+
+// stakeOf returns the current stake of the validator with the given address.
+func stakeOf(statedb *state.DB, addr common.Address) (*validatorStake, error) {
+	wrapper, err := statedb.ValidatorWrapper(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read validator %s", addr.Hex())
+	}
+	stake := &validatorStake{address: addr, status: wrapper.Status}
+	for _, delegation := range wrapper.Delegations {
+		undelegations := map[uint64]*big.Int{}
+		for _, undelegation := range delegation.Undelegations {
+			undelegations[undelegation.Epoch.Uint64()] = new(big.Int).Set(undelegation.Amount)
+		}
+		stake.delegations = append(stake.delegations, new(big.Int).Set(delegation.Amount))
+		stake.undelegations = append(stake.undelegations, undelegations)
+	}
+	return stake, nil
+}
+
+// minus returns how much stake s has more than later, a later stake of the
+// same validator, only counting the undelegations both have.
+func (s *validatorStake) minus(later *validatorStake) *big.Int {
+	diff := new(big.Int)
+	for i, amount := range s.delegations {
+		if i >= len(later.delegations) {
+			break
+		}
+		diff.Add(diff, amount).Sub(diff, later.delegations[i])
+		for epoch, undelegated := range s.undelegations[i] {
+			if left, ok := later.undelegations[i][epoch]; ok {
+				diff.Add(diff, undelegated).Sub(diff, left)
+			}
+		}
+	}
+	return diff
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/harmony-one/harmony/consensus/reward"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	staking2 "github.com/harmony-one/harmony/staking"
+	staking "github.com/harmony-one/harmony/staking/types"
+	"github.com/pkg/errors"
+)
+
+// StakingDirective is a staking transaction applied in a block, e.g. for
+// indexers tracking the lifecycle of validators.
+type StakingDirective struct {
+	TxHash           common.Hash
+	Directive        staking.Directive
+	ValidatorAddress common.Address // zero for CollectRewards
+	DelegatorAddress common.Address // the validator for CreateValidator and EditValidator
+	// Amount is the amount staked by CreateValidator, delegated by Delegate,
+	// undelegated by Undelegate or collected by CollectRewards. It is nil for
+	// EditValidator, and for CollectRewards in blocks without receipt logs.
+	Amount *big.Int
+}
+
+// ProcessWithStakingDirectives is like Process but additionally returns the
+// staking directives applied by the staking transactions of the block, in
+// block order.
+func (p *StateProcessor) ProcessWithStakingDirectives(
+	block *types.Block, statedb *state.DB, cfg vm.Config,
+) (
+	types.Receipts, types.CXReceipts,
+	[]*types.Log, uint64, reward.Reader, []StakingDirective, error,
+) {
+	result, err := p.ProcessWithOptions(
+		block, statedb, cfg, ProcessOptions{StakingDirectives: true},
+	)
+	if err != nil {
+		return nil, nil, nil, 0, nil, nil, err
+	}
+	return result.Receipts, result.CXReceipts, result.Logs, result.UsedGas,
+		result.Payout, result.StakingDirectives, nil
+}
+
+// stakingDirectives describes the applied staking transactions txs given
+// their receipts.
+func stakingDirectives(
+	txs staking.StakingTransactions, receipts types.Receipts,
+) ([]StakingDirective, error) {
+	directives := make([]StakingDirective, len(txs))
+	for i, tx := range txs {
+		payload, err := tx.RLPEncodeStakeMsg()
+		if err != nil {
+			return nil, err
+		}
+		directive := StakingDirective{
+			TxHash:    tx.Hash(),
+			Directive: tx.StakingType(),
+		}
+		switch tx.StakingType() {
+		case staking.DirectiveCreateValidator:
+			msg := staking.CreateValidator{}
+			err = rlp.DecodeBytes(payload, &msg)
+			directive.ValidatorAddress = msg.ValidatorAddress
+			directive.DelegatorAddress = msg.ValidatorAddress
+			directive.Amount = msg.Amount
+		case staking.DirectiveEditValidator:
+			msg := staking.EditValidator{}
+			err = rlp.DecodeBytes(payload, &msg)
+			directive.ValidatorAddress = msg.ValidatorAddress
+			directive.DelegatorAddress = msg.ValidatorAddress
+		case staking.DirectiveDelegate:
+			msg := staking.Delegate{}
+			err = rlp.DecodeBytes(payload, &msg)
+			directive.ValidatorAddress = msg.ValidatorAddress
+			directive.DelegatorAddress = msg.DelegatorAddress
+			directive.Amount = msg.Amount
+		case staking.DirectiveUndelegate:
+			msg := staking.Undelegate{}
+			err = rlp.DecodeBytes(payload, &msg)
+			directive.ValidatorAddress = msg.ValidatorAddress
+			directive.DelegatorAddress = msg.DelegatorAddress
+			directive.Amount = msg.Amount
+		case staking.DirectiveCollectRewards:
+			msg := staking.CollectRewards{}
+			err = rlp.DecodeBytes(payload, &msg)
+			directive.DelegatorAddress = msg.DelegatorAddress
+			for _, log := range receipts[i].Logs {
+				if len(log.Topics) > 0 && log.Topics[0] == staking2.CollectRewardsTopic {
+					directive.Amount = new(big.Int).SetBytes(log.Data)
+				}
+			}
+		default:
+			err = staking.ErrInvalidStakingKind
+		}
+		if err != nil {
+			return nil, errors.Wrapf(
+				err, "cannot decode staking transaction %d (%s)", i, tx.Hash().Hex(),
+			)
+		}
+		directives[i] = directive
+	}
+	return directives, nil
+}
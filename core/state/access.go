@@ -0,0 +1,209 @@
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AccessSet records the accounts and storage slots touched on a DB while it
+// is attached with SetAccessSet. Every write is recorded as a read as well,
+// so that two sets can be checked for conflicts by intersecting the writes of
+// one with the reads of the other.
+type AccessSet struct {
+	ReadAccounts  map[common.Address]struct{}
+	WriteAccounts map[common.Address]struct{}
+	ReadSlots     map[common.Address]map[common.Hash]struct{}
+	WriteSlots    map[common.Address]map[common.Hash]struct{}
+}
+
+// NewAccessSet returns an empty access set.
+func NewAccessSet() *AccessSet {
+	return &AccessSet{
+		ReadAccounts:  make(map[common.Address]struct{}),
+		WriteAccounts: make(map[common.Address]struct{}),
+		ReadSlots:     make(map[common.Address]map[common.Hash]struct{}),
+		WriteSlots:    make(map[common.Address]map[common.Hash]struct{}),
+	}
+}
+
+func (s *AccessSet) readAccount(addr common.Address) {
+	s.ReadAccounts[addr] = struct{}{}
+}
+
+func (s *AccessSet) writeAccount(addr common.Address) {
+	s.ReadAccounts[addr] = struct{}{}
+	s.WriteAccounts[addr] = struct{}{}
+}
+
+func (s *AccessSet) readSlot(addr common.Address, key common.Hash) {
+	addSlot(s.ReadSlots, addr, key)
+}
+
+func (s *AccessSet) writeSlot(addr common.Address, key common.Hash) {
+	addSlot(s.ReadSlots, addr, key)
+	addSlot(s.WriteSlots, addr, key)
+}
+
+func addSlot(
+	slots map[common.Address]map[common.Hash]struct{},
+	addr common.Address, key common.Hash,
+) {
+	keys, ok := slots[addr]
+	if !ok {
+		keys = make(map[common.Hash]struct{})
+		slots[addr] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// Merge adds all the reads and writes of other into s.
+func (s *AccessSet) Merge(other *AccessSet) {
+	for addr := range other.ReadAccounts {
+		s.ReadAccounts[addr] = struct{}{}
+	}
+	for addr := range other.WriteAccounts {
+		s.WriteAccounts[addr] = struct{}{}
+	}
+	for addr, keys := range other.ReadSlots {
+		for key := range keys {
+			addSlot(s.ReadSlots, addr, key)
+		}
+	}
+	for addr, keys := range other.WriteSlots {
+		for key := range keys {
+			addSlot(s.WriteSlots, addr, key)
+		}
+	}
+}
+
+// Conflicts reports whether anything read by s was written in prior, or
+// whether s rewrites an account whose storage was modified in prior. A set
+// that does not conflict with prior observes the same state whether it was
+// recorded before or after the writes of prior were applied.
+func (s *AccessSet) Conflicts(prior *AccessSet) bool {
+	for addr := range s.ReadAccounts {
+		if _, ok := prior.WriteAccounts[addr]; ok {
+			return true
+		}
+	}
+	for addr, keys := range s.ReadSlots {
+		if _, ok := prior.WriteAccounts[addr]; ok {
+			return true
+		}
+		written, ok := prior.WriteSlots[addr]
+		if !ok {
+			continue
+		}
+		for key := range keys {
+			if _, ok := written[key]; ok {
+				return true
+			}
+		}
+	}
+	for addr := range s.WriteAccounts {
+		if _, ok := prior.WriteSlots[addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAccessSet attaches set to the state so that subsequent account and
+// storage accesses are recorded into it. A nil set disables recording.
+func (db *DB) SetAccessSet(set *AccessSet) {
+	db.accessSet = set
+}
+
+// AccessSet returns the access set currently attached to the state, if any.
+func (db *DB) AccessSet() *AccessSet {
+	return db.accessSet
+}
+
+func (db *DB) recordAccountRead(addr common.Address) {
+	if db.accessSet != nil {
+		db.accessSet.readAccount(addr)
+	}
+}
+
+func (db *DB) recordAccountWrite(addr common.Address) {
+	if db.accessSet != nil {
+		db.accessSet.writeAccount(addr)
+	}
+}
+
+// recordBalanceChange records a balance update, which only counts as a write
+// when it changes the balance or touches an empty account.
+func (db *DB) recordBalanceChange(addr common.Address, amount *big.Int) {
+	if db.accessSet == nil {
+		return
+	}
+	if amount.Sign() != 0 || db.Empty(addr) {
+		db.accessSet.writeAccount(addr)
+		return
+	}
+	db.accessSet.readAccount(addr)
+}
+
+func (db *DB) recordSlotRead(addr common.Address, key common.Hash) {
+	if db.accessSet != nil {
+		db.accessSet.readSlot(addr, key)
+	}
+}
+
+func (db *DB) recordSlotWrite(addr common.Address, key common.Hash) {
+	if db.accessSet != nil {
+		db.accessSet.writeSlot(addr, key)
+	}
+}
+
+// ApplyWrites copies the values written in src, as recorded by writes, into
+// db. src must have been copied from db (or from an ancestor state of db that
+// shares the written entries) and must have been finalised since.
+func (db *DB) ApplyWrites(src *DB, writes *AccessSet) {
+	accounts := make([]common.Address, 0, len(writes.WriteAccounts))
+	for addr := range writes.WriteAccounts {
+		accounts = append(accounts, addr)
+	}
+	for _, addr := range sortAddresses(accounts) {
+		obj := src.getStateObject(addr)
+		if obj == nil {
+			// The account was removed by src, e.g. through self-destruct
+			// or by touching an empty account.
+			if db.Exist(addr) {
+				db.Suicide(addr)
+			}
+			continue
+		}
+		db.setStateObject(obj.deepCopy(db))
+		db.journal.dirty(addr)
+	}
+	slotted := make([]common.Address, 0, len(writes.WriteSlots))
+	for addr := range writes.WriteSlots {
+		slotted = append(slotted, addr)
+	}
+	for _, addr := range sortAddresses(slotted) {
+		if _, ok := writes.WriteAccounts[addr]; ok {
+			continue
+		}
+		keys := make([]common.Hash, 0, len(writes.WriteSlots[addr]))
+		for key := range writes.WriteSlots[addr] {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i][:], keys[j][:]) < 0
+		})
+		for _, key := range keys {
+			db.SetState(addr, key, src.GetState(addr, key))
+		}
+	}
+}
+
+func sortAddresses(addrs []common.Address) []common.Address {
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	return addrs
+}
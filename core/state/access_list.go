@@ -0,0 +1,175 @@
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/harmony-one/harmony/core/types"
+)
+
+// accessList is the EIP-2929 set of accounts and storage slots that have
+// already been accessed by the current transaction.
+type accessList struct {
+	addresses map[common.Address]int
+	slots     []map[common.Hash]struct{}
+}
+
+func newAccessList() *accessList {
+	return &accessList{
+		addresses: make(map[common.Address]int),
+	}
+}
+
+// ContainsAddress returns true if the address is in the access list.
+func (al *accessList) ContainsAddress(address common.Address) bool {
+	_, ok := al.addresses[address]
+	return ok
+}
+
+// Contains checks if a slot within an account is present in the access list,
+// returning separate flags for the presence of the account and the slot.
+func (al *accessList) Contains(
+	address common.Address, slot common.Hash,
+) (addressPresent bool, slotPresent bool) {
+	idx, ok := al.addresses[address]
+	if !ok {
+		return false, false
+	}
+	if idx == -1 {
+		return true, false
+	}
+	_, slotPresent = al.slots[idx][slot]
+	return true, slotPresent
+}
+
+// Copy creates an independent copy of an accessList.
+func (al *accessList) Copy() *accessList {
+	cp := newAccessList()
+	for k, v := range al.addresses {
+		cp.addresses[k] = v
+	}
+	cp.slots = make([]map[common.Hash]struct{}, len(al.slots))
+	for i, slotMap := range al.slots {
+		newSlotmap := make(map[common.Hash]struct{}, len(slotMap))
+		for k := range slotMap {
+			newSlotmap[k] = struct{}{}
+		}
+		cp.slots[i] = newSlotmap
+	}
+	return cp
+}
+
+// AddAddress adds an address to the access list, and returns true if the
+// operation caused a change (addr was not previously in the list).
+func (al *accessList) AddAddress(address common.Address) bool {
+	if _, present := al.addresses[address]; present {
+		return false
+	}
+	al.addresses[address] = -1
+	return true
+}
+
+// AddSlot adds the specified (addr, slot) combo to the access list. It
+// returns whether the address and the slot were newly added.
+func (al *accessList) AddSlot(
+	address common.Address, slot common.Hash,
+) (addrChange bool, slotChange bool) {
+	idx, addrPresent := al.addresses[address]
+	if !addrPresent || idx == -1 {
+		// Address not present, or addr present but no slots there
+		al.addresses[address] = len(al.slots)
+		slotmap := map[common.Hash]struct{}{slot: {}}
+		al.slots = append(al.slots, slotmap)
+		return !addrPresent, true
+	}
+	// There is already an (address,slot) mapping
+	slotmap := al.slots[idx]
+	if _, ok := slotmap[slot]; !ok {
+		slotmap[slot] = struct{}{}
+		return false, true
+	}
+	return false, false
+}
+
+// DeleteSlot removes an (address, slot)-tuple from the access list. It is
+// only used for reverting a journalled addition, so the slot is always the
+// last one that was added for the address.
+func (al *accessList) DeleteSlot(address common.Address, slot common.Hash) {
+	idx, ok := al.addresses[address]
+	if !ok {
+		panic("reverting slot change, address not present in list")
+	}
+	slotmap := al.slots[idx]
+	delete(slotmap, slot)
+	// If that was the last (first) slot, remove it. Since additions and
+	// removals are journalled, the slots of the address are the last ones.
+	if len(slotmap) == 0 {
+		al.slots = al.slots[:idx]
+		al.addresses[address] = -1
+	}
+}
+
+// DeleteAddress removes an address from the access list, which is only
+// valid when reverting a journalled addition without slots.
+func (al *accessList) DeleteAddress(address common.Address) {
+	delete(al.addresses, address)
+}
+
+// PrepareAccessList resets the access list for a new transaction and warms
+// up the sender, the destination (if any), the precompiled contracts and
+// everything listed in the transaction's access list.
+func (db *DB) PrepareAccessList(
+	sender common.Address, dst *common.Address,
+	precompiles []common.Address, list types.AccessList,
+) {
+	db.accessList = newAccessList()
+	db.AddAddressToAccessList(sender)
+	if dst != nil {
+		db.AddAddressToAccessList(*dst)
+	}
+	for _, addr := range precompiles {
+		db.AddAddressToAccessList(addr)
+	}
+	for _, el := range list {
+		db.AddAddressToAccessList(el.Address)
+		for _, key := range el.StorageKeys {
+			db.AddSlotToAccessList(el.Address, key)
+		}
+	}
+}
+
+// AddAddressToAccessList adds the given address to the access list.
+func (db *DB) AddAddressToAccessList(addr common.Address) {
+	if db.accessList.AddAddress(addr) {
+		db.journal.append(accessListAddAccountChange{&addr})
+	}
+}
+
+// AddSlotToAccessList adds the given (address, slot) to the access list.
+func (db *DB) AddSlotToAccessList(addr common.Address, slot common.Hash) {
+	addrMod, slotMod := db.accessList.AddSlot(addr, slot)
+	if addrMod {
+		// In practice, this should not happen, since there is no way to enter
+		// the scope of 'address' without having the 'address' become already
+		// added to the access list (via call-variant, create, etc). Better
+		// safe than sorry, though.
+		db.journal.append(accessListAddAccountChange{&addr})
+	}
+	if slotMod {
+		db.journal.append(accessListAddSlotChange{
+			address: &addr,
+			slot:    &slot,
+		})
+	}
+}
+
+// AddressInAccessList returns true if the given address is in the access list.
+func (db *DB) AddressInAccessList(addr common.Address) bool {
+	return db.accessList.ContainsAddress(addr)
+}
+
+// SlotInAccessList returns whether the given address and slot are in the
+// access list.
+func (db *DB) SlotInAccessList(
+	addr common.Address, slot common.Hash,
+) (addressPresent bool, slotPresent bool) {
+	return db.accessList.Contains(addr, slot)
+}
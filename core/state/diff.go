@@ -0,0 +1,156 @@
+package state
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AccountState is the state of an account as recorded in a Diff. Storage
+// only holds the slots that were written to.
+type AccountState struct {
+	Balance *big.Int
+	Nonce   uint64
+	Code    []byte
+	Storage map[common.Hash]common.Hash
+}
+
+// AccountDiff is the state of an account before and after a set of changes.
+type AccountDiff struct {
+	Pre, Post AccountState
+}
+
+// Diff maps the accounts modified by a set of changes to their state before
+// and after them.
+type Diff map[common.Address]*AccountDiff
+
+// accountPre collects the state of an account before a set of changes from
+// the journal entries undoing them. Fields are set by the first entry
+// touching them; the ones left unset were not modified.
+type accountPre struct {
+	balance  *big.Int
+	nonce    *uint64
+	code     []byte
+	hasCode  bool
+	storage  map[common.Hash]common.Hash
+	replaced *Object // account replaced by CreateAccount, if any
+}
+
+// DiffSince returns the accounts modified since the snapshot with the given
+// revision id was taken, with their balance, nonce, code and written storage
+// slots before and after the changes. Accounts that self-destructed are
+// empty after them. The diff is built from the journal rather than by
+// comparing tries, so it must be taken before the state is finalised.
+func (db *DB) DiffSince(revid int) Diff {
+	idx := sort.Search(len(db.validRevisions), func(i int) bool {
+		return db.validRevisions[i].id >= revid
+	})
+	if idx == len(db.validRevisions) || db.validRevisions[idx].id != revid {
+		panic(fmt.Errorf("revision id %v cannot be diffed", revid))
+	}
+
+	pres := make(map[common.Address]*accountPre)
+	pre := func(addr common.Address) *accountPre {
+		p, ok := pres[addr]
+		if !ok {
+			p = &accountPre{storage: make(map[common.Hash]common.Hash)}
+			pres[addr] = p
+		}
+		return p
+	}
+	for _, entry := range db.journal.entries[db.validRevisions[idx].journalIndex:] {
+		switch ch := entry.(type) {
+		case createObjectChange:
+			p := pre(*ch.account)
+			p.setBalance(new(big.Int))
+			p.setNonce(0)
+			p.setCode(nil)
+		case resetObjectChange:
+			p := pre(ch.prev.address)
+			p.setBalance(ch.prev.Balance())
+			p.setNonce(ch.prev.Nonce())
+			p.setCode(ch.prev.Code(db.db))
+			if p.replaced == nil {
+				p.replaced = ch.prev
+			}
+		case suicideChange:
+			pre(*ch.account).setBalance(ch.prevbalance)
+		case balanceChange:
+			pre(*ch.account).setBalance(ch.prev)
+		case nonceChange:
+			pre(*ch.account).setNonce(ch.prev)
+		case codeChange:
+			pre(*ch.account).setCode(ch.prevcode)
+		case storageChange:
+			p := pre(*ch.account)
+			if _, ok := p.storage[ch.key]; ok {
+				continue
+			}
+			if p.replaced != nil {
+				p.storage[ch.key] = p.replaced.GetState(db.db, ch.key)
+			} else {
+				p.storage[ch.key] = ch.prevalue
+			}
+		}
+	}
+
+	diff := make(Diff, len(pres))
+	for addr, p := range pres {
+		// Both states start from the current one; modified fields are then
+		// set back in the state before the changes.
+		d := &AccountDiff{
+			Pre: AccountState{
+				Balance: db.GetBalance(addr),
+				Nonce:   db.GetNonce(addr),
+				Code:    db.GetCode(addr),
+				Storage: p.storage,
+			},
+			Post: AccountState{
+				Storage: make(map[common.Hash]common.Hash, len(p.storage)),
+			},
+		}
+		if db.HasSuicided(addr) {
+			d.Post.Balance = new(big.Int)
+			for key := range p.storage {
+				d.Post.Storage[key] = common.Hash{}
+			}
+		} else {
+			d.Post.Balance = new(big.Int).Set(d.Pre.Balance)
+			d.Post.Nonce, d.Post.Code = d.Pre.Nonce, d.Pre.Code
+			for key := range p.storage {
+				d.Post.Storage[key] = db.GetState(addr, key)
+			}
+		}
+		if p.balance != nil {
+			d.Pre.Balance = p.balance
+		}
+		if p.nonce != nil {
+			d.Pre.Nonce = *p.nonce
+		}
+		if p.hasCode {
+			d.Pre.Code = p.code
+		}
+		diff[addr] = d
+	}
+	return diff
+}
+
+func (p *accountPre) setBalance(balance *big.Int) {
+	if p.balance == nil {
+		p.balance = new(big.Int).Set(balance)
+	}
+}
+
+func (p *accountPre) setNonce(nonce uint64) {
+	if p.nonce == nil {
+		p.nonce = &nonce
+	}
+}
+
+func (p *accountPre) setCode(code []byte) {
+	if !p.hasCode {
+		p.code, p.hasCode = code, true
+	}
+}
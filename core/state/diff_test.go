@@ -0,0 +1,76 @@
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// Tests that DiffSince reports the state of the accounts modified since a
+// snapshot before and after the changes, and nothing else.
+func TestDiffSince(t *testing.T) {
+	state, _ := New(common.Hash{}, NewDatabase(ethdb.NewMemDatabase()))
+
+	var (
+		untouched = common.BytesToAddress([]byte{0x01})
+		modified  = common.BytesToAddress([]byte{0x02})
+		created   = common.BytesToAddress([]byte{0x03})
+		suicided  = common.BytesToAddress([]byte{0x04})
+		slot      = common.BytesToHash([]byte{0x01})
+	)
+	for _, addr := range []common.Address{untouched, modified, suicided} {
+		state.AddBalance(addr, big.NewInt(10))
+		state.SetNonce(addr, 1)
+		state.SetState(addr, slot, common.BytesToHash([]byte{0x07}))
+	}
+	state.Finalise(true)
+
+	revid := state.Snapshot()
+	state.AddBalance(modified, big.NewInt(5))
+	state.SetNonce(modified, 2)
+	state.SetState(modified, slot, common.BytesToHash([]byte{0x2a}))
+	state.SetCode(created, []byte{0x00})
+	state.Suicide(suicided)
+	diff := state.DiffSince(revid)
+
+	if _, ok := diff[untouched]; ok {
+		t.Error("untouched account in the diff")
+	}
+	tests := []struct {
+		addr                  common.Address
+		preBalance, postBal   int64
+		preNonce, postNonce   uint64
+		preStorage, postStore common.Hash
+	}{
+		{modified, 10, 15, 1, 2, common.BytesToHash([]byte{0x07}), common.BytesToHash([]byte{0x2a})},
+		{created, 0, 0, 0, 0, common.Hash{}, common.Hash{}},
+		{suicided, 10, 0, 1, 0, common.Hash{}, common.Hash{}},
+	}
+	if len(diff) != len(tests) {
+		t.Errorf("got %d accounts in the diff, want %d", len(diff), len(tests))
+	}
+	for i, test := range tests {
+		d, ok := diff[test.addr]
+		if !ok {
+			t.Errorf("index: %v, account missing from the diff", i)
+			continue
+		}
+		if d.Pre.Balance.Int64() != test.preBalance || d.Post.Balance.Int64() != test.postBal {
+			t.Errorf("index: %v, expected balance %v -> %v, got %v -> %v",
+				i, test.preBalance, test.postBal, d.Pre.Balance, d.Post.Balance)
+		}
+		if d.Pre.Nonce != test.preNonce || d.Post.Nonce != test.postNonce {
+			t.Errorf("index: %v, expected nonce %v -> %v, got %v -> %v",
+				i, test.preNonce, test.postNonce, d.Pre.Nonce, d.Post.Nonce)
+		}
+		if d.Pre.Storage[slot] != test.preStorage || d.Post.Storage[slot] != test.postStore {
+			t.Errorf("index: %v, expected slot %x -> %x, got %x -> %x",
+				i, test.preStorage, test.postStore, d.Pre.Storage[slot], d.Post.Storage[slot])
+		}
+	}
+	if d := diff[created]; d != nil && (d.Pre.Code != nil || len(d.Post.Code) != 1) {
+		t.Errorf("created account: got code %x -> %x", d.Pre.Code, d.Post.Code)
+	}
+}
@@ -19,6 +19,7 @@ package state
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -95,3 +96,77 @@ func (db *DB) Dump() string {
 
 	return string(json)
 }
+
+// DumpDiff is a difference between an account of a dump and the same account
+// of an expected dump.
+type DumpDiff struct {
+	Account string `json:"account"`
+	// Field is one of account, balance, nonce, codeHash, code or
+	// storage/<key>; an account present on only one side is a single
+	// difference of its account field.
+	Field string `json:"field"`
+	Got   string `json:"got"`
+	Want  string `json:"want"`
+}
+
+// Diff returns the differences between the accounts of dump and the ones of
+// expected, ordered by account and field so that the outcome is deterministic.
+func (dump Dump) Diff(expected Dump) []DumpDiff {
+	accounts := make([]string, 0, len(dump.Accounts))
+	for account := range dump.Accounts {
+		accounts = append(accounts, account)
+	}
+	for account := range expected.Accounts {
+		if _, ok := dump.Accounts[account]; !ok {
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Strings(accounts)
+
+	diffs := []DumpDiff{}
+	for _, account := range accounts {
+		got, inDump := dump.Accounts[account]
+		want, inExpected := expected.Accounts[account]
+		if !inDump || !inExpected {
+			diffs = append(diffs, DumpDiff{
+				account, "account", presence(inDump), presence(inExpected),
+			})
+			continue
+		}
+		for _, field := range [...]struct{ name, got, want string }{
+			{"balance", got.Balance, want.Balance},
+			{"code", got.Code, want.Code},
+			{"codeHash", got.CodeHash, want.CodeHash},
+			{"nonce", fmt.Sprint(got.Nonce), fmt.Sprint(want.Nonce)},
+		} {
+			if field.got != field.want {
+				diffs = append(diffs, DumpDiff{account, field.name, field.got, field.want})
+			}
+		}
+		keys := make([]string, 0, len(got.Storage))
+		for key := range got.Storage {
+			keys = append(keys, key)
+		}
+		for key := range want.Storage {
+			if _, ok := got.Storage[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if got.Storage[key] != want.Storage[key] {
+				diffs = append(diffs, DumpDiff{
+					account, "storage/" + key, got.Storage[key], want.Storage[key],
+				})
+			}
+		}
+	}
+	return diffs
+}
+
+func presence(present bool) string {
+	if present {
+		return "present"
+	}
+	return "absent"
+}
@@ -129,6 +129,15 @@ type (
 	touchChange struct {
 		account *common.Address
 	}
+
+	// Changes to the access list
+	accessListAddAccountChange struct {
+		address *common.Address
+	}
+	accessListAddSlotChange struct {
+		address *common.Address
+		slot    *common.Hash
+	}
 )
 
 func (ch createObjectChange) revert(s *DB) {
@@ -230,3 +239,26 @@ func (ch addPreimageChange) revert(s *DB) {
 func (ch addPreimageChange) dirtied() *common.Address {
 	return nil
 }
+
+func (ch accessListAddAccountChange) revert(s *DB) {
+	// One important invariant here, is that whenever a (addr, slot) is added,
+	// if the addr is not already present, the add causes two journal entries:
+	// - one for the address,
+	// - one for the (address,slot)
+	// Therefore, when unrolling the change, we can always blindly delete the
+	// (addr) at this point, since no storage adds can remain when come upon
+	// a single (addr) change.
+	s.accessList.DeleteAddress(*ch.address)
+}
+
+func (ch accessListAddAccountChange) dirtied() *common.Address {
+	return nil
+}
+
+func (ch accessListAddSlotChange) revert(s *DB) {
+	s.accessList.DeleteSlot(*ch.address, *ch.slot)
+}
+
+func (ch accessListAddSlotChange) dirtied() *common.Address {
+	return nil
+}
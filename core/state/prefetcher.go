@@ -0,0 +1,28 @@
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Prefetcher reads accounts from a private copy of the account trie of a DB,
+// e.g. to load the trie nodes of accounts into the node cache of the database
+// before the DB itself reads them.
+type Prefetcher struct {
+	trie Trie
+}
+
+// NewPrefetcher returns a Prefetcher reading the accounts of db as of the
+// root of its account trie. NewPrefetcher must not be called concurrently with
+// other methods of db, but the returned Prefetcher can be used concurrently
+// with db.
+func (db *DB) NewPrefetcher() *Prefetcher {
+	return &Prefetcher{trie: db.db.CopyTrie(db.trie)}
+}
+
+// Prefetch reads the account addr, resolving the trie nodes on its path. It
+// is best effort: missing nodes and other errors are ignored, as the DB runs
+// into them on its own when it reads the account. A Prefetcher is not safe
+// for concurrent use.
+func (p *Prefetcher) Prefetch(addr common.Address) {
+	p.trie.TryGet(addr[:])
+}
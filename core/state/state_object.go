@@ -169,6 +169,9 @@ func (so *Object) GetState(db Database, key common.Hash) common.Hash {
 	// If we have a dirty value for this state entry, return it
 	value, dirty := so.dirtyStorage[key]
 	if dirty {
+		if so.db.trieStats != nil {
+			so.db.trieStats.StorageHits++
+		}
 		return value
 	}
 	// Otherwise return the entry's original value
@@ -180,9 +183,15 @@ func (so *Object) GetCommittedState(db Database, key common.Hash) common.Hash {
 	// If we have the original value cached, return that
 	value, cached := so.originStorage[key]
 	if cached {
+		if so.db.trieStats != nil {
+			so.db.trieStats.StorageHits++
+		}
 		return value
 	}
 	// Otherwise load the value from the database
+	if so.db.trieStats != nil {
+		so.db.trieStats.StorageMisses++
+	}
 	enc, err := so.getTrie(db).TryGet(key[:])
 	if err != nil {
 		so.setError(err)
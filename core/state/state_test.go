@@ -243,3 +243,52 @@ func compareStateObjects(so0, so1 *Object, t *testing.T) {
 		}
 	}
 }
+
+func TestDumpDiff(t *testing.T) {
+	newState := func() *DB {
+		db, _ := New(common.Hash{}, NewDatabase(ethdb.NewMemDatabase()))
+		return db
+	}
+	var (
+		same, changed = toAddr([]byte{0x01}), toAddr([]byte{0x02})
+		onlyGot       = toAddr([]byte{0x03})
+		key           = common.HexToHash("0x10")
+	)
+	got, want := newState(), newState()
+	for _, db := range []*DB{got, want} {
+		db.SetBalance(same, big.NewInt(1))
+		db.SetNonce(changed, 1)
+		db.SetState(changed, key, common.HexToHash("0x01"))
+	}
+	got.SetBalance(changed, big.NewInt(5))
+	got.SetState(changed, key, common.HexToHash("0x02"))
+	got.SetBalance(onlyGot, big.NewInt(1))
+	// Dumps read the storage tries from the database.
+	got.Commit(false)
+	want.Commit(false)
+
+	diffs := got.RawDump().Diff(want.RawDump())
+	fields := []string{}
+	for _, diff := range diffs {
+		fields = append(fields, diff.Field)
+	}
+	// Accounts are ordered by their bech32 address, which puts 0x03 first.
+	wantFields := []string{"account", "balance", "storage/" + common.Bytes2Hex(key[:])}
+	if len(fields) != len(wantFields) {
+		t.Fatalf("got differences %+v, want fields %v", diffs, wantFields)
+	}
+	for i := range wantFields {
+		if fields[i] != wantFields[i] {
+			t.Errorf("difference %d: got field %s, want %s", i, fields[i], wantFields[i])
+		}
+	}
+	if diffs[0].Got != "present" || diffs[0].Want != "absent" {
+		t.Errorf("unexpected account difference %+v", diffs[0])
+	}
+	if diffs[1].Got != "5" || diffs[1].Want != "0" {
+		t.Errorf("unexpected balance difference %+v", diffs[1])
+	}
+	if diffs := want.RawDump().Diff(want.RawDump()); len(diffs) != 0 {
+		t.Errorf("got differences %+v between identical dumps", diffs)
+	}
+}
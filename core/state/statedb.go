@@ -18,6 +18,7 @@
 package state
 
 import (
+	"bytes"
 	"fmt"
 	"math/big"
 	"sort"
@@ -88,11 +89,33 @@ type DB struct {
 
 	preimages map[common.Hash][]byte
 
+	// Per-transaction EIP-2929 access list, see PrepareAccessList.
+	accessList *accessList
+
 	// Journal of state modifications. This is the backbone of
 	// Snapshot and RevertToSnapshot.
 	journal        *journal
 	validRevisions []revision
 	nextRevisionID int
+
+	// accessSet, when non-nil, records the accounts and storage slots
+	// accessed through the public getters and setters.
+	accessSet *AccessSet
+
+	// trieStats, when non-nil, counts the account and storage reads, see
+	// SetTrieStats.
+	trieStats *TrieStats
+
+	// readOnly makes Commit fail instead of writing to the database.
+	readOnly bool
+
+	// selfDestructed holds the accounts the last Finalise deleted because
+	// they self-destructed.
+	selfDestructed []common.Address
+
+	// created, when non-nil, holds the accounts created since recording
+	// started, see RecordCreatedAccounts.
+	created map[common.Address]struct{}
 }
 
 // New creates a new state from a given trie.
@@ -109,6 +132,7 @@ func New(root common.Hash, db Database) (*DB, error) {
 		stateValidators:   make(map[common.Address]*stk.ValidatorWrapper),
 		logs:              make(map[common.Hash][]*types.Log),
 		preimages:         make(map[common.Hash][]byte),
+		accessList:        newAccessList(),
 		journal:           newJournal(),
 	}, nil
 }
@@ -120,6 +144,9 @@ func (db *DB) setError(err error) {
 	}
 }
 
+// Error returns the first error the state met reading or updating its tries
+// or the contract code, including the storage of accounts once they are
+// finalised.
 func (db *DB) Error() error {
 	return db.dbErr
 }
@@ -141,6 +168,7 @@ func (db *DB) Reset(root common.Hash) error {
 	db.logs = make(map[common.Hash][]*types.Log)
 	db.logSize = 0
 	db.preimages = make(map[common.Hash][]byte)
+	db.accessList = newAccessList()
 	db.clearJournalAndRefund()
 	return nil
 }
@@ -205,18 +233,21 @@ func (db *DB) SubRefund(gas uint64) {
 // Exist reports whether the given account address exists in the state.
 // Notably this also returns true for suicided accounts.
 func (db *DB) Exist(addr common.Address) bool {
+	db.recordAccountRead(addr)
 	return db.getStateObject(addr) != nil
 }
 
 // Empty returns whether the state object is either non-existent
 // or empty according to the EIP161 specification (balance = nonce = code = 0)
 func (db *DB) Empty(addr common.Address) bool {
+	db.recordAccountRead(addr)
 	so := db.getStateObject(addr)
 	return so == nil || so.empty()
 }
 
 // GetBalance retrieves the balance from the given address or 0 if object not found
 func (db *DB) GetBalance(addr common.Address) *big.Int {
+	db.recordAccountRead(addr)
 	stateObject := db.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.Balance()
@@ -226,6 +257,7 @@ func (db *DB) GetBalance(addr common.Address) *big.Int {
 
 // GetNonce ...
 func (db *DB) GetNonce(addr common.Address) uint64 {
+	db.recordAccountRead(addr)
 	stateObject := db.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.Nonce()
@@ -236,6 +268,7 @@ func (db *DB) GetNonce(addr common.Address) uint64 {
 
 // GetCode ...
 func (db *DB) GetCode(addr common.Address) []byte {
+	db.recordAccountRead(addr)
 	stateObject := db.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.Code(db.db)
@@ -245,6 +278,7 @@ func (db *DB) GetCode(addr common.Address) []byte {
 
 // GetCodeSize ...
 func (db *DB) GetCodeSize(addr common.Address) int {
+	db.recordAccountRead(addr)
 	stateObject := db.getStateObject(addr)
 	if stateObject == nil {
 		return 0
@@ -263,6 +297,7 @@ func (db *DB) GetCodeSize(addr common.Address) int {
 
 // GetCodeHash ...
 func (db *DB) GetCodeHash(addr common.Address) common.Hash {
+	db.recordAccountRead(addr)
 	stateObject := db.getStateObject(addr)
 	if stateObject == nil {
 		return common.Hash{}
@@ -272,6 +307,7 @@ func (db *DB) GetCodeHash(addr common.Address) common.Hash {
 
 // GetState retrieves a value from the given account's storage trie.
 func (db *DB) GetState(addr common.Address, hash common.Hash) common.Hash {
+	db.recordSlotRead(addr, hash)
 	stateObject := db.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.GetState(db.db, hash)
@@ -299,6 +335,7 @@ func (db *DB) GetStorageProof(a common.Address, key common.Hash) ([][]byte, erro
 
 // GetCommittedState retrieves a value from the given account's committed storage trie.
 func (db *DB) GetCommittedState(addr common.Address, hash common.Hash) common.Hash {
+	db.recordSlotRead(addr, hash)
 	stateObject := db.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.GetCommittedState(db.db, hash)
@@ -324,6 +361,7 @@ func (db *DB) StorageTrie(addr common.Address) Trie {
 
 // HasSuicided ...
 func (db *DB) HasSuicided(addr common.Address) bool {
+	db.recordAccountRead(addr)
 	stateObject := db.getStateObject(addr)
 	if stateObject != nil {
 		return stateObject.suicided
@@ -337,6 +375,7 @@ func (db *DB) HasSuicided(addr common.Address) bool {
 
 // AddBalance adds amount to the account associated with addr.
 func (db *DB) AddBalance(addr common.Address, amount *big.Int) {
+	db.recordBalanceChange(addr, amount)
 	stateObject := db.GetOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.AddBalance(amount)
@@ -345,6 +384,7 @@ func (db *DB) AddBalance(addr common.Address, amount *big.Int) {
 
 // SubBalance subtracts amount from the account associated with addr.
 func (db *DB) SubBalance(addr common.Address, amount *big.Int) {
+	db.recordBalanceChange(addr, amount)
 	stateObject := db.GetOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SubBalance(amount)
@@ -353,6 +393,7 @@ func (db *DB) SubBalance(addr common.Address, amount *big.Int) {
 
 // SetBalance ...
 func (db *DB) SetBalance(addr common.Address, amount *big.Int) {
+	db.recordAccountWrite(addr)
 	stateObject := db.GetOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetBalance(amount)
@@ -361,6 +402,7 @@ func (db *DB) SetBalance(addr common.Address, amount *big.Int) {
 
 // SetNonce ...
 func (db *DB) SetNonce(addr common.Address, nonce uint64) {
+	db.recordAccountWrite(addr)
 	stateObject := db.GetOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetNonce(nonce)
@@ -369,6 +411,7 @@ func (db *DB) SetNonce(addr common.Address, nonce uint64) {
 
 // SetCode ...
 func (db *DB) SetCode(addr common.Address, code []byte) {
+	db.recordAccountWrite(addr)
 	stateObject := db.GetOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetCode(crypto.Keccak256Hash(code), code)
@@ -377,6 +420,7 @@ func (db *DB) SetCode(addr common.Address, code []byte) {
 
 // SetState ...
 func (db *DB) SetState(addr common.Address, key, value common.Hash) {
+	db.recordSlotWrite(addr, key)
 	stateObject := db.GetOrNewStateObject(addr)
 	if stateObject != nil {
 		stateObject.SetState(db.db, key, value)
@@ -389,6 +433,7 @@ func (db *DB) SetState(addr common.Address, key, value common.Hash) {
 // The account's state object is still available until the state is committed,
 // getStateObject will return a non-nil account after Suicide.
 func (db *DB) Suicide(addr common.Address) bool {
+	db.recordAccountWrite(addr)
 	stateObject := db.getStateObject(addr)
 	if stateObject == nil {
 		return false
@@ -429,6 +474,9 @@ func (db *DB) deleteStateObject(stateObject *Object) {
 func (db *DB) getStateObject(addr common.Address) (stateObject *Object) {
 	// Prefer 'live' objects.
 	if obj := db.stateObjects[addr]; obj != nil {
+		if db.trieStats != nil {
+			db.trieStats.AccountHits++
+		}
 		if obj.deleted {
 			return nil
 		}
@@ -436,6 +484,9 @@ func (db *DB) getStateObject(addr common.Address) (stateObject *Object) {
 	}
 
 	// Load the object from the database.
+	if db.trieStats != nil {
+		db.trieStats.AccountMisses++
+	}
 	enc, err := db.trie.TryGet(addr[:])
 	if len(enc) == 0 {
 		db.setError(err)
@@ -473,6 +524,9 @@ func (db *DB) createObject(addr common.Address) (newobj, prev *Object) {
 	newobj.setNonce(0) // sets the object to dirty
 	if prev == nil {
 		db.journal.append(createObjectChange{account: &addr})
+		if db.created != nil {
+			db.created[addr] = struct{}{}
+		}
 	} else {
 		db.journal.append(resetObjectChange{prev: prev})
 	}
@@ -491,6 +545,7 @@ func (db *DB) createObject(addr common.Address) (newobj, prev *Object) {
 //
 // Carrying over the balance ensures that Ether doesn't disappear.
 func (db *DB) CreateAccount(addr common.Address) {
+	db.recordAccountWrite(addr)
 	newObj, prev := db.createObject(addr)
 	if prev != nil {
 		newObj.setBalance(prev.data.Balance)
@@ -528,7 +583,16 @@ func (db *DB) Copy() *DB {
 		logs:              make(map[common.Hash][]*types.Log, len(db.logs)),
 		logSize:           db.logSize,
 		preimages:         make(map[common.Hash][]byte),
+		accessList:        db.accessList.Copy(),
 		journal:           newJournal(),
+		readOnly:          db.readOnly,
+		selfDestructed:    append([]common.Address(nil), db.selfDestructed...),
+	}
+	if db.created != nil {
+		state.created = make(map[common.Address]struct{}, len(db.created))
+		for addr := range db.created {
+			state.created[addr] = struct{}{}
+		}
 	}
 	// Copy the dirty states, logs, and preimages
 	for addr := range db.journal.dirties {
@@ -602,6 +666,7 @@ func (db *DB) Finalise(deleteEmptyObjects bool) {
 		db.UpdateValidatorWrapper(addr, val)
 	}
 
+	db.selfDestructed = nil
 	for addr := range db.journal.dirties {
 		stateObject, exist := db.stateObjects[addr]
 		if !exist {
@@ -616,16 +681,57 @@ func (db *DB) Finalise(deleteEmptyObjects bool) {
 
 		if stateObject.suicided || (deleteEmptyObjects && stateObject.empty()) {
 			db.deleteStateObject(stateObject)
+			if stateObject.suicided {
+				db.selfDestructed = append(db.selfDestructed, addr)
+			}
 		} else {
 			stateObject.updateRoot(db.db)
+			db.setError(stateObject.dbErr)
 			db.updateStateObject(stateObject)
 		}
 		db.stateObjectsDirty[addr] = struct{}{}
 	}
+	sort.Slice(db.selfDestructed, func(i, j int) bool {
+		return bytes.Compare(db.selfDestructed[i][:], db.selfDestructed[j][:]) < 0
+	})
 	// Invalidate journal because reverting across transactions is not allowed.
 	db.clearJournalAndRefund()
 }
 
+// SelfDestructed returns the accounts the last call to Finalise, e.g. through
+// IntermediateRoot, deleted because they self-destructed, ordered by address.
+func (db *DB) SelfDestructed() []common.Address {
+	return append([]common.Address(nil), db.selfDestructed...)
+}
+
+// RecordCreatedAccounts starts recording the accounts created from now on if
+// record is set, discarding the ones recorded before, and stops recording
+// otherwise, see CreatedAccounts.
+func (db *DB) RecordCreatedAccounts(record bool) {
+	db.created = nil
+	if record {
+		db.created = make(map[common.Address]struct{})
+	}
+}
+
+// CreatedAccounts returns the accounts created since RecordCreatedAccounts
+// started recording that still exist, ordered by address. An account is
+// created when it is first written to while it does not exist, e.g. as it
+// receives a transfer, or after it has been deleted. Creations that were
+// reverted are not reported.
+func (db *DB) CreatedAccounts() []common.Address {
+	var created []common.Address
+	for addr := range db.created {
+		if db.Exist(addr) {
+			created = append(created, addr)
+		}
+	}
+	sort.Slice(created, func(i, j int) bool {
+		return bytes.Compare(created[i][:], created[j][:]) < 0
+	})
+	return created
+}
+
 // IntermediateRoot computes the current root hash of the state trie.
 // It is called in between transactions to get the root hash that
 // goes into transaction receipts.
@@ -634,6 +740,18 @@ func (db *DB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	return db.trie.Hash()
 }
 
+// IntermediateRootWithError is like IntermediateRoot but fails if the state
+// met an error reading or updating its tries so far, e.g. a node missing from
+// a pruned database, in which case the root may have been computed over
+// incomplete data. The error is the one returned by Error.
+func (db *DB) IntermediateRootWithError(deleteEmptyObjects bool) (common.Hash, error) {
+	root := db.IntermediateRoot(deleteEmptyObjects)
+	if db.dbErr != nil {
+		return common.Hash{}, db.dbErr
+	}
+	return root, nil
+}
+
 // Prepare sets the current transaction hash and index and block hash which is
 // used when the EVM emits new state logs.
 func (db *DB) Prepare(thash, bhash common.Hash, ti int) {
@@ -648,8 +766,27 @@ func (db *DB) clearJournalAndRefund() {
 	db.refund = 0
 }
 
+// ErrReadOnly is returned when committing a read-only state.
+var ErrReadOnly = errors.New("state is read-only")
+
+// SetReadOnly sets whether the state is read-only. The changes made to a
+// read-only state stay in memory, so that its root can still be computed,
+// but committing them to the database fails with ErrReadOnly. Copies of a
+// read-only state are read-only as well.
+func (db *DB) SetReadOnly(readOnly bool) {
+	db.readOnly = readOnly
+}
+
+// ReadOnly returns whether the state is read-only, see SetReadOnly.
+func (db *DB) ReadOnly() bool {
+	return db.readOnly
+}
+
 // Commit writes the state to the underlying in-memory trie database.
 func (db *DB) Commit(deleteEmptyObjects bool) (root common.Hash, err error) {
+	if db.readOnly {
+		return common.Hash{}, ErrReadOnly
+	}
 	defer db.clearJournalAndRefund()
 
 	for addr := range db.journal.dirties {
@@ -778,6 +915,7 @@ func (db *DB) UnsetValidatorFlag(addr common.Address) {
 
 // IsValidator checks whether it is a validator object
 func (db *DB) IsValidator(addr common.Address) bool {
+	db.recordSlotRead(addr, staking.IsValidatorKey)
 	so := db.getStateObject(addr)
 	if so == nil {
 		return false
@@ -0,0 +1,37 @@
+package state
+
+// TrieStats counts how accounts and storage slots are read on a DB while it
+// is attached with SetTrieStats. A read is a hit if it is served by the
+// accounts and slots the DB holds in memory, and a miss if it looks up the
+// account trie or a storage trie of an account.
+type TrieStats struct {
+	AccountHits   uint64
+	AccountMisses uint64
+	StorageHits   uint64
+	StorageMisses uint64
+}
+
+// TrieReads returns the number of lookups in the account and storage tries.
+func (s *TrieStats) TrieReads() uint64 {
+	return s.AccountMisses + s.StorageMisses
+}
+
+// Add adds the counts of other to s.
+func (s *TrieStats) Add(other *TrieStats) {
+	s.AccountHits += other.AccountHits
+	s.AccountMisses += other.AccountMisses
+	s.StorageHits += other.StorageHits
+	s.StorageMisses += other.StorageMisses
+}
+
+// SetTrieStats attaches stats to the state so that subsequent account and
+// storage reads are counted into it. A nil stats disables counting. Copies
+// of the state do not count into it.
+func (db *DB) SetTrieStats(stats *TrieStats) {
+	db.trieStats = stats
+}
+
+// TrieStats returns the stats currently attached to the state, if any.
+func (db *DB) TrieStats() *TrieStats {
+	return db.trieStats
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/internal/params"
+)
+
+// prefetchTransactions starts loading the senders and recipients of txs from
+// the account trie of statedb in the background, ahead of the transactions
+// being applied to statedb, and returns a function stopping it. It recovers
+// the senders as well, which ApplyTransaction then finds cached in the
+// transactions. The accounts are only kept if the database of statedb caches
+// clean trie nodes, see state.NewDatabaseWithCache.
+func prefetchTransactions(
+	config *params.ChainConfig, header *block.Header,
+	statedb *state.DB, txs types.Transactions,
+) (stop func()) {
+	var (
+		prefetcher = statedb.NewPrefetcher()
+		signer     = types.MakeSigner(config, header.Epoch())
+		quit       = make(chan struct{})
+		done       = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for _, tx := range txs {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			if from, err := types.Sender(signer, tx); err == nil {
+				prefetcher.Prefetch(from)
+			}
+			if to := tx.To(); to != nil && tx.ShardID() == tx.ToShardID() {
+				prefetcher.Prefetch(*to)
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
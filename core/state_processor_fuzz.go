@@ -0,0 +1,107 @@
+package core
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/harmony-one/harmony/block"
+	consensus_engine "github.com/harmony-one/harmony/consensus/engine"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/internal/params"
+	staking "github.com/harmony-one/harmony/staking/types"
+	"github.com/pkg/errors"
+)
+
+// FuzzResult is the outcome of ApplyTransactionForFuzz, holding nothing that
+// depends on anything but the inputs.
+type FuzzResult struct {
+	Status          uint64
+	GasUsed         uint64
+	GasRefund       uint64
+	ContractAddress common.Address
+	CXReceipt       *types.CXReceipt // nil unless a cross-shard receipt was produced
+	Logs            []*types.Log     // with only the address, topics and data set
+
+	ReturnData []byte
+	VMErr      error // error the EVM execution ended with, if any
+
+	StateDiff []AccountDiff // post-state of everything written, by address
+	Root      common.Hash   // state root after the transaction
+}
+
+// ApplyTransactionForFuzz applies tx on top of a copy of statedb in the block
+// with the given header, which must not have a nil number, and returns its
+// normalized outcome, e.g. to compare the outcomes of fuzzed transactions.
+// The coinbase of header is credited the fees, BLOCKHASH only resolves the
+// parent of header and errors of the EVM execution are not logged. It has no
+// side effects; in particular statedb is left unmodified. A transaction that
+// cannot be applied yields its error, like with ApplyTransaction.
+func ApplyTransactionForFuzz(
+	config *params.ChainConfig, statedb *state.DB,
+	header *block.Header, tx *types.Transaction,
+) (*FuzzResult, error) {
+	var (
+		db       = statedb.Copy()
+		accesses = state.NewAccessSet()
+		author   = header.Coinbase()
+		gp       = new(GasPool).AddGas(header.GasLimit())
+		usedGas  uint64
+	)
+	db.SetAccessSet(accesses)
+	db.Prepare(tx.Hash(), header.Hash(), 0)
+	receipt, cxReceipt, result, _, err := applyTransaction(
+		config, fuzzChain{}, &author, gp, db, header, tx, &usedGas,
+		vm.Config{}, applyOptions{quiet: true},
+	)
+	db.SetAccessSet(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Error(); err != nil {
+		return nil, errors.Wrap(err, "cannot read state")
+	}
+
+	logs := make([]*types.Log, len(receipt.Logs))
+	for i, log := range receipt.Logs {
+		logs[i] = &types.Log{
+			Address: log.Address,
+			Topics:  append([]common.Hash{}, log.Topics...),
+			Data:    common.CopyBytes(log.Data),
+		}
+	}
+	return &FuzzResult{
+		Status:          receipt.Status,
+		GasUsed:         receipt.GasUsed,
+		GasRefund:       receipt.GasRefund,
+		ContractAddress: receipt.ContractAddress,
+		CXReceipt:       cxReceipt,
+		Logs:            logs,
+		ReturnData:      common.CopyBytes(result.ReturnData),
+		VMErr:           result.VMErr,
+		StateDiff:       writtenAccounts(db, accesses),
+		Root:            db.IntermediateRoot(config.IsStateClearing(header.Epoch())),
+	}, nil
+}
+
+// fuzzChain is a ChainContext without any blocks or staking data.
+type fuzzChain struct{}
+
+func (fuzzChain) Engine() consensus_engine.Engine { return nil }
+
+func (fuzzChain) GetHeader(common.Hash, uint64) *block.Header { return nil }
+
+func (fuzzChain) ReadDelegationsByDelegator(
+	common.Address,
+) (staking.DelegationIndexes, error) {
+	return nil, errors.New("no delegations")
+}
+
+func (fuzzChain) ReadValidatorSnapshot(
+	common.Address,
+) (*staking.ValidatorSnapshot, error) {
+	return nil, errors.New("no validator snapshots")
+}
+
+func (fuzzChain) ReadValidatorList() ([]common.Address, error) {
+	return nil, nil
+}
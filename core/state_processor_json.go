@@ -0,0 +1,76 @@
+package core
+
+import (
+	"encoding/json"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/shard"
+	"github.com/pkg/errors"
+)
+
+// processedBlock is the document ProcessToJSON returns. Its fields, and the
+// ones of everything in it, are marshaled in the order they are declared in.
+type processedBlock struct {
+	BlockHash  common.Hash      `json:"blockHash"`
+	Receipts   types.Receipts   `json:"receipts"`
+	Logs       []*types.Log     `json:"logs"`
+	CXReceipts types.CXReceipts `json:"cxReceipts"`
+	GasUsed    hexutil.Uint64   `json:"gasUsed"`
+	Payout     processedPayout  `json:"payout"`
+}
+
+// processedPayout is the payout of a processed block.
+type processedPayout struct {
+	Total          *big.Int                 `json:"total"`
+	Validators     []processedValidatorPaid `json:"validators"`
+	MissingSigners shard.SlotList           `json:"missingSigners"`
+}
+
+// processedValidatorPaid is what a validator earned in a processed block.
+type processedValidatorPaid struct {
+	Address common.Address `json:"address"`
+	Amount  *big.Int       `json:"amount"`
+}
+
+// ProcessToJSON processes the block like Process and returns its receipts,
+// logs, cross-shard receipts, gas used and payout as an indented JSON
+// document, e.g. for golden files or to compare the outcome of a block
+// between nodes. The document only depends on the block and the state it is
+// processed on; its top-level lists are encoded as [] rather than null when
+// empty.
+func (p *StateProcessor) ProcessToJSON(
+	block *types.Block, statedb *state.DB, cfg vm.Config,
+) ([]byte, error) {
+	receipts, outcxs, allLogs, usedGas, payout, err := p.Process(block, statedb, cfg)
+	if err != nil {
+		return nil, err
+	}
+	doc := processedBlock{
+		BlockHash:  block.Hash(),
+		Receipts:   append(types.Receipts{}, receipts...),
+		Logs:       append([]*types.Log{}, allLogs...),
+		CXReceipts: append(types.CXReceipts{}, outcxs...),
+		GasUsed:    hexutil.Uint64(usedGas),
+		Payout: processedPayout{
+			Total:          payout.ReadRoundResult().Total,
+			Validators:     []processedValidatorPaid{},
+			MissingSigners: append(shard.SlotList{}, payout.MissingSigners()...),
+		},
+	}
+	for _, paid := range payout.ValidatorPayouts() {
+		doc.Payout.Validators = append(doc.Payout.Validators, processedValidatorPaid{
+			Address: paid.Addr,
+			Amount:  paid.Amount,
+		})
+	}
+	enc, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot encode block %v", block.Number())
+	}
+	return enc, nil
+}
@@ -0,0 +1,274 @@
+package core
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/consensus/reward"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/internal/params"
+	"github.com/pkg/errors"
+)
+
+// ProcessParallel is like Process but executes the plain transactions of the
+// block optimistically in parallel, see ProcessOptions.Parallel. The
+// receipts, cross-shard receipts, logs and gas used are identical to the ones
+// of Process.
+func (p *StateProcessor) ProcessParallel(
+	block *types.Block, statedb *state.DB, cfg vm.Config,
+) (
+	types.Receipts, types.CXReceipts,
+	[]*types.Log, uint64, reward.Reader, error,
+) {
+	result, err := p.ProcessWithOptions(
+		block, statedb, cfg, ProcessOptions{Parallel: true},
+	)
+	if err != nil {
+		return nil, nil, nil, 0, nil, err
+	}
+	return result.Receipts, result.CXReceipts, result.Logs, result.UsedGas,
+		result.Payout, nil
+}
+
+// canApplyInParallel returns whether transactions of the block with the given
+// header can be speculatively executed under cfg.
+func canApplyInParallel(
+	config *params.ChainConfig, header *block.Header, cfg vm.Config,
+) bool {
+	// Tracers and preimage recording observe the execution of every
+	// transaction, so they cannot be run speculatively. Merging the results
+	// relies on the state being finalised and cleared of empty accounts
+	// after each transaction, as by the rule of S3Epoch from
+	// StateClearingEpoch on rather than a custom strategy. Before staking,
+	// the fee of every transaction is credited to the coinbase, so any two
+	// transactions conflict and would all be re-executed serially.
+	return config.StateRoot == nil && config.IsS3(header.Epoch()) &&
+		config.IsStateClearing(header.Epoch()) &&
+		config.IsStaking(header.Epoch()) &&
+		!cfg.Debug && !cfg.EnablePreimageRecording
+}
+
+// speculativeResult is the outcome of executing a transaction on a private
+// copy of the pre-block state.
+type speculativeResult struct {
+	statedb   *state.DB
+	accesses  *state.AccessSet
+	receipt   *types.Receipt
+	cxReceipt *types.CXReceipt
+	gas       uint64
+	err       error
+}
+
+// speculationWindow is the number of transactions per worker that
+// applyTransactionsParallel speculatively executes at a time.
+const speculationWindow = 4
+
+// applyTransactionsParallel applies the plain transactions of a block
+// optimistically in parallel, see ProcessOptions.Parallel.
+//
+// The transactions are taken a window at a time. Every transaction of the
+// window is first executed speculatively on its own copy of the pre-block
+// state while its account and storage accesses are recorded. The results are
+// then merged in block order; a transaction whose reads overlap with the
+// writes of an earlier transaction in the block is re-executed serially on
+// the merged state instead. Once most of a window conflicts, e.g. in a block
+// of transfers to the same account, speculating is a waste and the rest of
+// the block is executed serially. The receipts, cross-shard receipts, logs
+// and gas used are therefore identical to the ones of applyTransactions.
+// It must only be used for blocks that canApplyInParallel.
+func applyTransactionsParallel(
+	config *params.ChainConfig, bc ChainContext, author *common.Address,
+	gp *GasPool, statedb *state.DB, header *block.Header, blockHash common.Hash,
+	txs types.Transactions, usedGas *uint64, cfg vm.Config,
+) (types.Receipts, types.CXReceipts, []*types.Log, error) {
+	var (
+		receipts types.Receipts
+		outcxs   types.CXReceipts
+		allLogs  []*types.Log
+		window   = speculationWindow * runtime.NumCPU()
+		serial   bool
+		// preBlock is the state the transactions are speculated on
+		preBlock = statedb.Copy()
+		// written accumulates the writes of all the transactions merged so far
+		written = state.NewAccessSet()
+	)
+	// applySerially applies the i-th transaction on statedb, recording its
+	// accesses unless the rest of the block is executed serially anyway.
+	applySerially := func(i int, tx *types.Transaction) (*state.AccessSet, error) {
+		var accesses *state.AccessSet
+		if !serial {
+			accesses = state.NewAccessSet()
+			statedb.SetAccessSet(accesses)
+		}
+		statedb.Prepare(tx.Hash(), blockHash, i)
+		receipt, cxReceipt, _, err := applyTransactionIsolated(
+			config, bc, author, gp, statedb, header, tx, usedGas, cfg,
+		)
+		statedb.SetAccessSet(nil)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err, "cannot apply transaction %d (%s)", i, tx.Hash().Hex(),
+			)
+		}
+		receipts = append(receipts, receipt)
+		if cxReceipt != nil {
+			outcxs = append(outcxs, cxReceipt)
+		}
+		allLogs = append(allLogs, receipt.Logs...)
+		return accesses, nil
+	}
+
+	for start := 0; start < len(txs); start += window {
+		end := start + window
+		if end > len(txs) {
+			end = len(txs)
+		}
+		if serial {
+			for i := start; i < end; i++ {
+				if _, err := applySerially(i, txs[i]); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+			continue
+		}
+
+		results := speculate(
+			config, bc, author, preBlock, header, blockHash, start,
+			txs[start:end], cfg,
+		)
+		conflicts := 0
+		for j, tx := range txs[start:end] {
+			i, res := start+j, results[j]
+			if res.err != nil || res.accesses.Conflicts(written) || gp.Gas() < tx.Gas() {
+				// The speculative run either failed, saw stale state or
+				// might not have been able to buy its gas; execute it for
+				// real.
+				conflicts++
+				accesses, err := applySerially(i, tx)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				written.Merge(accesses)
+				continue
+			}
+
+			// Replay the effects of the speculative run on the real state.
+			if err := gp.SubGas(tx.Gas()); err != nil {
+				return nil, nil, nil, errors.Wrapf(
+					err, "cannot apply transaction %d (%s)", i, tx.Hash().Hex(),
+				)
+			}
+			gp.AddGas(tx.Gas() - res.gas)
+			statedb.ApplyWrites(res.statedb, res.accesses)
+			statedb.Prepare(tx.Hash(), blockHash, i)
+			for _, log := range res.statedb.GetLogs(tx.Hash()) {
+				cpy := *log
+				statedb.AddLog(&cpy)
+			}
+			statedb.Finalise(true)
+			written.Merge(res.accesses)
+
+			*usedGas += res.gas
+			receipt := res.receipt
+			receipt.CumulativeGasUsed = *usedGas
+			if config.IsReceiptLog(header.Epoch()) {
+				receipt.Logs = statedb.GetLogs(tx.Hash())
+			}
+			receipts = append(receipts, receipt)
+			if res.cxReceipt != nil {
+				outcxs = append(outcxs, res.cxReceipt)
+			}
+			allLogs = append(allLogs, receipt.Logs...)
+		}
+		serial = 2*conflicts > end-start
+	}
+	return receipts, outcxs, allLogs, nil
+}
+
+// speculate executes every transaction on its own copy of statedb using a
+// bounded number of workers. The transactions are the ones of the block from
+// index first on.
+func speculate(
+	config *params.ChainConfig, bc ChainContext, author *common.Address,
+	statedb *state.DB, header *block.Header, blockHash common.Hash, first int,
+	txs types.Transactions, cfg vm.Config,
+) []speculativeResult {
+	var (
+		results = make([]speculativeResult, len(txs))
+		base    = statedb.Copy()
+		jobs    = make(chan int)
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+	)
+	workers := runtime.NumCPU()
+	if workers > len(txs) {
+		workers = len(txs)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = speculateTransaction(
+					config, bc, author, base, &mu, header, blockHash, first+i, txs[i], cfg,
+				)
+			}
+		}()
+	}
+	for i := range txs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// speculateTransaction executes tx, the i-th transaction of the block, on a
+// copy of base, which mu guards. A panic during the execution is returned
+// as ErrTransactionPanicked, like a conflict, so that the transaction is
+// applied serially instead of bringing the node down.
+func speculateTransaction(
+	config *params.ChainConfig, bc ChainContext, author *common.Address,
+	base *state.DB, mu *sync.Mutex, header *block.Header, blockHash common.Hash,
+	i int, tx *types.Transaction, cfg vm.Config,
+) (res speculativeResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = speculativeResult{err: errors.Wrapf(ErrTransactionPanicked, "%v", r)}
+		}
+	}()
+	// Copying reads the dirty objects of base, which must not race with
+	// the other workers doing the same.
+	db := func() *state.DB {
+		mu.Lock()
+		defer mu.Unlock()
+		return base.Copy()
+	}()
+
+	accesses := state.NewAccessSet()
+	db.SetAccessSet(accesses)
+	db.Prepare(tx.Hash(), blockHash, i)
+	var (
+		gp   = new(GasPool).AddGas(header.GasLimit())
+		used uint64
+	)
+	receipt, cxReceipt, gas, err := ApplyTransaction(
+		config, bc, author, gp, db, header, tx, &used, cfg,
+	)
+	db.SetAccessSet(nil)
+	if err == nil {
+		err = db.Error()
+	}
+	return speculativeResult{
+		statedb:   db,
+		accesses:  accesses,
+		receipt:   receipt,
+		cxReceipt: cxReceipt,
+		gas:       gas,
+		err:       err,
+	}
+}
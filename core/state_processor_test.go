@@ -0,0 +1,5679 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/harmony-one/harmony/block"
+	blockfactory "github.com/harmony-one/harmony/block/factory"
+	"github.com/harmony-one/harmony/common/denominations"
+	consensus_engine "github.com/harmony-one/harmony/consensus/engine"
+	"github.com/harmony-one/harmony/consensus/reward"
+	"github.com/harmony-one/harmony/core/rawdb"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/crypto/bls"
+	chain2 "github.com/harmony-one/harmony/internal/chain"
+	shardingconfig "github.com/harmony-one/harmony/internal/configs/sharding"
+	"github.com/harmony-one/harmony/internal/params"
+	"github.com/harmony-one/harmony/internal/utils"
+	"github.com/harmony-one/harmony/numeric"
+	"github.com/harmony-one/harmony/shard"
+	staking2 "github.com/harmony-one/harmony/staking"
+	"github.com/harmony-one/harmony/staking/effective"
+	"github.com/harmony-one/harmony/staking/network"
+	"github.com/harmony-one/harmony/staking/slash"
+	staking "github.com/harmony-one/harmony/staking/types"
+	staketest "github.com/harmony-one/harmony/staking/types/test"
+	"github.com/pkg/errors"
+)
+
+var (
+	testTokenAddr = common.HexToAddress("0x7070")
+	testCoinbase  = common.HexToAddress("0xc0ffee")
+
+	// testTokenCode is a minimal token contract whose call data is the
+	// 32-byte recipient followed by the 32-byte amount, and which keeps the
+	// balance of each holder in the storage slot keyed by its address:
+	//
+	//   CALLER SLOAD PUSH1 0x20 CALLDATALOAD SWAP1 SUB CALLER SSTORE
+	//   PUSH1 0x00 CALLDATALOAD DUP1 SLOAD PUSH1 0x20 CALLDATALOAD ADD
+	//   SWAP1 SSTORE STOP
+	testTokenCode = common.FromHex(
+		"3354602035900333556000358054602035019055" + "00",
+	)
+)
+
+// newTestState returns an empty in-memory state.
+func newTestState() *state.DB {
+	statedb, _ := state.New(
+		common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()),
+	)
+	return statedb
+}
+
+// newTestChain returns a chain of config with an empty genesis block, which
+// the blocks processed on top of it need not descend from.
+func newTestChain(t testing.TB, config *params.ChainConfig) *BlockChain {
+	gspec := Genesis{
+		Config:   config,
+		Factory:  blockfactory.ForTest,
+		Alloc:    GenesisAlloc{},
+		GasLimit: 1e18,
+	}
+	database := ethdb.NewMemDatabase()
+	gspec.MustCommit(database)
+	bc, err := NewBlockChain(database, nil, config, chain2.Engine, vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+// newTestHeader returns a shard 0 header of the given epoch.
+func newTestHeader(epoch int64) *block.Header {
+	return blockfactory.NewTestHeader().With().
+		Number(big.NewInt(1)).
+		Epoch(big.NewInt(epoch)).
+		ShardID(0).
+		GasLimit(1e9).
+		Header()
+}
+
+// newTestKeys generates n funded keys in statedb.
+func newTestKeys(t testing.TB, statedb *state.DB, n int) []*ecdsa.PrivateKey {
+	keys := make([]*ecdsa.PrivateKey, n)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		statedb.AddBalance(
+			crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1e18),
+		)
+		keys[i] = key
+	}
+	return keys
+}
+
+func signTestTx(
+	t testing.TB, header *block.Header, key *ecdsa.PrivateKey,
+	tx *types.Transaction,
+) *types.Transaction {
+	signed, err := types.SignTx(
+		tx, types.MakeSigner(params.TestChainConfig, header.Epoch()), key,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// tokenTransfer returns a signed call transferring amount tokens to `to`.
+func tokenTransfer(
+	t testing.TB, header *block.Header, key *ecdsa.PrivateKey, nonce uint64,
+	to common.Address, amount int64,
+) *types.Transaction {
+	data := append(
+		common.LeftPadBytes(to.Bytes(), 32),
+		common.LeftPadBytes(big.NewInt(amount).Bytes(), 32)...,
+	)
+	return signTestTx(t, header, key, types.NewTransaction(
+		nonce, testTokenAddr, 0, big.NewInt(0), 100000, big.NewInt(1), data,
+	))
+}
+
+// deployTestToken installs the token contract, credits every key and
+// returns the committed state, as it would be at the start of a block.
+func deployTestToken(
+	t testing.TB, statedb *state.DB, keys []*ecdsa.PrivateKey,
+) *state.DB {
+	statedb.SetCode(testTokenAddr, testTokenCode)
+	for _, key := range keys {
+		statedb.SetState(
+			testTokenAddr,
+			crypto.PubkeyToAddress(key.PublicKey).Hash(),
+			common.BigToHash(big.NewInt(1e9)),
+		)
+	}
+	root, err := statedb.Commit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := state.New(root, statedb.Database())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return committed
+}
+
+// tokenBlockTxs builds a block worth of token transfers. When hot is set all
+// of them pay the same recipient, otherwise every one pays a distinct account.
+func tokenBlockTxs(
+	t testing.TB, header *block.Header, keys []*ecdsa.PrivateKey, hot bool,
+) types.Transactions {
+	txs := make(types.Transactions, 0, len(keys))
+	for i, key := range keys {
+		to := common.BigToAddress(big.NewInt(int64(0x10000 + i)))
+		if hot {
+			to = common.HexToAddress("0xbeef")
+		}
+		txs = append(txs, tokenTransfer(t, header, key, 0, to, 1))
+	}
+	return txs
+}
+
+func runApplier(
+	t testing.TB, apply transactionsApplier, statedb *state.DB,
+	header *block.Header, txs types.Transactions,
+) (types.Receipts, uint64) {
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	receipts, _, _, err := apply(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+		common.Hash{}, txs, &usedGas, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receipts, usedGas
+}
+
+func TestApplyTransactionsParallel(t *testing.T) {
+	header := newTestHeader(1)
+	for _, hot := range []bool{false, true} {
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 32)
+		statedb = deployTestToken(t, statedb, keys)
+		// Make the last sender spend twice so that it conflicts with itself.
+		txs := tokenBlockTxs(t, header, keys, hot)
+		txs = append(txs, tokenTransfer(
+			t, header, keys[len(keys)-1], 1, common.HexToAddress("0xbeef"), 1,
+		))
+
+		serialState, parallelState := statedb.Copy(), statedb.Copy()
+		serial, serialGas := runApplier(t, applyTransactions, serialState, header, txs)
+		parallel, parallelGas := runApplier(t, applyTransactionsParallel, parallelState, header, txs)
+
+		if serialGas != parallelGas {
+			t.Errorf("hot=%v: gas used mismatch: serial %d, parallel %d", hot, serialGas, parallelGas)
+		}
+		if a, b := types.DeriveSha(serial), types.DeriveSha(parallel); a != b {
+			t.Errorf("hot=%v: receipt root mismatch: serial %x, parallel %x", hot, a, b)
+		}
+		if a, b := serialState.IntermediateRoot(true), parallelState.IntermediateRoot(true); a != b {
+			t.Errorf("hot=%v: state root mismatch: serial %x, parallel %x", hot, a, b)
+		}
+	}
+}
+
+func TestCanApplyInParallel(t *testing.T) {
+	preStaking := *params.TestChainConfig
+	preStaking.StakingEpoch = big.NewInt(10)
+
+	tests := []struct {
+		name   string
+		config *params.ChainConfig
+		cfg    vm.Config
+		want   bool
+	}{
+		{"staking", params.TestChainConfig, vm.Config{}, true},
+		// Every transaction credits its fee to the coinbase.
+		{"before staking", &preStaking, vm.Config{}, false},
+		{"tracing", params.TestChainConfig, vm.Config{Debug: true}, false},
+		{"preimage recording", params.TestChainConfig, vm.Config{EnablePreimageRecording: true}, false},
+	}
+	for _, test := range tests {
+		if got := canApplyInParallel(test.config, newTestHeader(1), test.cfg); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func benchmarkApplier(b *testing.B, apply transactionsApplier, hot bool) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(b, statedb, 500)
+	statedb = deployTestToken(b, statedb, keys)
+	txs := tokenBlockTxs(b, header, keys, hot)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runApplier(b, apply, statedb.Copy(), header, txs)
+	}
+}
+
+func BenchmarkApplyTransactionsSerial(b *testing.B) {
+	benchmarkApplier(b, applyTransactions, false)
+}
+
+func BenchmarkApplyTransactionsParallel(b *testing.B) {
+	benchmarkApplier(b, applyTransactionsParallel, false)
+}
+
+func BenchmarkApplyTransactionsSerialContended(b *testing.B) {
+	benchmarkApplier(b, applyTransactions, true)
+}
+
+func BenchmarkApplyTransactionsParallelContended(b *testing.B) {
+	benchmarkApplier(b, applyTransactionsParallel, true)
+}
+
+func TestTraceTransaction(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	statedb = deployTestToken(t, statedb, keys)
+	to := common.HexToAddress("0xbeef")
+	txs := types.Transactions{
+		tokenTransfer(t, header, keys[0], 0, to, 7),
+		signTestTx(t, header, keys[0], types.NewContractCreation(
+			1, 0, big.NewInt(0), 100000, big.NewInt(1), testTokenCode,
+		)),
+	}
+
+	plainState, tracedState := statedb.Copy(), statedb.Copy()
+	var plainGas, tracedGas uint64
+	for i, tx := range txs {
+		gp := new(GasPool).AddGas(header.GasLimit())
+		receipt, _, _, err := ApplyTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, plainState, header,
+			tx, &plainGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gp = new(GasPool).AddGas(header.GasLimit())
+		trace, err := TraceTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, tracedState, header,
+			tx, &tracedGas, nil,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trace.Gas != receipt.GasUsed || trace.Receipt.ContractAddress != receipt.ContractAddress {
+			t.Errorf("tx %d: traced receipt differs from the untraced one", i)
+		}
+		if len(trace.StructLogs) == 0 && i == 0 {
+			t.Errorf("tx %d: no steps traced", i)
+		}
+	}
+	if plainGas != tracedGas {
+		t.Errorf("gas used mismatch: plain %d, traced %d", plainGas, tracedGas)
+	}
+	if a, b := plainState.IntermediateRoot(true), tracedState.IntermediateRoot(true); a != b {
+		t.Errorf("state root mismatch: plain %x, traced %x", a, b)
+	}
+}
+
+func TestTraceTransactionStateDiff(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	statedb = deployTestToken(t, statedb, keys)
+	to := common.HexToAddress("0xbeef")
+
+	var usedGas uint64
+	gp := new(GasPool).AddGas(header.GasLimit())
+	trace, err := TraceTransaction(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+		tokenTransfer(t, header, keys[0], 0, to, 7), &usedGas, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.CXReceipt != nil {
+		t.Errorf("unexpected cross-shard receipt %v", trace.CXReceipt)
+	}
+	var token *AccountDiff
+	for i := range trace.StateDiff {
+		if trace.StateDiff[i].Address == testTokenAddr {
+			token = &trace.StateDiff[i]
+		}
+	}
+	if token == nil {
+		t.Fatal("token contract missing from the state diff")
+	}
+	if got := token.Storage[to.Hash()]; got != common.BigToHash(big.NewInt(7)) {
+		t.Errorf("recipient balance: got %x, want 7", got)
+	}
+}
+
+func TestApplyTransactionWithOverrides(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	callee := common.HexToAddress("0xdead")
+	root := statedb.IntermediateRoot(true)
+
+	tx := signTestTx(t, header, key, types.NewTransaction(
+		0, callee, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+	))
+	// The sender cannot pay for gas without the balance override.
+	if _, _, err := ApplyTransactionWithOverrides(
+		params.TestChainConfig, nil, &testCoinbase, statedb, header, tx,
+		nil, vm.Config{},
+	); err == nil {
+		t.Fatal("expected unfunded sender to fail")
+	}
+
+	overrides := StateOverrides{
+		sender: {Balance: big.NewInt(1e18)},
+		// PUSH1 0x2a PUSH1 0x00 MSTORE PUSH1 0x20 PUSH1 0x00 RETURN
+		callee: {Code: common.FromHex("602a60005260206000f3")},
+	}
+	receipt, ret, err := ApplyTransactionWithOverrides(
+		params.TestChainConfig, nil, &testCoinbase, statedb, header, tx,
+		overrides, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Errorf("unexpected receipt status %d", receipt.Status)
+	}
+	if want := common.BigToHash(big.NewInt(42)).Bytes(); string(ret) != string(want) {
+		t.Errorf("return data: got %x, want %x", ret, want)
+	}
+	if got := statedb.IntermediateRoot(true); got != root {
+		t.Errorf("state was modified: root %x, want %x", got, root)
+	}
+}
+
+func TestSimulateBundle(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// A market the searcher buys from with empty calldata, setting slot 0,
+	// and sells to otherwise, which reverts unless slot 0 is set and clears
+	// it.
+	market := common.HexToAddress("0x1064")
+	statedb.SetCode(market, common.FromHex(
+		"36600a576001600055005b600054601557600080fd5b600060005500",
+	))
+	root := statedb.IntermediateRoot(true)
+	bundle := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, market, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			1, market, 0, big.NewInt(0), 100000, big.NewInt(1), []byte{1},
+		)),
+	}
+	simulate := func(onBeforeTx BundleHook, abortOnRevert bool) (*BundleResult, error) {
+		return SimulateBundle(
+			params.TestChainConfig, nil, &testCoinbase, statedb, header, bundle,
+			onBeforeTx, abortOnRevert, vm.Config{},
+		)
+	}
+
+	var hooked []int
+	result, err := simulate(func(i int, tx *types.Transaction, pending *state.DB) error {
+		// The buy is pending when the sell is about to be applied.
+		if i == 1 && pending.GetState(market, common.Hash{}) == (common.Hash{}) {
+			t.Error("state of the first transaction not pending")
+		}
+		hooked = append(hooked, i)
+		return nil
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hooked, []int{0, 1}) {
+		t.Errorf("hook invoked before transactions %v, want [0 1]", hooked)
+	}
+	if len(result.Receipts) != 2 {
+		t.Fatalf("got %d receipts, want 2", len(result.Receipts))
+	}
+	for i, receipt := range result.Receipts {
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Errorf("transaction %d failed", i)
+		}
+	}
+	if got := result.Receipts[1].CumulativeGasUsed; got != result.GasUsed {
+		t.Errorf("got %d gas used, want %d", result.GasUsed, got)
+	}
+	written := map[common.Address]bool{}
+	for _, diff := range result.StateDiff {
+		written[diff.Address] = true
+	}
+	for _, addr := range []common.Address{crypto.PubkeyToAddress(keys[0].PublicKey), market} {
+		if !written[addr] {
+			t.Errorf("%s missing from the state diff", addr.Hex())
+		}
+	}
+	if got := statedb.IntermediateRoot(true); got != root {
+		t.Errorf("state was modified: root %x, want %x", got, root)
+	}
+
+	// Someone else sells first, so the sell of the bundle reverts.
+	frontrun := func(i int, tx *types.Transaction, pending *state.DB) error {
+		if i == 1 {
+			pending.SetState(market, common.Hash{}, common.Hash{})
+		}
+		return nil
+	}
+	if _, err := simulate(frontrun, true); errors.Cause(err) != ErrBundleReverted {
+		t.Errorf("got error %v, want %v", err, ErrBundleReverted)
+	}
+	result, err = simulate(frontrun, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Receipts) != 2 || result.Receipts[1].Status != types.ReceiptStatusFailed {
+		t.Errorf("the reverted sell is not kept with a failed receipt")
+	}
+
+	// The hook can abort the bundle.
+	abort := errors.New("abort")
+	if _, err := simulate(func(int, *types.Transaction, *state.DB) error {
+		return abort
+	}, false); errors.Cause(err) != abort {
+		t.Errorf("got error %v, want %v", err, abort)
+	}
+}
+
+func TestApplyMessageAt(t *testing.T) {
+	header := newTestHeader(1).With().Time(big.NewInt(1000)).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// TIMESTAMP PUSH1 0x00 MSTORE PUSH1 0x20 PUSH1 0x00 RETURN
+	clock := common.HexToAddress("0x1049")
+	statedb.SetCode(clock, common.FromHex("4260005260206000f3"))
+	msg := types.NewMessage(
+		crypto.PubkeyToAddress(keys[0].PublicKey), &clock, 0, big.NewInt(0),
+		100000, big.NewInt(1), nil, false,
+	)
+
+	for _, timestamp := range []int64{1000, 2000000000} {
+		ret, _, failed, err := ApplyMessageAt(
+			params.TestChainConfig, nil, &testCoinbase,
+			new(GasPool).AddGas(header.GasLimit()), statedb.Copy(), header, msg,
+			big.NewInt(timestamp), vm.Config{},
+		)
+		if err != nil || failed {
+			t.Fatalf("timestamp %d: failed %v, err %v", timestamp, failed, err)
+		}
+		if got := new(big.Int).SetBytes(ret); got.Int64() != timestamp {
+			t.Errorf("got block.timestamp %v, want %d", got, timestamp)
+		}
+	}
+	if header.Time().Int64() != 1000 {
+		t.Errorf("header time changed to %v", header.Time())
+	}
+}
+
+func TestVRFRandomness(t *testing.T) {
+	config := *params.TestChainConfig
+	config.VRFEpoch = big.NewInt(2)
+	// DIFFICULTY PUSH1 0x00 MSTORE PUSH1 0x20 PUSH1 0x00 RETURN
+	random := common.HexToAddress("0x104a")
+	vrf := append(crypto.Keccak256([]byte("vrf output")), make([]byte, 96)...)
+	for epoch, want := range map[int64][]byte{
+		1: make([]byte, 32),
+		2: vrf[:32],
+	} {
+		header := newTestHeader(epoch).With().Vrf(vrf).Header()
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(random, common.FromHex("4460005260206000f3"))
+		msg := types.NewMessage(
+			crypto.PubkeyToAddress(keys[0].PublicKey), &random, 0, big.NewInt(0),
+			100000, big.NewInt(1), nil, false,
+		)
+		context := NewEVMContext(msg, header, nil, &testCoinbase)
+		vmenv := vm.NewEVM(context, statedb, &config, vm.Config{})
+		ret, _, failed, err := ApplyMessage(vmenv, msg, new(GasPool).AddGas(header.GasLimit()))
+		if err != nil || failed {
+			t.Fatalf("epoch %d: failed %v, err %v", epoch, failed, err)
+		}
+		if !bytes.Equal(ret, want) {
+			t.Errorf("epoch %d: got randomness %x, want %x", epoch, ret, want)
+		}
+	}
+}
+
+func TestApplyTransactionAccessList(t *testing.T) {
+	const slots = 40
+	var (
+		header   = newTestHeader(1)
+		contract = common.HexToAddress("0x5107")
+		code     []byte
+		al       = types.AccessList{{Address: contract}}
+	)
+	// PUSH1 i SLOAD POP for every slot, then STOP.
+	for i := 0; i < slots; i++ {
+		code = append(code, byte(vm.PUSH1), byte(i), byte(vm.SLOAD), byte(vm.POP))
+		al[0].StorageKeys = append(al[0].StorageKeys, common.BigToHash(big.NewInt(int64(i))))
+	}
+	code = append(code, byte(vm.STOP))
+
+	beforeFork := *params.TestChainConfig
+	beforeFork.AccessListEpoch = big.NewInt(2)
+
+	gasUsed := func(config *params.ChainConfig, al types.AccessList) (uint64, error) {
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(contract, code)
+		tx := types.NewTransaction(
+			0, contract, 0, big.NewInt(0), 1000000, big.NewInt(1), nil,
+		)
+		if al != nil {
+			tx = tx.WithAccessList(al)
+		}
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, gas, err := ApplyTransaction(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], tx), &usedGas, vm.Config{},
+		)
+		return gas, err
+	}
+
+	legacy, err := gasUsed(&beforeFork, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gasUsed(&beforeFork, al); errors.Cause(err) != ErrAccessListNotSupported {
+		t.Errorf("access list before the fork: got error %v, want %v", err, ErrAccessListNotSupported)
+	}
+	cold, err := gasUsed(params.TestChainConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warm, err := gasUsed(params.TestChainConfig, al)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From the fork on loads cost the cold or the warm access cost in place
+	// of the regular one.
+	loads := legacy - slots*params.GasTableS3.SLoad
+	if want := loads + slots*params.ColdSloadCostEIP2929; cold != want {
+		t.Errorf("gas without access list: got %d, want %d", cold, want)
+	}
+	listCost := params.TxAccessListAddressGas + slots*params.TxAccessListStorageKeyGas
+	if want := loads + slots*params.WarmStorageReadCostEIP2929 + listCost; warm != want {
+		t.Errorf("gas with access list: got %d, want %d", warm, want)
+	}
+	if warm >= cold {
+		t.Errorf("access list did not reduce gas: %d with, %d without", warm, cold)
+	}
+}
+
+func TestApplyTransactionRepeatedSload(t *testing.T) {
+	const loads = 10
+	contract := common.HexToAddress("0x5108")
+	// PUSH1 0x00 SLOAD POP the same slot every time, then STOP.
+	var code []byte
+	for i := 0; i < loads; i++ {
+		code = append(code, byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP))
+	}
+	code = append(code, byte(vm.STOP))
+
+	config := *params.TestChainConfig
+	config.AccessListEpoch = big.NewInt(2)
+	gasUsed := func(epoch int64) uint64 {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(contract, code)
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, gas, err := ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, contract, 0, big.NewInt(0), 1000000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gas
+	}
+
+	// From the fork on only the first load is cold and the others cost the
+	// warm access cost; the called contract is warm already.
+	before, after := gasUsed(1), gasUsed(2)
+	want := before - loads*params.GasTableS3.SLoad +
+		params.ColdSloadCostEIP2929 + (loads-1)*params.WarmStorageReadCostEIP2929
+	if after != want {
+		t.Errorf("gas after the fork: got %d, want %d (%d before)", after, want, before)
+	}
+}
+
+func TestApplyTransactionColdCall(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0x5109")
+		callee   = common.HexToAddress("0x1086")
+	)
+	// CALL callee with no gas, value nor data, then STOP.
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH1), 0, byte(vm.PUSH20),
+	}
+	code = append(code, callee.Bytes()...)
+	code = append(code, byte(vm.PUSH1), 0, byte(vm.CALL), byte(vm.POP), byte(vm.STOP))
+
+	config := *params.TestChainConfig
+	config.AccessListEpoch = big.NewInt(2)
+	gasUsed := func(epoch int64, al types.AccessList) uint64 {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(contract, code)
+		tx := types.NewTransaction(
+			0, contract, 0, big.NewInt(0), 1000000, big.NewInt(1), nil,
+		)
+		if al != nil {
+			tx = tx.WithAccessList(al)
+		}
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, gas, err := ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], tx), &usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gas
+	}
+
+	// From the fork on the call costs the cold or the warm access cost in
+	// place of the regular one.
+	before := gasUsed(1, nil) - params.GasTableS3.Calls
+	if cold, want := gasUsed(2, nil), before+params.ColdAccountAccessCostEIP2929; cold != want {
+		t.Errorf("cold call: got %d gas, want %d", cold, want)
+	}
+	warm := gasUsed(2, types.AccessList{{Address: callee}})
+	if want := before + params.WarmStorageReadCostEIP2929 + params.TxAccessListAddressGas; warm != want {
+		t.Errorf("warm call: got %d gas, want %d", warm, want)
+	}
+}
+
+func TestApplyTransactionsContinueOnError(t *testing.T) {
+	header := blockfactory.NewTestHeader().With().
+		Number(big.NewInt(1)).
+		Epoch(big.NewInt(1)).
+		ShardID(0).
+		GasLimit(300000).
+		Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	statedb = deployTestToken(t, statedb, keys)
+	to := common.HexToAddress("0xbeef")
+	txs := types.Transactions{
+		tokenTransfer(t, header, keys[0], 0, to, 1),
+		// Does not fit into what is left of the block gas limit.
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, to, 0, big.NewInt(1), 1000000, big.NewInt(1), nil,
+		)),
+		tokenTransfer(t, header, keys[2], 0, to, 1),
+	}
+
+	if _, _, _, err := runApplierErr(applyTransactions, statedb.Copy(), header, txs); errors.Cause(err) != ErrGasLimitReached {
+		t.Fatalf("strict mode: got error %v, want %v", err, ErrGasLimitReached)
+	}
+
+	var failed []FailedTransaction
+	receipts, usedGas, balance, err := runApplierErr(
+		applyHooks{failed: &failed}.apply, statedb.Copy(), header, txs,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Index != 1 || failed[0].TxHash != txs[1].Hash() ||
+		errors.Cause(failed[0].Err) != ErrGasLimitReached {
+		t.Fatalf("unexpected failed transactions %+v", failed)
+	}
+	if len(receipts) != len(txs) {
+		t.Fatalf("got %d receipts, want %d", len(receipts), len(txs))
+	}
+	if r := receipts[1]; r.Status != types.ReceiptStatusFailed || r.GasUsed != 0 {
+		t.Errorf("unexpected receipt for the failed transaction %+v", r)
+	}
+	if r := receipts[2]; r.Status != types.ReceiptStatusSuccessful || r.CumulativeGasUsed != usedGas {
+		t.Errorf("unexpected receipt for the last transaction %+v", r)
+	}
+	if want := common.BigToHash(big.NewInt(2)); balance != want {
+		t.Errorf("recipient token balance: got %x, want %x", balance, want)
+	}
+}
+
+// runApplierErr applies txs with apply and returns the receipts, the gas used
+// and the token balance of 0xbeef.
+func runApplierErr(
+	apply transactionsApplier, statedb *state.DB, header *block.Header,
+	txs types.Transactions,
+) (types.Receipts, uint64, common.Hash, error) {
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	receipts, _, _, err := apply(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+		common.Hash{}, txs, &usedGas, vm.Config{},
+	)
+	balance := statedb.GetState(testTokenAddr, common.HexToAddress("0xbeef").Hash())
+	return receipts, usedGas, balance, err
+}
+
+func TestCountCXReceipts(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	var (
+		to      = common.HexToAddress("0xbeef")
+		nano    = big.NewInt(denominations.Nano)
+		created = metrics.GetOrRegisterCounter("cx/receipts/created/0/1", nil)
+		value   = metrics.GetOrRegisterCounter("cx/receipts/value/0/1", nil)
+		other   = metrics.GetOrRegisterCounter("cx/receipts/created/0/2", nil)
+
+		createdBefore, valueBefore, otherBefore = created.Count(), value.Count(), other.Count()
+	)
+	countCXReceipts(types.CXReceipts{
+		{To: &to, ShardID: 0, ToShardID: 1, Amount: new(big.Int).Mul(big.NewInt(3), nano)},
+		// Less than a nano is not counted in the value.
+		{To: &to, ShardID: 0, ToShardID: 1, Amount: new(big.Int).Add(new(big.Int).Mul(big.NewInt(4), nano), big.NewInt(1))},
+		{To: &to, ShardID: 0, ToShardID: 2, Amount: big.NewInt(5)},
+	})
+	if got := created.Count() - createdBefore; got != 2 {
+		t.Errorf("receipts created from shard 0 to 1: got %d, want 2", got)
+	}
+	if got := value.Count() - valueBefore; got != 7 {
+		t.Errorf("nanos sent from shard 0 to 1: got %v, want 7", got)
+	}
+	if got := other.Count() - otherBefore; got != 1 {
+		t.Errorf("receipts created from shard 0 to 2: got %d, want 1", got)
+	}
+}
+
+func TestCountTransactionOutcomes(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	success := metrics.GetOrRegisterCounter("tx/processed/success", nil)
+	revert := metrics.GetOrRegisterCounter("tx/processed/revert", nil)
+	successBefore, revertBefore := success.Count(), revert.Count()
+	countTransactionOutcomes(types.Receipts{
+		{Status: types.ReceiptStatusSuccessful, GasUsed: 21000},
+		{Status: types.ReceiptStatusFailed, GasUsed: 50000},
+		{Status: types.ReceiptStatusSuccessful, GasUsed: 41000},
+	})
+	if got := success.Count() - successBefore; got != 2 {
+		t.Errorf("successful transactions: got %d, want 2", got)
+	}
+	if got := revert.Count() - revertBefore; got != 1 {
+		t.Errorf("reverted transactions: got %d, want 1", got)
+	}
+	if got := metrics.GetOrRegisterGaugeFloat64("tx/processed/success/gas", nil).Value(); got != 31000 {
+		t.Errorf("average gas used by successful transactions: got %v, want 31000", got)
+	}
+}
+
+func TestPhaseTimers(t *testing.T) {
+	enabled := metrics.Enabled
+	defer func() { metrics.Enabled = enabled }()
+	// Processing blocks in other tests may have registered the timer.
+	metrics.DefaultRegistry.Unregister(processFinalizeTimer)
+
+	metrics.Enabled = false
+	if start := startPhase(); !start.IsZero() {
+		t.Fatalf("phase started at %v with metrics disabled", start)
+	}
+	endPhase(processFinalizeTimer, time.Time{})
+	if metrics.DefaultRegistry.Get(processFinalizeTimer) != nil {
+		t.Fatal("timer registered with metrics disabled")
+	}
+
+	metrics.Enabled = true
+	start := startPhase()
+	endPhase(processFinalizeTimer, start)
+	endPhase(processFinalizeTimer, start)
+	if got := metrics.GetOrRegisterTimer(processFinalizeTimer, nil).Count(); got != 2 {
+		t.Errorf("got %d finalize timings, want 2", got)
+	}
+}
+
+// shrinkingSchedule is a sharding schedule going from 4 shards to 2 shards at
+// epoch 5.
+type shrinkingSchedule struct {
+	shardingconfig.Schedule
+}
+
+func (s shrinkingSchedule) InstanceForEpoch(epoch *big.Int) shardingconfig.Instance {
+	numShards := uint32(4)
+	if epoch.Cmp(big.NewInt(5)) >= 0 {
+		numShards = 2
+	}
+	return shardingconfig.MustNewInstance(
+		numShards, 1, 1, numeric.OneDec(), nil, nil, nil, s.BlocksPerEpoch(),
+	)
+}
+
+func TestGetTransactionType(t *testing.T) {
+	defer func(schedule shardingconfig.Schedule) { shard.Schedule = schedule }(shard.Schedule)
+	shard.Schedule = shrinkingSchedule{shardingconfig.LocalnetSchedule}
+
+	config := *params.TestChainConfig
+	config.CrossTxEpoch = big.NewInt(1)
+
+	to := common.HexToAddress("0xbeef")
+	tests := []struct {
+		name                       string
+		epoch                      int64
+		headerShard, from, toShard uint32
+		want                       types.TransactionType
+	}{
+		{"same shard", 3, 1, 1, 1, types.SameShardTx},
+		{"wrong source shard", 3, 1, 0, 0, types.InvalidTx},
+		{"cross shard before accepted", 1, 1, 1, 3, types.SameShardTx},
+		{"cross shard to non-existent shard before accepted", 1, 1, 1, 7, types.SameShardTx},
+		{"cross shard", 3, 1, 1, 3, types.SubtractionOnly},
+		{"cross shard to non-existent shard", 3, 1, 1, 4, types.InvalidTx},
+		{"cross shard to last shard before shrink", 4, 0, 0, 3, types.SubtractionOnly},
+		{"cross shard to removed shard at shrink", 5, 0, 0, 3, types.InvalidTx},
+		{"cross shard to removed shard after shrink", 6, 0, 0, 2, types.InvalidTx},
+		{"cross shard to remaining shard after shrink", 6, 0, 0, 1, types.SubtractionOnly},
+	}
+	for _, test := range tests {
+		header := blockfactory.NewTestHeader().With().
+			Epoch(big.NewInt(test.epoch)).
+			ShardID(test.headerShard).
+			Header()
+		tx := types.NewCrossShardTransaction(
+			0, &to, test.from, test.toShard, big.NewInt(1), 21000, big.NewInt(1), nil,
+		)
+		if got := getTransactionType(&config, header, tx); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCrossTxTooEarlyError(t *testing.T) {
+	err := errors.Wrap(&CrossTxTooEarlyError{
+		CrossTxEpoch: big.NewInt(1),
+		CurrentEpoch: big.NewInt(0),
+	}, "cannot apply transaction 0")
+
+	want := "cannot apply transaction 0: cannot handle it until after epoch 1 (now 0): " +
+		"cross-shard transaction too early"
+	if got := err.Error(); got != want {
+		t.Errorf("got message %q, want %q", got, want)
+	}
+	if errors.Cause(err) != ErrCrossTxTooEarly {
+		t.Errorf("got cause %v, want %v", errors.Cause(err), ErrCrossTxTooEarly)
+	}
+	if !errors.Is(err, ErrCrossTxTooEarly) {
+		t.Errorf("%v is not %v", err, ErrCrossTxTooEarly)
+	}
+	var tooEarly *CrossTxTooEarlyError
+	if !errors.As(err, &tooEarly) {
+		t.Fatalf("%v is not a CrossTxTooEarlyError", err)
+	}
+	if tooEarly.CrossTxEpoch.Int64() != 1 || tooEarly.CurrentEpoch.Int64() != 0 {
+		t.Errorf(
+			"got epochs %v and %v, want 1 and 0",
+			tooEarly.CrossTxEpoch, tooEarly.CurrentEpoch,
+		)
+	}
+}
+
+func TestGetStakingTransactionType(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := staking.NewStakingTransaction(0, 1e6, big.NewInt(1), func() (staking.Directive, interface{}) {
+		return staking.DirectiveCollectRewards, staking.CollectRewards{
+			DelegatorAddress: crypto.PubkeyToAddress(key.PublicKey),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx, err = staking.Sign(tx, staking.NewEIP155Signer(tx.ChainID()), key); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		shard uint32
+		want  types.TransactionType
+	}{
+		{"beacon chain", shard.BeaconChainShardID, types.CollectRewards},
+		{"other shard", 1, types.InvalidTx},
+	}
+	for _, test := range tests {
+		header := newTestHeader(1).With().ShardID(test.shard).Header()
+		if got := getStakingTransactionType(header, tx); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	var (
+		header  = newTestHeader(1).With().ShardID(1).Header()
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	_, _, err = ApplyStakingTransaction(
+		params.TestChainConfig, nil, &testCoinbase, gp, newTestState(), header,
+		tx, &usedGas, vm.Config{},
+	)
+	if errors.Cause(err) != ErrInvalidTxType {
+		t.Errorf("applying on shard 1: got %v, want %v", err, ErrInvalidTxType)
+	}
+}
+
+func TestApplyIncomingReceiptRoot(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	newTestKeys(t, statedb, 4)
+
+	// Dozens of receipts over a few proofs, with repeated recipients and
+	// zero amounts.
+	var proofs types.CXReceiptsProofs
+	for p := 0; p < 4; p++ {
+		proof := &types.CXReceiptsProof{}
+		for i := 0; i < 12; i++ {
+			to := common.BigToAddress(big.NewInt(int64(0x1000 + (p*12+i)%17)))
+			proof.Receipts = append(proof.Receipts, &types.CXReceipt{
+				TxHash:    common.BigToHash(big.NewInt(int64(p*12 + i + 1))),
+				To:        &to,
+				ShardID:   1,
+				ToShardID: 0,
+				Amount:    big.NewInt(int64(i % 3)),
+			})
+		}
+		proofs = append(proofs, proof)
+	}
+
+	batched, perReceipt := statedb.Copy(), statedb.Copy()
+	for _, proof := range proofs {
+		if err := ApplyIncomingReceipt(params.TestChainConfig, batched, header, proof); err != nil {
+			t.Fatal(err)
+		}
+		// The previous behavior, computing the root after every receipt.
+		for _, cx := range proof.Receipts {
+			if err := markCXReceiptApplied(perReceipt, cx); err != nil {
+				t.Fatal(err)
+			}
+			if !perReceipt.Exist(*cx.To) {
+				perReceipt.CreateAccount(*cx.To)
+			}
+			perReceipt.AddBalance(*cx.To, cx.Amount)
+			perReceipt.IntermediateRoot(true)
+		}
+	}
+	if a, b := batched.IntermediateRoot(true), perReceipt.IntermediateRoot(true); a != b {
+		t.Errorf("state root mismatch: batched %x, per receipt %x", a, b)
+	}
+}
+
+func TestProcessIncomingReceipts(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	existing := crypto.PubkeyToAddress(keys[0].PublicKey)
+	fresh := common.HexToAddress("0x1048")
+	receipt := func(n int64, to common.Address, amount int64) *types.CXReceipt {
+		return &types.CXReceipt{
+			TxHash:    common.BigToHash(big.NewInt(n)),
+			To:        &to,
+			ShardID:   1,
+			ToShardID: 0,
+			Amount:    big.NewInt(amount),
+		}
+	}
+	proofs := types.CXReceiptsProofs{
+		{Receipts: types.CXReceipts{receipt(1, existing, 100), receipt(2, fresh, 5)}},
+		{Receipts: types.CXReceipts{receipt(3, fresh, 7)}},
+		{Receipts: types.CXReceipts{receipt(4, existing, 0)}},
+	}
+	block := types.NewBlockWithHeader(header).WithBody(nil, nil, nil, proofs)
+
+	before := statedb.GetBalance(existing)
+	p := NewStateProcessor(params.TestChainConfig, nil, &offlineEngine{})
+	credited, err := p.ProcessIncomingReceipts(block, statedb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[common.Address]*big.Int{existing: big.NewInt(100), fresh: big.NewInt(12)}
+	if !reflect.DeepEqual(credited, want) {
+		t.Errorf("got credited %v, want %v", credited, want)
+	}
+	if got := new(big.Int).Sub(statedb.GetBalance(existing), before); got.Cmp(want[existing]) != 0 {
+		t.Errorf("got %v credited in the state, want %v", got, want[existing])
+	}
+	if got := statedb.GetBalance(fresh); got.Cmp(want[fresh]) != 0 {
+		t.Errorf("got new account balance %v, want %v", got, want[fresh])
+	}
+
+	// Replaying the same receipts is rejected, like in Process.
+	if _, err := p.ProcessIncomingReceipts(block, statedb); err == nil {
+		t.Error("replayed incoming receipts were applied again")
+	}
+}
+
+func TestApplyTransactionsWithContext(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 2)
+	statedb = deployTestToken(t, statedb, keys)
+	txs := tokenBlockTxs(t, header, keys, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	receipts, _, _, err := runApplierErr(
+		applyHooks{ctx: ctx}.apply, statedb.Copy(), header, txs,
+	)
+	if err != nil || len(receipts) != len(txs) {
+		t.Fatalf("live context: got %d receipts, error %v", len(receipts), err)
+	}
+	cancel()
+	if _, _, _, err := runApplierErr(
+		applyHooks{ctx: ctx}.apply, statedb.Copy(), header, txs,
+	); err != context.Canceled {
+		t.Fatalf("cancelled context: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestApplyTransactionsNotifying(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	statedb = deployTestToken(t, statedb, keys)
+	txs := tokenBlockTxs(t, header, keys, true)
+
+	var notified []int
+	var notifiedReceipts types.Receipts
+	receipts, usedGas := runApplier(
+		t, applyHooks{onReceipt: func(i int, r *types.Receipt, cx *types.CXReceipt) {
+			if cx != nil {
+				t.Errorf("transaction %d: unexpected cross-shard receipt", i)
+			}
+			notified = append(notified, i)
+			notifiedReceipts = append(notifiedReceipts, r)
+		}}.apply, statedb.Copy(), header, txs,
+	)
+	if want := []int{0, 1, 2}; !reflect.DeepEqual(notified, want) {
+		t.Fatalf("notified transactions %v, want %v", notified, want)
+	}
+	for i, r := range notifiedReceipts {
+		if r != receipts[i] {
+			t.Errorf("transaction %d: notified a different receipt", i)
+		}
+	}
+
+	// The callback does not change the outcome.
+	plain, plainGas := runApplier(t, applyTransactions, statedb.Copy(), header, txs)
+	if usedGas != plainGas || types.DeriveSha(receipts) != types.DeriveSha(plain) {
+		t.Error("notifying applier changed the receipts")
+	}
+}
+
+func TestApplyTransactionInterrupt(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// JUMPDEST PUSH1 0x00 JUMP, looping until it runs out of gas.
+	loop := common.HexToAddress("0x1009")
+	statedb.SetCode(loop, common.FromHex("5b600056"))
+	tx := signTestTx(t, header, keys[0], types.NewTransaction(
+		0, loop, 0, big.NewInt(0), 1e8, big.NewInt(1), nil,
+	))
+
+	interrupt := int32(1)
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	receipt, _, _, err := ApplyTransaction(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header, tx,
+		&usedGas, vm.Config{Interrupt: &interrupt},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusFailed {
+		t.Errorf("interrupted transaction succeeded: %+v", receipt)
+	}
+}
+
+func TestApplyTransactionErrors(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// PUSH1 0x00 PUSH1 0x00 REVERT
+	reverter := common.HexToAddress("0x1010")
+	statedb.SetCode(reverter, common.FromHex("60006000fd"))
+
+	apply := func(tx *types.Transaction) (*types.Receipt, error) {
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], tx), &usedGas, vm.Config{},
+		)
+		return receipt, err
+	}
+
+	wrongShard := types.NewCrossShardTransaction(
+		0, &reverter, 1, 1, big.NewInt(0), 100000, big.NewInt(1), nil,
+	)
+	if _, err := apply(wrongShard); errors.Cause(err) != ErrInvalidTxType {
+		t.Errorf("transaction of another shard: got error %v, want %v", err, ErrInvalidTxType)
+	}
+
+	receipt, err := apply(types.NewTransaction(
+		0, reverter, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+	))
+	if err != nil {
+		t.Fatalf("reverting transaction: unexpected error %v", err)
+	}
+	if receipt.Status != types.ReceiptStatusFailed {
+		t.Errorf("reverting transaction: got status %d, want failed", receipt.Status)
+	}
+}
+
+func TestBeneficiaryFallback(t *testing.T) {
+	bc := createBlockChain()
+	defer bc.Stop()
+	// The genesis shard state has no committee, so no coinbase of a staking
+	// block can be resolved.
+	p := NewStateProcessor(bc.Config(), bc, chain2.Engine)
+	// Before staking the chain credits the coinbase itself.
+	preStakingConfig := *bc.Config()
+	preStakingConfig.PreStakingEpoch = big.NewInt(10)
+	preStakingConfig.StakingEpoch = big.NewInt(10)
+	preStakingChain := newTestChain(t, &preStakingConfig)
+	defer preStakingChain.Stop()
+	preStaking := NewStateProcessor(&preStakingConfig, preStakingChain, chain2.Engine)
+
+	genesis := bc.Genesis().Header()
+	if got, err := p.beneficiary(p.bc, genesis); err != nil || got != genesis.Coinbase() {
+		t.Errorf("genesis: got %s (%v), want its coinbase %s",
+			got.Hex(), err, genesis.Coinbase().Hex())
+	}
+
+	header := blockfactory.NewTestHeader().With().
+		Number(big.NewInt(1)).
+		Epoch(big.NewInt(0)).
+		ShardID(0).
+		Coinbase(testCoinbase).
+		Header()
+	if got, err := p.beneficiary(p.bc, header); err == nil {
+		t.Errorf("staking block: got %s for a coinbase outside the committee", got.Hex())
+	}
+	if got, err := preStaking.beneficiary(preStaking.bc, header); err != nil || got != testCoinbase {
+		t.Errorf("pre-staking block: got %s (%v), want its coinbase %s",
+			got.Hex(), err, testCoinbase.Hex())
+	}
+}
+
+func TestBeneficiaryCache(t *testing.T) {
+	var (
+		slots    shard.SlotList
+		coinbase []common.Address
+	)
+	for i := 0; i < 3; i++ {
+		var pub shard.BLSPublicKey
+		if err := pub.FromLibBLSPublicKey(bls.RandPrivateKey().GetPublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		slot := shard.Slot{
+			EcdsaAddress: common.BigToAddress(big.NewInt(int64(0x2000 + i))),
+			BLSPublicKey: pub,
+		}
+		slots = append(slots, slot)
+		coinbase = append(
+			coinbase, slot.EcdsaAddress, utils.GetAddressFromBLSPubKeyBytes(pub[:]),
+		)
+	}
+	// Not part of the committee.
+	coinbase = append(coinbase, common.HexToAddress("0xbad"))
+
+	gspec := Genesis{
+		Config:   params.TestChainConfig,
+		Factory:  blockfactory.ForTest,
+		Alloc:    GenesisAlloc{},
+		GasLimit: 1e18,
+		ShardState: shard.State{
+			Epoch:  big.NewInt(0),
+			Shards: []shard.Committee{{ShardID: 0, Slots: slots}},
+		},
+	}
+	database := ethdb.NewMemDatabase()
+	gspec.MustCommit(database)
+	bc, err := NewBlockChain(database, nil, gspec.Config, chain2.Engine, vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Stop()
+
+	p := NewStateProcessor(gspec.Config, bc, chain2.Engine)
+	if err := p.SetBeneficiaryCacheLimit(2); err != nil {
+		t.Fatal(err)
+	}
+	// Go over the coinbases twice so that both cache hits and evicted
+	// entries are looked up.
+	for round := 0; round < 2; round++ {
+		for i, cb := range coinbase {
+			for _, repeat := range []int{0, 1} {
+				header := blockfactory.NewTestHeader().With().
+					Number(big.NewInt(int64(i + 1))).
+					Epoch(big.NewInt(0)).
+					ShardID(0).
+					Coinbase(cb).
+					Header()
+				want, wantErr := bc.GetECDSAFromCoinbase(header)
+				if member := i < len(coinbase)-1; member != (wantErr == nil) {
+					t.Fatalf("coinbase %d: unexpected lookup error %v", i, wantErr)
+				}
+				got, err := p.beneficiary(p.bc, header)
+				if got != want || (err == nil) != (wantErr == nil) {
+					t.Errorf("round %d coinbase %d lookup %d: got %s (%v), want %s (%v)",
+						round, i, repeat, got.Hex(), err, want.Hex(), wantErr)
+				}
+			}
+		}
+	}
+	if n := p.beneficiaryCache.Len(); n != 2 {
+		t.Errorf("got %d cached beneficiaries, want 2", n)
+	}
+}
+
+func TestStakingTransitionDbVerifiesFirst(t *testing.T) {
+	header := newTestHeader(1)
+	stakingMsg := func(
+		from common.Address, typ types.TransactionType, directive interface{},
+	) types.Message {
+		payload, err := rlp.EncodeToBytes(directive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := types.NewStakingMessage(
+			from, 0, 1e6, big.NewInt(1), payload, header.Number(),
+		)
+		msg.SetType(typ)
+		return msg
+	}
+	tooSmall := defaultMsgDelegate()
+	tooSmall.Amount = big.NewInt(1)
+	noValidator := defaultMsgDelegate()
+	noValidator.ValidatorAddress = makeTestAddr("nobody")
+
+	tests := []struct {
+		name    string
+		msg     types.Message
+		balance *big.Int // of the sender, if not the default one
+		want    error
+	}{
+		{"valid", stakingMsg(delegatorAddr, types.Delegate, defaultMsgDelegate()), nil, nil},
+		{"wrong signer", stakingMsg(validatorAddr, types.Delegate, defaultMsgDelegate()), nil, errInvalidSigner},
+		{"below minimum", stakingMsg(delegatorAddr, types.Delegate, tooSmall), nil, errDelegationTooSmall},
+		{"no validator", stakingMsg(delegatorAddr, types.Delegate, noValidator), nil, errValidatorNotExist},
+		{"stake and gas over balance", stakingMsg(delegatorAddr, types.Delegate, defaultMsgDelegate()), tenKOnes, errInsufficientBalanceForStake},
+		{"no rewards", stakingMsg(delegatorAddr, types.CollectRewards, staking.CollectRewards{
+			DelegatorAddress: delegatorAddr,
+		}), nil, errNoRewardsToCollect},
+	}
+	for _, test := range tests {
+		statedb := makeStateDBForStake(t)
+		if test.balance != nil {
+			statedb.SetBalance(test.msg.From(), test.balance)
+		}
+		balance := statedb.GetBalance(test.msg.From())
+		chain := makeFakeChainContextForStake()
+		vmenv := vm.NewEVM(
+			NewEVMContext(test.msg, header, chain, &testCoinbase), statedb,
+			params.TestChainConfig, vm.Config{},
+		)
+		_, err := ApplyStakingMessage(vmenv, test.msg, new(GasPool).AddGas(header.GasLimit()), chain)
+		if errors.Cause(err) != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+		if test.want == nil {
+			continue
+		}
+		// Nothing is bought nor applied for a directive that fails to verify.
+		if got := statedb.GetBalance(test.msg.From()); got.Cmp(balance) != 0 {
+			t.Errorf("%s: got balance %v, want %v", test.name, got, balance)
+		}
+		if nonce := statedb.GetNonce(test.msg.From()); nonce != 0 {
+			t.Errorf("%s: got nonce %d, want 0", test.name, nonce)
+		}
+	}
+}
+
+func TestValidateStakingTx(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	delegate := func(amount *big.Int) *staking.StakingTransaction {
+		msg := defaultMsgDelegate()
+		msg.DelegatorAddress = from
+		msg.Amount = amount
+		tx, err := staking.NewStakingTransaction(0, 1e6, big.NewInt(1), func() (staking.Directive, interface{}) {
+			return staking.DirectiveDelegate, msg
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx, err = staking.Sign(tx, staking.NewEIP155Signer(tx.ChainID()), key); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	tests := []struct {
+		name    string
+		tx      *staking.StakingTransaction
+		shard   uint32
+		balance *big.Int
+		want    error
+	}{
+		{"valid", delegate(fiveKOnes), shard.BeaconChainShardID, hundredKOnes, nil},
+		{"below minimum", delegate(big.NewInt(1)), shard.BeaconChainShardID, hundredKOnes, errDelegationTooSmall},
+		{"stake and gas over balance", delegate(fiveKOnes), shard.BeaconChainShardID, fiveKOnes, errInsufficientBalanceForStake},
+		{"other shard", delegate(fiveKOnes), 1, hundredKOnes, ErrInvalidTxType},
+	}
+	for _, test := range tests {
+		statedb := makeStateDBForStake(t)
+		statedb.SetBalance(from, test.balance)
+		header := newTestHeader(1).With().ShardID(test.shard).Header()
+		err := ValidateStakingTx(
+			params.TestChainConfig, makeFakeChainContextForStake(), statedb,
+			header, test.tx,
+		)
+		if errors.Cause(err) != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+		// Validating leaves the state untouched.
+		if got := statedb.GetBalance(from); got.Cmp(test.balance) != 0 {
+			t.Errorf("%s: got balance %v, want %v", test.name, got, test.balance)
+		}
+		if nonce := statedb.GetNonce(from); nonce != 0 {
+			t.Errorf("%s: got nonce %d, want 0", test.name, nonce)
+		}
+	}
+}
+
+func TestApplyTransactionGasRefund(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// PUSH1 0x00 PUSH1 0x00 SSTORE STOP, clearing slot 0.
+	clearer := common.HexToAddress("0x1011")
+	statedb.SetCode(clearer, common.FromHex("600060005500"))
+	statedb.SetState(clearer, common.Hash{}, common.HexToHash("0x01"))
+
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	apply := func(nonce uint64) *types.Receipt {
+		receipt, _, _, err := ApplyTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				nonce, clearer, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receipt
+	}
+
+	cleared := apply(0)
+	if cleared.GasRefund == 0 || cleared.GasRefund > cleared.GasUsed {
+		t.Errorf("clearing storage: got refund %d for %d gas used",
+			cleared.GasRefund, cleared.GasUsed)
+	}
+	// The slot is already empty now, nothing is refunded.
+	if noop := apply(1); noop.GasRefund != 0 {
+		t.Errorf("storing zero into an empty slot: got refund %d", noop.GasRefund)
+	}
+
+	// The refund is not part of the consensus encoding.
+	withRefund, err := rlp.EncodeToBytes(cleared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleared.GasRefund = 0
+	withoutRefund, err := rlp.EncodeToBytes(cleared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(withRefund, withoutRefund) {
+		t.Error("gas refund changes the receipt encoding")
+	}
+}
+
+func TestCXReceiptsOrder(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 6)
+	to := common.HexToAddress("0xbeef")
+	var txs types.Transactions
+	for i, key := range keys {
+		// Interleave the destinations, with a same-shard transaction in
+		// between.
+		toShard := []uint32{3, 1, 0, 2, 1, 3}[i]
+		txs = append(txs, signTestTx(t, header, key, types.NewCrossShardTransaction(
+			0, &to, 0, toShard, big.NewInt(1), 21000, big.NewInt(1), nil,
+		)))
+	}
+
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	_, outcxs, _, err := applyTransactions(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+		common.Hash{}, txs, &usedGas, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcxs) != 5 {
+		t.Fatalf("got %d cross-shard receipts, want 5", len(outcxs))
+	}
+	want := append(types.CXReceipts{}, outcxs...)
+
+	// Whatever order they come in, they end up in transaction order.
+	shuffled := types.CXReceipts{outcxs[4], outcxs[0], outcxs[3], outcxs[2], outcxs[1]}
+	sortCXReceipts(shuffled, txs)
+	for i := range want {
+		if shuffled[i] != want[i] {
+			t.Errorf("receipt %d: got the one of %x, want the one of %x",
+				i, shuffled[i].TxHash, want[i].TxHash)
+		}
+	}
+	if a, b := types.DeriveSha(shuffled), types.DeriveSha(want); a != b {
+		t.Errorf("outgoing receipts hash: got %x, want %x", a, b)
+	}
+}
+
+func TestReplayTransaction(t *testing.T) {
+	// Before staking the coinbase is the beneficiary itself.
+	config := *params.TestChainConfig
+	config.PreStakingEpoch = big.NewInt(100)
+	config.StakingEpoch = big.NewInt(100)
+	gspec := Genesis{
+		Config:   &config,
+		Factory:  blockfactory.ForTest,
+		Alloc:    GenesisAlloc{},
+		GasLimit: 1e18,
+	}
+	database := ethdb.NewMemDatabase()
+	gspec.MustCommit(database)
+	bc, err := NewBlockChain(database, nil, &config, chain2.Engine, vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, chain2.Engine)
+
+	header := blockfactory.NewTestHeader().With().
+		Number(big.NewInt(1)).
+		Epoch(big.NewInt(1)).
+		ShardID(0).
+		GasLimit(1e9).
+		Coinbase(testCoinbase).
+		Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 4)
+	// PUSH1 0x00 PUSH1 0x00 LOG0 STOP
+	logger := common.HexToAddress("0x1012")
+	statedb.SetCode(logger, common.FromHex("60006000a000"))
+	statedb = deployTestToken(t, statedb, keys)
+	txs := tokenBlockTxs(t, header, keys[:2], true)
+	for i, key := range keys[2:] {
+		txs = append(txs, signTestTx(t, header, key, types.NewTransaction(
+			0, logger, 0, big.NewInt(0), 100000, big.NewInt(1), []byte{byte(i)},
+		)))
+	}
+
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	receipts, _, _, err := applyTransactions(
+		&config, bc, &testCoinbase, gp, statedb.Copy(), header,
+		common.Hash{}, txs, &usedGas, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := types.NewBlock(header, txs, receipts, nil, nil, nil)
+	// The receipts of the block were created before its hash was known.
+	for _, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			log.BlockHash = block.Hash()
+		}
+	}
+
+	for _, i := range []int{1, 3} {
+		got, _, err := p.ReplayTransaction(block, i, statedb.Copy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := receipts[i]
+		if i == 3 && len(want.Logs) != 1 {
+			t.Fatalf("got %d logs for the logging transaction", len(want.Logs))
+		}
+		if got.GasUsed != want.GasUsed || got.CumulativeGasUsed != want.CumulativeGasUsed ||
+			got.Status != want.Status || got.TxHash != want.TxHash {
+			t.Errorf("transaction %d: got receipt %+v, want %+v", i, got, want)
+		}
+		if len(got.Logs) != len(want.Logs) {
+			t.Fatalf("transaction %d: got %d logs, want %d", i, len(got.Logs), len(want.Logs))
+		}
+		for j := range want.Logs {
+			if !reflect.DeepEqual(got.Logs[j], want.Logs[j]) {
+				t.Errorf("transaction %d: got log %+v, want %+v", i, got.Logs[j], want.Logs[j])
+			}
+		}
+	}
+	if _, _, err := p.ReplayTransaction(block, len(txs), statedb.Copy()); err == nil {
+		t.Error("replayed a transaction past the end of the block")
+	}
+}
+
+func TestRecomputeReceipt(t *testing.T) {
+	// Before staking the coinbase is the beneficiary itself.
+	config := *params.TestChainConfig
+	config.PreStakingEpoch = big.NewInt(100)
+	config.StakingEpoch = big.NewInt(100)
+	keys := make([]*ecdsa.PrivateKey, 3)
+	alloc := GenesisAlloc{}
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+		alloc[crypto.PubkeyToAddress(key.PublicKey)] = GenesisAccount{Balance: big.NewInt(1e18)}
+	}
+	// PUSH1 0x00 PUSH1 0x00 LOG0 STOP
+	logger := common.HexToAddress("0x106a")
+	alloc[logger] = GenesisAccount{Code: common.FromHex("60006000a000"), Balance: new(big.Int)}
+	gspec := Genesis{
+		Config:   &config,
+		Factory:  blockfactory.ForTest,
+		Alloc:    alloc,
+		GasLimit: 1e18,
+	}
+	database := ethdb.NewMemDatabase()
+	genesis := gspec.MustCommit(database)
+	bc, err := NewBlockChain(database, nil, &config, chain2.Engine, vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, chain2.Engine)
+
+	header := blockfactory.NewTestHeader().With().
+		ParentHash(genesis.Hash()).
+		Number(big.NewInt(1)).
+		Epoch(big.NewInt(1)).
+		ShardID(0).
+		GasLimit(1e9).
+		Coinbase(testCoinbase).
+		Header()
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x106b"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, logger, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[2], types.NewTransaction(
+			0, logger, 0, big.NewInt(0), 100000, big.NewInt(1), []byte{1},
+		)),
+	}
+	statedb, err := bc.StateAt(genesis.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	receipts, _, _, err := applyTransactions(
+		&config, bc, &testCoinbase, gp, statedb, header,
+		common.Hash{}, txs, &usedGas, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := types.NewBlock(header, txs, receipts, nil, nil, nil)
+	// The receipts of the block were created before its hash was known.
+	for _, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			log.BlockHash = block.Hash()
+		}
+	}
+	rawdb.WriteBlock(database, block)
+	rawdb.WriteCanonicalHash(database, block.Hash(), 1)
+	rawdb.WriteReceipts(database, block.Hash(), 1, receipts)
+
+	stored := bc.GetReceiptsByHash(block.Hash())
+	if len(stored) != len(txs) {
+		t.Fatalf("got %d stored receipts, want %d", len(stored), len(txs))
+	}
+	encode := func(receipt *types.Receipt) []byte {
+		enc, err := rlp.EncodeToBytes((*types.ReceiptForStorage)(receipt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}
+	for i := range txs {
+		got, err := p.RecomputeReceipt(1, i)
+		if err != nil {
+			t.Fatalf("transaction %d: %v", i, err)
+		}
+		if !bytes.Equal(encode(got), encode(stored[i])) {
+			t.Errorf("transaction %d: got receipt %+v, want %+v", i, got, stored[i])
+		}
+	}
+
+	if _, err := p.RecomputeReceipt(1, len(txs)); err == nil {
+		t.Error("recomputed the receipt of a transaction beyond the block")
+	}
+	if _, err := p.RecomputeReceipt(2, 0); err == nil {
+		t.Error("recomputed a receipt of a missing block")
+	}
+}
+
+func TestApplyIncomingReceiptTwice(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	to := common.HexToAddress("0xbeef")
+	cx := &types.CXReceipt{
+		TxHash:    common.HexToHash("0x01"),
+		To:        &to,
+		ShardID:   1,
+		ToShardID: 0,
+		Amount:    big.NewInt(5),
+	}
+	proof := &types.CXReceiptsProof{Receipts: types.CXReceipts{cx}}
+
+	if err := ApplyIncomingReceipt(params.TestChainConfig, statedb, header, proof); err != nil {
+		t.Fatal(err)
+	}
+	// The set of applied receipts survives committing the state.
+	root, err := statedb.Commit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statedb, err = state.New(root, statedb.Database())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ApplyIncomingReceipt(params.TestChainConfig, statedb, header, proof)
+	if errors.Cause(err) != ErrReceiptAlreadyApplied {
+		t.Fatalf("applying the receipt again: got error %v, want %v", err, ErrReceiptAlreadyApplied)
+	}
+	if got := statedb.GetBalance(to); got.Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("got balance %v, want 5", got)
+	}
+
+	// Before the fork receipts are not tracked.
+	config := *params.TestChainConfig
+	config.CXReplayEpoch = big.NewInt(2)
+	statedb = newTestState()
+	for i := 0; i < 2; i++ {
+		if err := ApplyIncomingReceipt(&config, statedb, header, proof); err != nil {
+			t.Fatalf("applying the receipt before the fork: %v", err)
+		}
+	}
+}
+
+func TestBaseFee(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	baseFee := big.NewInt(2)
+	header := newTestHeader(1).With().
+		Coinbase(testCoinbase).
+		BaseFee(baseFee).
+		Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// BASEFEE PUSH1 0x00 SSTORE STOP, storing the base fee into slot 0.
+	recorder := common.HexToAddress("0x1012")
+	statedb.SetCode(recorder, common.FromHex("4860005500"))
+
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	apply := func(nonce uint64, gasPrice int64) (*types.Transaction, *types.Receipt, error) {
+		tx := signTestTx(t, header, keys[0], types.NewTransaction(
+			nonce, recorder, 0, big.NewInt(0), 100000, big.NewInt(gasPrice), nil,
+		))
+		receipt, _, _, err := ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header, tx, &usedGas,
+			vm.Config{},
+		)
+		return tx, receipt, err
+	}
+
+	if _, _, err := apply(0, 1); errors.Cause(err) != ErrGasPriceBelowBaseFee {
+		t.Fatalf("gas price below base fee: got error %v", err)
+	}
+	tx, receipt, err := apply(0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statedb.GetState(recorder, common.Hash{}).Big(); got.Cmp(baseFee) != 0 {
+		t.Errorf("BASEFEE: got %v, want %v", got, baseFee)
+	}
+
+	gasUsed := new(big.Int).SetUint64(receipt.GasUsed)
+	if got, want := statedb.GetBalance(testCoinbase), new(big.Int).Mul(gasUsed, big.NewInt(5)); got.Cmp(want) != 0 {
+		t.Fatalf("coinbase before burning: got %v, want %v", got, want)
+	}
+	burned := chain2.BurnBaseFee(
+		&config, header, statedb, types.Transactions{tx}, types.Receipts{receipt},
+	)
+	if want := new(big.Int).Mul(gasUsed, baseFee); burned.Cmp(want) != 0 {
+		t.Errorf("burned %v, want %v", burned, want)
+	}
+	if got, want := statedb.GetBalance(testCoinbase), new(big.Int).Mul(gasUsed, big.NewInt(3)); got.Cmp(want) != 0 {
+		t.Errorf("coinbase after burning: got %v, want %v", got, want)
+	}
+
+	// Staking era fees are not paid out, so there is nothing to burn.
+	stakingHeader := newTestHeader(10).With().BaseFee(baseFee).Header()
+	if burned := chain2.BurnBaseFee(
+		&config, stakingHeader, statedb, types.Transactions{tx}, types.Receipts{receipt},
+	); burned.Sign() != 0 {
+		t.Errorf("burned %v in the staking era", burned)
+	}
+}
+
+func TestApplyTransactionSignerFork(t *testing.T) {
+	config := *params.TestChainConfig
+	config.EIP155Epoch = big.NewInt(2)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		frontier  = types.FrontierSigner{}
+		protected = types.NewEIP155Signer(config.ChainID)
+		otherID   = types.NewEIP155Signer(new(big.Int).Add(config.ChainID, big.NewInt(1)))
+	)
+	apply := func(epoch int64, signer types.Signer) error {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		statedb.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1e18))
+		tx, err := types.SignTx(types.NewTransaction(
+			0, common.HexToAddress("0x105d"), 0, big.NewInt(1), 21000, big.NewInt(1), nil,
+		), signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, _, err = ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header, tx, &usedGas, vm.Config{},
+		)
+		return err
+	}
+
+	tests := []struct {
+		name   string
+		epoch  int64
+		signer types.Signer
+		want   error
+	}{
+		{"unprotected before the fork", 1, frontier, nil},
+		{"replay-protected before the fork", 1, protected, ErrUnsupportedTxSigner},
+		{"replay-protected from the fork", 2, protected, nil},
+		// Replay protection is optional, like on Ethereum.
+		{"unprotected from the fork", 2, frontier, nil},
+		{"replay-protected for another chain", 2, otherID, types.ErrInvalidChainID},
+	}
+	for _, test := range tests {
+		if err := apply(test.epoch, test.signer); errors.Cause(err) != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestApplyTransactionWrongChainID(t *testing.T) {
+	config := *params.TestChainConfig
+	config.EIP155Epoch = big.NewInt(2)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID := new(big.Int).Add(config.ChainID, big.NewInt(1))
+	tests := []struct {
+		name      string
+		epoch     int64
+		toShardID uint32
+		want      error
+	}{
+		{"from the fork", 2, 0, types.ErrInvalidChainID},
+		// The chain ID is checked before whether the transaction belongs in
+		// the block.
+		{"to an unknown shard", 2, 1 << 20, types.ErrInvalidChainID},
+		{"before the fork", 1, 0, ErrUnsupportedTxSigner},
+	}
+	for _, test := range tests {
+		header := newTestHeader(test.epoch)
+		statedb := newTestState()
+		sender := crypto.PubkeyToAddress(key.PublicKey)
+		statedb.AddBalance(sender, big.NewInt(1e18))
+		to := common.HexToAddress("0x1068")
+		tx, err := types.SignTx(types.NewCrossShardTransaction(
+			0, &to, 0, test.toShardID, big.NewInt(1), 21000, big.NewInt(1), nil,
+		), types.NewEIP155Signer(otherID), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, _, err = ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header, tx, &usedGas, vm.Config{},
+		)
+		if errors.Cause(err) != test.want {
+			t.Fatalf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+		if test.want == types.ErrInvalidChainID {
+			for _, id := range []*big.Int{otherID, config.ChainID} {
+				if !strings.Contains(err.Error(), id.String()) {
+					t.Errorf("%s: error %q does not mention chain %v", test.name, err, id)
+				}
+			}
+		}
+		if statedb.GetNonce(sender) != 0 || usedGas != 0 {
+			t.Errorf("%s: rejected transaction was applied", test.name)
+		}
+	}
+}
+
+func TestApplyTransactionMinGasPrice(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	config.MinGasPriceEpoch = big.NewInt(2)
+	config.MinGasPrices = map[uint32]*big.Int{0: big.NewInt(100)}
+	otherShard := config
+	otherShard.MinGasPrices = map[uint32]*big.Int{1: big.NewInt(100)}
+	tests := []struct {
+		name     string
+		config   *params.ChainConfig
+		epoch    int64
+		gasPrice int64
+		want     error
+	}{
+		{"below before the fork", &config, 1, 99, nil},
+		{"below from the fork", &config, 2, 99, ErrUnderpriced},
+		{"at the minimum", &config, 2, 100, nil},
+		{"above the minimum", &config, 3, 101, nil},
+		{"minimum of another shard", &otherShard, 2, 1, nil},
+	}
+	for _, test := range tests {
+		header := newTestHeader(test.epoch).With().Coinbase(testCoinbase).Header()
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		tx := signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x1069"), 0, big.NewInt(1), 21000,
+			big.NewInt(test.gasPrice), nil,
+		))
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, _, err := ApplyTransaction(
+			test.config, nil, &testCoinbase, gp, statedb.Copy(), header, tx,
+			&usedGas, vm.Config{},
+		)
+		if errors.Cause(err) != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+		// Importing a block enforces the same minimum.
+		blk := types.NewBlockWithHeader(header).WithBody(types.Transactions{tx}, nil, nil, nil)
+		bc := newTestChain(t, test.config)
+		defer bc.Stop()
+		p := NewStateProcessor(test.config, bc, &offlineEngine{})
+		if _, _, _, _, _, err := p.Process(blk, statedb, vm.Config{}); errors.Cause(err) != test.want {
+			t.Errorf("%s: got error %v on processing, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestApplyTransactionModExpGas(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	config.ModExpGasEpoch = big.NewInt(2)
+	// 3 ** (2**256 - 2**32 - 978) mod (2**256 - 2**32 - 977), from EIP-198
+	input := common.FromHex(
+		"0000000000000000000000000000000000000000000000000000000000000001" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"03" +
+			"fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2e" +
+			"fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f",
+	)
+	modExp := common.BytesToAddress([]byte{5})
+
+	apply := func(epoch int64) uint64 {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, modExp, 0, big.NewInt(0), 100000, big.NewInt(1), input,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("epoch %d: modular exponentiation failed", epoch)
+		}
+		return receipt.GasUsed
+	}
+
+	// The operation costs 13056 gas under EIP-198 and 1360 under EIP-2565.
+	before, after := apply(1), apply(2)
+	if before-after != 13056-1360 {
+		t.Errorf("got %d gas before the fork and %d after, want %d less",
+			before, after, 13056-1360)
+	}
+	if later := apply(3); later != after {
+		t.Errorf("got %d gas after the fork, want %d", later, after)
+	}
+}
+
+func TestStateClearingEpoch(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	config.StateClearingEpoch = big.NewInt(2)
+	var (
+		transferred = common.HexToAddress("0x1081")
+		received    = common.HexToAddress("0x1082")
+	)
+
+	for _, test := range []struct {
+		epoch int64
+		kept  bool
+	}{
+		{1, true},
+		{2, false},
+	} {
+		header := newTestHeader(test.epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.Finalise(true)
+
+		// A transfer of no value to a missing account.
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		if _, _, _, err := ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, transferred, 0, big.NewInt(0), 21000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		); err != nil {
+			t.Fatal(err)
+		}
+		if statedb.Exist(transferred) != test.kept {
+			t.Errorf("epoch %d: empty account of the transfer kept: %v, want %v",
+				test.epoch, statedb.Exist(transferred), test.kept)
+		}
+
+		// An incoming receipt of no value to a missing account.
+		proof := &types.CXReceiptsProof{Receipts: types.CXReceipts{{
+			TxHash:    common.HexToHash("0x01"),
+			To:        &received,
+			ShardID:   1,
+			ToShardID: 0,
+			Amount:    big.NewInt(0),
+		}}}
+		if err := ApplyIncomingReceipt(&config, statedb, header, proof); err != nil {
+			t.Fatal(err)
+		}
+		if statedb.Exist(received) != test.kept {
+			t.Errorf("epoch %d: empty account of the receipt kept: %v, want %v",
+				test.epoch, statedb.Exist(received), test.kept)
+		}
+	}
+}
+
+func TestApplyTransactionEffectiveGasPrice(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseFee *big.Int
+	}{
+		{"legacy", nil},
+		{"base fee", big.NewInt(2)},
+	}
+	for _, test := range tests {
+		header := newTestHeader(1)
+		if test.baseFee != nil {
+			header = header.With().BaseFee(test.baseFee).Header()
+		}
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		sender := crypto.PubkeyToAddress(keys[0].PublicKey)
+		before := statedb.GetBalance(sender)
+		tx := signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x1063"), 0, big.NewInt(1000), 21000, big.NewInt(5), nil,
+		))
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, gas, err := ApplyTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb, header, tx,
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := receipt.EffectiveGasPrice; got == nil || got.Cmp(tx.GasPrice()) != 0 {
+			t.Errorf("%s: got effective gas price %v, want %v", test.name, got, tx.GasPrice())
+		}
+		// The sender paid the effective price for the gas used.
+		paid := new(big.Int).Sub(before, statedb.GetBalance(sender))
+		want := new(big.Int).Mul(new(big.Int).SetUint64(gas), receipt.EffectiveGasPrice)
+		want.Add(want, tx.Value())
+		if paid.Cmp(want) != 0 {
+			t.Errorf("%s: sender paid %v, want %v", test.name, paid, want)
+		}
+	}
+}
+
+func TestRequiredBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseFee *big.Int
+	}{
+		{"legacy", nil},
+		{"base fee", big.NewInt(2)},
+	}
+	for _, test := range tests {
+		header := newTestHeader(1)
+		if test.baseFee != nil {
+			header = header.With().BaseFee(test.baseFee).Header()
+		}
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The whole gas limit is bought, not only the gas used.
+		tx := signTestTx(t, header, key, types.NewTransaction(
+			0, common.HexToAddress("0x107c"), 0, big.NewInt(1000), 30000, big.NewInt(5), nil,
+		))
+		required := RequiredBalance(tx)
+		if want := big.NewInt(1000 + 30000*5); required.Cmp(want) != 0 {
+			t.Errorf("%s: got required balance %v, want %v", test.name, required, want)
+		}
+
+		// Exactly the required balance is enough, one less is not.
+		for _, balance := range []*big.Int{required, new(big.Int).Sub(required, common.Big1)} {
+			statedb := newTestState()
+			statedb.AddBalance(crypto.PubkeyToAddress(key.PublicKey), balance)
+			var (
+				gp      = new(GasPool).AddGas(header.GasLimit())
+				usedGas uint64
+			)
+			receipt, _, _, err := ApplyTransaction(
+				params.TestChainConfig, nil, &testCoinbase, gp, statedb, header, tx,
+				&usedGas, vm.Config{},
+			)
+			ok := err == nil && receipt.Status == types.ReceiptStatusSuccessful
+			if enough := balance.Cmp(required) >= 0; ok != enough {
+				t.Errorf("%s: with a balance of %v got error %v, receipt %+v",
+					test.name, balance, err, receipt)
+			}
+		}
+	}
+
+	// The amount does not overflow with the largest gas limit and price.
+	maxPrice := new(big.Int).Lsh(common.Big1, 256)
+	maxPrice.Sub(maxPrice, common.Big1)
+	tx := types.NewTransaction(
+		0, common.HexToAddress("0x107c"), 0, maxPrice, math.MaxUint64, maxPrice, nil,
+	)
+	want := new(big.Int).Mul(new(big.Int).SetUint64(math.MaxUint64), maxPrice)
+	want.Add(want, maxPrice)
+	if got := RequiredBalance(tx); got.Cmp(want) != 0 {
+		t.Errorf("got required balance %v, want %v", got, want)
+	}
+	if tx.GasPrice().Cmp(maxPrice) != 0 || tx.Value().Cmp(maxPrice) != 0 {
+		t.Error("computing the required balance modified the transaction")
+	}
+}
+
+func TestApplyTransactionGasUsedExceedsLimit(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	tx := signTestTx(t, header, keys[0], types.NewTransaction(
+		0, common.HexToAddress("0x1060"), 0, big.NewInt(1), 21000, big.NewInt(1), nil,
+	))
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	overLimit := func(
+		evm *vm.EVM, msg Message, gp *GasPool, payer common.Address, quiet bool,
+	) (*ExecutionResult, uint64, uint64, error) {
+		result, _, refund, err := applyMessage(evm, msg, gp, payer, quiet)
+		return result, msg.Gas() + 1, refund, err
+	}
+	receipt, _, _, _, err := applyTransaction(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header, tx,
+		&usedGas, vm.Config{}, applyOptions{applyMessage: overLimit},
+	)
+	if errors.Cause(err) != ErrGasUsedExceedsLimit {
+		t.Fatalf("got error %v, want %v", err, ErrGasUsedExceedsLimit)
+	}
+	for _, want := range []string{"21001", "21000"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+	if receipt != nil || usedGas != 0 {
+		t.Errorf("got receipt %v and %d gas used for a rejected transaction", receipt, usedGas)
+	}
+}
+
+func TestApplyTransactionGasUintOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		usedGas  uint64
+		overflow bool
+	}{
+		{"fits", math.MaxUint64 - 21000, false},
+		{"overflows", math.MaxUint64 - 20999, true},
+	}
+	for _, test := range tests {
+		header := newTestHeader(1)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		tx := signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x1065"), 0, big.NewInt(1), 21000, big.NewInt(1), nil,
+		))
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas = test.usedGas
+		)
+		receipt, _, _, err := ApplyTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb, header, tx,
+			&usedGas, vm.Config{},
+		)
+		if !test.overflow {
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if usedGas != math.MaxUint64 || receipt.CumulativeGasUsed != math.MaxUint64 {
+				t.Errorf("%s: got %d gas used, want %d", test.name, usedGas, uint64(math.MaxUint64))
+			}
+			continue
+		}
+		if errors.Cause(err) != ErrGasUintOverflow {
+			t.Fatalf("%s: got error %v, want %v", test.name, err, ErrGasUintOverflow)
+		}
+		if receipt != nil || usedGas != test.usedGas {
+			t.Errorf("%s: got receipt %v and %d gas used for a rejected transaction", test.name, receipt, usedGas)
+		}
+	}
+}
+
+func TestApplyTransactionStateRoot(t *testing.T) {
+	tests := []struct {
+		name     string
+		s3Epoch  *big.Int // S3Epoch, selecting the opposite rule
+		strategy params.StateRootStrategy
+		wantRoot bool
+	}{
+		{"finalise", big.NewInt(10), FinaliseStateRoot, false},
+		{"intermediate root", big.NewInt(0), IntermediateStateRoot, true},
+	}
+	for _, test := range tests {
+		config := *params.TestChainConfig
+		config.S3Epoch = test.s3Epoch
+		config.StateRoot = test.strategy
+		header := newTestHeader(1)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		tx := signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x1066"), 0, big.NewInt(1), 21000, big.NewInt(1), nil,
+		))
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header, tx, &usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !test.wantRoot {
+			if len(receipt.PostState) != 0 {
+				t.Errorf("%s: receipt records root %x", test.name, receipt.PostState)
+			}
+			continue
+		}
+		if want := statedb.IntermediateRoot(false); !bytes.Equal(receipt.PostState, want.Bytes()) {
+			t.Errorf("%s: receipt records root %x, want %x", test.name, receipt.PostState, want)
+		}
+	}
+}
+
+func TestStateRootStrategyStateClearing(t *testing.T) {
+	to := common.HexToAddress("0x1085")
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// apply applies a transfer of no value to a missing account at epoch
+	// under config and returns the receipt, the root of the state and
+	// whether the account was kept.
+	apply := func(config *params.ChainConfig, epoch int64) (*types.Receipt, common.Hash, bool) {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		statedb.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1e18))
+		statedb.Finalise(true)
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, key, types.NewTransaction(
+				0, to, 0, big.NewInt(0), 21000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receipt, statedb.IntermediateRoot(false), statedb.Exist(to)
+	}
+
+	tests := []struct {
+		name     string
+		s3Epoch  *big.Int // S3Epoch, selecting the same rule as strategy
+		strategy params.StateRootStrategy
+	}{
+		{"finalise", big.NewInt(0), FinaliseStateRoot},
+		{"intermediate root", big.NewInt(10), IntermediateStateRoot},
+	}
+	for _, test := range tests {
+		config := *params.TestChainConfig
+		config.StakingEpoch = big.NewInt(10)
+		config.S3Epoch = test.s3Epoch
+		config.StateClearingEpoch = big.NewInt(2)
+		withStrategy := config
+		withStrategy.StateRoot = test.strategy
+		for _, epoch := range []int64{1, 2} {
+			wantReceipt, wantRoot, wantKept := apply(&config, epoch)
+			receipt, root, kept := apply(&withStrategy, epoch)
+			if kept != wantKept {
+				t.Errorf("%s at epoch %d: empty account kept: %v, want %v",
+					test.name, epoch, kept, wantKept)
+			}
+			if root != wantRoot {
+				t.Errorf("%s at epoch %d: got state root %x, want %x",
+					test.name, epoch, root, wantRoot)
+			}
+			if !bytes.Equal(receipt.PostState, wantReceipt.PostState) {
+				t.Errorf("%s at epoch %d: receipt records root %x, want %x",
+					test.name, epoch, receipt.PostState, wantReceipt.PostState)
+			}
+		}
+	}
+}
+
+func TestApplyTransactionMissingTrieNode(t *testing.T) {
+	header := newTestHeader(1)
+	diskdb := ethdb.NewMemDatabase()
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(diskdb))
+	keys := newTestKeys(t, statedb, 1)
+	to := common.HexToAddress("0x1078")
+	statedb.AddBalance(to, big.NewInt(1))
+	root, err := statedb.Commit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := statedb.Database().TrieDB().Commit(root, false); err != nil {
+		t.Fatal(err)
+	}
+	// Prune the nodes only on the path to the recipient, as a pruned
+	// database would.
+	tr, err := statedb.Database().OpenTrie(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofs := make([]*ethdb.MemDatabase, 2)
+	for i, addr := range []common.Address{to, crypto.PubkeyToAddress(keys[0].PublicKey)} {
+		proofs[i] = ethdb.NewMemDatabase()
+		// The proof of a secure trie takes the hashed key.
+		if err := tr.Prove(crypto.Keccak256(addr[:]), 0, proofs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range proofs[0].Keys() {
+		if ok, _ := proofs[1].Has(key); !ok {
+			diskdb.Delete(key)
+		}
+	}
+
+	statedb, err = state.New(root, state.NewDatabase(diskdb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := signTestTx(t, header, keys[0], types.NewTransaction(
+		0, to, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+	))
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	_, _, _, err = ApplyTransaction(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header, tx, &usedGas, vm.Config{},
+	)
+	if _, ok := errors.Cause(err).(*trie.MissingNodeError); !ok {
+		t.Errorf("got error %v, want a missing trie node", err)
+	}
+	if _, err := statedb.IntermediateRootWithError(false); err == nil {
+		t.Error("computed the root of an incomplete state")
+	}
+}
+
+// burningEngine finalizes blocks by crediting a fixed reward to their
+// coinbase and burning the base fee portion of their fees.
+type burningEngine struct {
+	consensus_engine.Engine
+
+	config *params.ChainConfig
+	reward *big.Int
+}
+
+func (e *burningEngine) Finalize(
+	chain consensus_engine.ChainReader, header *block.Header,
+	state *state.DB, txs []*types.Transaction,
+	receipts []*types.Receipt, outcxs []*types.CXReceipt,
+	incxs []*types.CXReceiptsProof, stks staking.StakingTransactions,
+	doubleSigners slash.Records,
+) (*types.Block, reward.Reader, error) {
+	state.AddBalance(header.Coinbase(), e.reward)
+	chain2.BurnBaseFee(e.config, header, state, txs, receipts)
+	return nil, network.NewPreStakingEraRewarded(e.reward), nil
+}
+
+func TestProcessWithFees(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	engine := &burningEngine{config: &config, reward: big.NewInt(1000000)}
+	p := NewStateProcessor(&config, nil, engine)
+
+	for _, epoch := range []int64{1, 10} {
+		header := newTestHeader(epoch).With().
+			Number(big.NewInt(0)).
+			Coinbase(testCoinbase).
+			BaseFee(big.NewInt(2)).
+			Header()
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 3)
+		txs := make(types.Transactions, len(keys))
+		for i, key := range keys {
+			txs[i] = signTestTx(t, header, key, types.NewTransaction(
+				0, common.HexToAddress("0x104b"), 0, big.NewInt(1000), 21000,
+				big.NewInt(int64(3+i)), nil,
+			))
+		}
+		block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+
+		_, _, _, _, _, fees, err := p.ProcessWithFees(block, statedb, vm.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The fees are 21000 * (3 + 4 + 5), of which the base fee portion
+		// 21000 * 3 * 2 is burned before staking, and all of them after.
+		collected, burned := big.NewInt(21000*12), big.NewInt(21000*6)
+		if epoch >= 10 {
+			burned = collected
+		}
+		if fees.Collected.Cmp(collected) != 0 || fees.Burned.Cmp(burned) != 0 {
+			t.Errorf("epoch %d: got %v collected, %v burned, want %v, %v",
+				epoch, fees.Collected, fees.Burned, collected, burned)
+		}
+		// What is not burned is the proposer's, on top of the block reward.
+		proposed := new(big.Int).Sub(statedb.GetBalance(testCoinbase), engine.reward)
+		if got := new(big.Int).Add(proposed, fees.Burned); got.Cmp(fees.Collected) != 0 {
+			t.Errorf("epoch %d: proposer got %v and %v burned, but %v collected",
+				epoch, proposed, fees.Burned, fees.Collected)
+		}
+		if want := new(big.Int).Sub(engine.reward, burned); fees.NetIssuance.Cmp(want) != 0 {
+			t.Errorf("epoch %d: got net issuance %v, want %v", epoch, fees.NetIssuance, want)
+		}
+	}
+}
+
+func TestInsertChainCountsFeesBurned(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+	total := metrics.GetOrRegisterCounter("hmy/fees/burned/total", nil)
+
+	// Before staking, with a reward schedule paying nothing, so that blocks
+	// are finalized without counting signatures.
+	config := *params.TestChainConfig
+	config.PreStakingEpoch = big.NewInt(100)
+	config.StakingEpoch = big.NewInt(100)
+	config.RewardSchedule = []params.RewardTier{
+		{Epoch: big.NewInt(0), BlockReward: big.NewInt(0)},
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gspec := Genesis{
+		Config:  &config,
+		Factory: blockfactory.ForTest,
+		Alloc: GenesisAlloc{
+			crypto.PubkeyToAddress(key.PublicKey): {Balance: big.NewInt(1e18)},
+		},
+		GasLimit: 1e18,
+		ShardState: shard.State{
+			Epoch: big.NewInt(0),
+			Shards: []shard.Committee{{ShardID: 0, Slots: shard.SlotList{
+				{EcdsaAddress: testCoinbase, BLSPublicKey: shard.BLSPublicKey{1}},
+			}}},
+		},
+	}
+	database := ethdb.NewMemDatabase()
+	genesis := gspec.MustCommit(database)
+	bc, err := NewBlockChain(database, nil, &config, chain2.Engine, vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Stop()
+
+	header := blockfactory.NewTestHeader().With().
+		ParentHash(genesis.Hash()).
+		Number(big.NewInt(1)).
+		Epoch(big.NewInt(0)).
+		ShardID(0).
+		GasLimit(1e9).
+		Coinbase(testCoinbase).
+		BaseFee(big.NewInt(2 * denominations.Nano)).
+		Header()
+	txs := types.Transactions{signTestTx(t, header, key, types.NewTransaction(
+		0, common.HexToAddress("0x1087"), 0, big.NewInt(1000), 21000,
+		big.NewInt(3*denominations.Nano), nil,
+	))}
+	statedb, err := bc.StateAt(genesis.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := total.Count()
+	receipts, cxs, _, usedGas, _, err := bc.Processor().Process(
+		types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil), statedb, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := total.Count() - before; got != 0 {
+		t.Errorf("processing a block counted %d nanos burned", got)
+	}
+	header = header.With().
+		GasUsed(usedGas).
+		Root(statedb.IntermediateRoot(config.IsStateClearing(header.Epoch()))).
+		Header()
+	block := types.NewBlock(header, txs, receipts, cxs, nil, nil)
+
+	if _, err := bc.InsertChain(types.Blocks{block}, false); err != nil {
+		t.Fatal(err)
+	}
+	// The base fee portion of the fee is burned.
+	if got, want := total.Count()-before, int64(21000*2); got != want {
+		t.Errorf("inserting a block counted %d nanos burned, want %d", got, want)
+	}
+	if _, err := bc.InsertChain(types.Blocks{block}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := total.Count()-before, int64(21000*2); got != want {
+		t.Errorf("inserting a known block counted %d nanos burned, want %d", got, want)
+	}
+}
+
+func TestProcessTips(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	engine := &burningEngine{config: &config, reward: big.NewInt(1000000)}
+	p := NewStateProcessor(&config, nil, engine)
+	tests := []struct {
+		name    string
+		epoch   int64
+		baseFee *big.Int
+		tips    int64 // per gas, summed over the transactions
+	}{
+		{"without base fee", 1, nil, 3 + 4 + 5},
+		{"with base fee", 1, big.NewInt(2), 1 + 2 + 3},
+		{"staking era", 10, big.NewInt(2), 0},
+	}
+	for _, test := range tests {
+		header := newTestHeader(test.epoch).With().
+			Number(big.NewInt(0)).
+			Coinbase(testCoinbase).
+			Header()
+		if test.baseFee != nil {
+			header = header.With().BaseFee(test.baseFee).Header()
+		}
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 3)
+		txs := make(types.Transactions, len(keys))
+		for i, key := range keys {
+			txs[i] = signTestTx(t, header, key, types.NewTransaction(
+				0, common.HexToAddress("0x106f"), 0, big.NewInt(1000), 21000,
+				big.NewInt(int64(3+i)), nil,
+			))
+		}
+
+		var (
+			applied = statedb.Copy()
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+			sum     = new(big.Int)
+		)
+		for i, tx := range txs {
+			applied.Prepare(tx.Hash(), common.Hash{}, i)
+			_, _, tip, _, err := ApplyTransactionWithTip(
+				&config, nil, &testCoinbase, gp, applied, header, tx, &usedGas, vm.Config{},
+			)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			sum.Add(sum, tip)
+		}
+		if want := big.NewInt(21000 * test.tips); sum.Cmp(want) != 0 {
+			t.Errorf("%s: got tips %v, want %v", test.name, sum, want)
+		}
+
+		block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+		_, _, _, _, _, fees, err := p.ProcessWithFees(block, statedb, vm.Config{})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if fees.Tips.Cmp(sum) != 0 {
+			t.Errorf("%s: got total tips %v, want the sum %v", test.name, fees.Tips, sum)
+		}
+		// The tips are what the proposer earns on top of the block reward.
+		earned := new(big.Int).Sub(statedb.GetBalance(testCoinbase), engine.reward)
+		if earned.Cmp(fees.Tips) != 0 {
+			t.Errorf("%s: proposer earned %v, want %v", test.name, earned, fees.Tips)
+		}
+	}
+}
+
+func TestProcessNoReward(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	engine := &burningEngine{config: &config, reward: big.NewInt(1000000)}
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, engine)
+	statedb := newTestState()
+	blk, _ := signedTransferBlock(t, statedb, 2)
+	before := statedb.GetBalance(testCoinbase)
+
+	rewarded := statedb.Copy()
+	receipts, _, _, usedGas, _, err := p.Process(blk, rewarded, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotReceipts, gotUsedGas, err := p.ProcessNoReward(blk, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotUsedGas != usedGas || len(gotReceipts) != len(receipts) {
+		t.Errorf("got %d receipts using %d gas, want %d using %d",
+			len(gotReceipts), gotUsedGas, len(receipts), usedGas)
+	}
+	// The coinbase only earns the fees, at a gas price of 1.
+	want := new(big.Int).Add(before, new(big.Int).SetUint64(usedGas))
+	if got := statedb.GetBalance(testCoinbase); got.Cmp(want) != 0 {
+		t.Errorf("got coinbase balance %v, want %v", got, want)
+	}
+	want.Add(want, engine.reward)
+	if got := rewarded.GetBalance(testCoinbase); got.Cmp(want) != 0 {
+		t.Errorf("got coinbase balance %v after Process, want %v", got, want)
+	}
+	recipient := common.HexToAddress("0x104b")
+	if got := statedb.GetBalance(recipient); got.Cmp(big.NewInt(2000)) != 0 {
+		t.Errorf("got recipient balance %v, want 2000", got)
+	}
+}
+
+func TestProcessAtEpoch(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	config.CrossTxEpoch = big.NewInt(1)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	// PUSH1 0x00 PUSH1 0x00 LOG0 STOP
+	logger := common.HexToAddress("0x1070")
+	to := common.HexToAddress("0x1071")
+	makeBlock := func(statedb *state.DB, epoch int64) *types.Block {
+		header := newTestHeader(epoch).With().Coinbase(testCoinbase).Header()
+		statedb.SetCode(logger, common.FromHex("60006000a000"))
+		keys := newTestKeys(t, statedb, 2)
+		return types.NewBlockWithHeader(header).WithBody(types.Transactions{
+			signTestTx(t, header, keys[0], types.NewCrossShardTransaction(
+				0, &to, 0, 1, big.NewInt(1000), 21000, big.NewInt(1), nil,
+			)),
+			signTestTx(t, header, keys[1], types.NewTransaction(
+				0, logger, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+			)),
+		}, nil, nil, nil)
+	}
+
+	// Cross-shard transactions are accepted from epoch 2 on; before, their
+	// destination shard is ignored.
+	statedb := newTestState()
+	block := makeBlock(statedb, 1)
+	atReal := statedb.Copy()
+	_, outcxs, _, _, _, err := p.Process(block, atReal, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcxs) != 0 || atReal.GetBalance(to).Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("got %d cross-shard receipts at the real epoch, want a local transfer", len(outcxs))
+	}
+	_, outcxs, allLogs, _, _, err := p.ProcessAtEpoch(block, statedb, vm.Config{}, big.NewInt(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcxs) != 1 || outcxs[0].ToShardID != 1 || statedb.GetBalance(to).Sign() != 0 {
+		t.Errorf("got cross-shard receipts %v, want one to shard 1", outcxs)
+	}
+	if block.Epoch().Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("block epoch changed to %v", block.Epoch())
+	}
+	if len(allLogs) != 1 || allLogs[0].BlockHash != block.Hash() {
+		t.Errorf("got logs %v, want one of block %x", allLogs, block.Hash())
+	}
+
+	statedb = newTestState()
+	block = makeBlock(statedb, 2)
+	_, outcxs, _, _, _, err = p.ProcessAtEpoch(block, statedb, vm.Config{}, big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcxs) != 0 {
+		t.Errorf("got %d cross-shard receipts at the earlier epoch, want none", len(outcxs))
+	}
+}
+
+func TestProcessDryRun(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	statedb := newTestState()
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	keys := newTestKeys(t, statedb, 2)
+	to := common.HexToAddress("0x1067")
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewCrossShardTransaction(
+			0, &to, 0, 1, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, to, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+	}
+	blk := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+	root := statedb.IntermediateRoot(true)
+
+	receipts, outcxs, err := p.ProcessDryRun(blk, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statedb.IntermediateRoot(true); got != root {
+		t.Errorf("state was modified: root %x, want %x", got, root)
+	}
+	for _, key := range keys {
+		if nonce := statedb.GetNonce(crypto.PubkeyToAddress(key.PublicKey)); nonce != 0 {
+			t.Errorf("got sender nonce %d, want 0", nonce)
+		}
+	}
+
+	// The dry run previews what processing the block produces.
+	wantReceipts, wantOutcxs, _, _, _, err := p.Process(blk, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcxs) != 1 || outcxs[0].ToShardID != 1 || outcxs[0].TxHash != txs[0].Hash() {
+		t.Fatalf("got cross-shard receipts %v, want the one of the first transaction", outcxs)
+	}
+	if a, b := types.DeriveSha(outcxs), types.DeriveSha(wantOutcxs); a != b {
+		t.Errorf("outgoing receipts hash: got %x, want %x", a, b)
+	}
+	if a, b := types.DeriveSha(receipts), types.DeriveSha(wantReceipts); a != b {
+		t.Errorf("receipts hash: got %x, want %x", a, b)
+	}
+}
+
+func TestCheckGasUsed(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 2)
+	statedb = deployTestToken(t, statedb, keys)
+	receipts, usedGas := runApplier(
+		t, applyTransactions, statedb, header, tokenBlockTxs(t, header, keys, false),
+	)
+	if err := checkGasUsed(header.GasLimit(), usedGas, receipts); err != nil {
+		t.Fatalf("consistent gas used: %v", err)
+	}
+
+	// Simulate over-counting gas in various places.
+	if err := checkGasUsed(usedGas-1, usedGas, receipts); err == nil {
+		t.Error("gas used over the limit was accepted")
+	}
+	if err := checkGasUsed(header.GasLimit(), usedGas+1, receipts); err == nil {
+		t.Error("gas used not matching the receipts was accepted")
+	}
+	receipts[0].GasUsed++
+	if err := checkGasUsed(header.GasLimit(), usedGas, receipts); err == nil {
+		t.Error("receipt gas used not matching its cumulative gas used was accepted")
+	}
+	receipts[0].GasUsed--
+
+	// Inconsistent cumulative gas used, with the receipts still hashing.
+	last := receipts[len(receipts)-1]
+	last.CumulativeGasUsed++
+	if err := checkGasUsed(header.GasLimit(), usedGas, receipts); err == nil {
+		t.Error("last cumulative gas used not matching the gas used was accepted")
+	}
+	last.CumulativeGasUsed--
+	receipts[1].CumulativeGasUsed = receipts[0].CumulativeGasUsed - 1
+	if err := checkGasUsed(header.GasLimit(), usedGas, receipts); err == nil {
+		t.Error("decreasing cumulative gas used was accepted")
+	}
+}
+
+func TestPredictContractAddress(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	from := crypto.PubkeyToAddress(keys[0].PublicKey)
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	apply := func(tx *types.Transaction) *types.Receipt {
+		receipt, _, _, err := ApplyTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], tx), &usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatal("transaction failed")
+		}
+		return receipt
+	}
+
+	// Deploy a factory whose code CREATE2s the call data as init code with
+	// salt 0x2a, storing the address of the created contract into slot 0.
+	factoryCode := common.FromHex("366000600037602a3660006000f560005500")
+	// PUSH1 len PUSH1 12 PUSH1 0 CODECOPY PUSH1 len PUSH1 0 RETURN <code>
+	deployCode := append(common.FromHex("6012600c60003960126000f3"), factoryCode...)
+	receipt := apply(types.NewContractCreation(
+		0, 0, big.NewInt(0), 1000000, big.NewInt(1), deployCode,
+	))
+	factory := PredictContractAddress(from, 0)
+	if receipt.ContractAddress != factory {
+		t.Fatalf("deployed %s, predicted %s", receipt.ContractAddress.Hex(), factory.Hex())
+	}
+	if code := statedb.GetCode(factory); !bytes.Equal(code, factoryCode) {
+		t.Fatalf("code at predicted address %x, want %x", code, factoryCode)
+	}
+
+	initCode := common.FromHex("00")
+	apply(types.NewTransaction(
+		1, factory, 0, big.NewInt(0), 1000000, big.NewInt(1), initCode,
+	))
+	created := common.BytesToAddress(statedb.GetState(factory, common.Hash{}).Bytes())
+	predicted := PredictContractAddress2(
+		factory, common.BigToHash(big.NewInt(0x2a)), crypto.Keccak256Hash(initCode),
+	)
+	if created != predicted {
+		t.Errorf("CREATE2 deployed %s, predicted %s", created.Hex(), predicted.Hex())
+	}
+}
+
+// offlineChain is a ProcessChain serving a fixed set of headers, as an
+// offline tool without a BlockChain would.
+type offlineChain struct {
+	ProcessChain // not needed by the blocks processed
+
+	headers map[common.Hash]*block.Header
+}
+
+func (c *offlineChain) Config() *params.ChainConfig {
+	return params.TestChainConfig
+}
+
+func (c *offlineChain) GetHeader(hash common.Hash, number uint64) *block.Header {
+	if header, ok := c.headers[hash]; ok && header.Number().Uint64() == number {
+		return header
+	}
+	return nil
+}
+
+func (c *offlineChain) GetECDSAFromCoinbase(header *block.Header) (common.Address, error) {
+	return header.Coinbase(), nil
+}
+
+// offlineEngine finalizes blocks without paying out any rewards, recording the
+// chain it was given.
+type offlineEngine struct {
+	consensus_engine.Engine
+
+	chain consensus_engine.ChainReader
+}
+
+func (e *offlineEngine) Finalize(
+	chain consensus_engine.ChainReader, header *block.Header,
+	state *state.DB, txs []*types.Transaction,
+	receipts []*types.Receipt, outcxs []*types.CXReceipt,
+	incxs []*types.CXReceiptsProof, stks staking.StakingTransactions,
+	doubleSigners slash.Records,
+) (*types.Block, reward.Reader, error) {
+	e.chain = chain
+	return nil, network.EmptyPayout, nil
+}
+
+func TestProcessWithChain(t *testing.T) {
+	grandparent := newTestHeader(1).With().
+		Number(big.NewInt(1)).
+		ParentHash(common.HexToHash("0x1111")).
+		Header()
+	parent := newTestHeader(1).With().
+		Number(big.NewInt(2)).
+		ParentHash(grandparent.Hash()).
+		Header()
+	header := newTestHeader(1).With().
+		Number(big.NewInt(3)).
+		ParentHash(parent.Hash()).
+		Coinbase(testCoinbase).
+		Header()
+	chain := &offlineChain{headers: map[common.Hash]*block.Header{
+		grandparent.Hash(): grandparent,
+		parent.Hash():      parent,
+	}}
+
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// PUSH1 0x01 BLOCKHASH PUSH1 0x00 SSTORE STOP, resolving the hash of
+	// block 1 through the chain.
+	recorder := common.HexToAddress("0x1013")
+	statedb.SetCode(recorder, common.FromHex("60014060005500"))
+	tx := signTestTx(t, header, keys[0], types.NewTransaction(
+		0, recorder, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+	))
+	block := types.NewBlockWithHeader(header).WithBody(
+		types.Transactions{tx}, nil, nil, nil,
+	)
+
+	engine := &offlineEngine{}
+	p := NewStateProcessor(params.TestChainConfig, nil, engine)
+	receipts, _, _, usedGas, _, err := p.ProcessWithChain(
+		chain, block, statedb, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || usedGas != receipts[0].GasUsed {
+		t.Fatalf("got %d receipts, %d gas used", len(receipts), usedGas)
+	}
+	if got := statedb.GetState(recorder, common.Hash{}); got != grandparent.Hash() {
+		t.Errorf("BLOCKHASH(1) = %s, want %s", got.Hex(), grandparent.Hash().Hex())
+	}
+	if engine.chain != chain {
+		t.Error("block not finalized with the given chain")
+	}
+}
+
+func TestApplyTransactionOpcodeGas(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// Store i+1 into slot i for i from 0 to 9:
+	//
+	//   PUSH1 0x00 JUMPDEST DUP1 PUSH1 0x01 ADD DUP2 SSTORE PUSH1 0x01 ADD
+	//   DUP1 PUSH1 0x0a GT PUSH1 0x02 JUMPI STOP
+	loop := common.HexToAddress("0x1014")
+	statedb.SetCode(loop, common.FromHex("60005b80600101815560010180600a1160025700"))
+
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	apply := func(nonce uint64, cfg vm.Config) *types.Receipt {
+		receipt, _, _, err := ApplyTransaction(
+			params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				nonce, loop, 0, big.NewInt(0), 1000000, big.NewInt(1), nil,
+			)),
+			&usedGas, cfg,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receipt
+	}
+
+	if receipt := apply(0, vm.Config{OpcodeGas: true}); receipt.OpcodeGas != nil {
+		t.Error("opcode gas summed up outside debug mode")
+	}
+	receipt := apply(1, vm.Config{
+		Debug: true, Tracer: vm.NewStructLogger(nil), OpcodeGas: true,
+	})
+	sstore := receipt.OpcodeGas["SSTORE"]
+	if sstore == 0 {
+		t.Fatalf("no gas consumed by SSTORE in %v", receipt.OpcodeGas)
+	}
+	for op, gas := range receipt.OpcodeGas {
+		if op != "SSTORE" && gas >= sstore {
+			t.Errorf("%s consumed %d gas, SSTORE only %d", op, gas, sstore)
+		}
+	}
+}
+
+func TestApplyTransactionVMLimits(t *testing.T) {
+	// PUSH1 0x00 1100 times, exceeding the default stack limit, then STOP
+	deepStack := common.HexToAddress("0x1046")
+	// Call itself with its calldata decremented until it is zero, and revert
+	// if the nested call fails:
+	//
+	//   PUSH1 0x00 CALLDATALOAD DUP1 ISZERO PUSH1 0x23 JUMPI
+	//   PUSH1 0x01 SWAP1 SUB PUSH1 0x00 MSTORE
+	//   PUSH1 0x00 PUSH1 0x00 PUSH1 0x20 PUSH1 0x00 PUSH1 0x00 ADDRESS GAS CALL
+	//   PUSH1 0x23 JUMPI PUSH1 0x00 DUP1 REVERT JUMPDEST STOP
+	recursive := common.HexToAddress("0x1047")
+	recursiveCode := "6000358015602357600190036000526000600060206000600030" +
+		"5af1602357600080fd5b00"
+
+	run := func(config *params.ChainConfig, epoch int64, to common.Address) uint64 {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(deepStack, common.FromHex(strings.Repeat("6000", 1100)+"00"))
+		statedb.SetCode(recursive, common.FromHex(recursiveCode))
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, to, 0, big.NewInt(0), 1000000, big.NewInt(1),
+				common.LeftPadBytes([]byte{10}, 32),
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receipt.Status
+	}
+
+	limited := *params.TestChainConfig
+	limited.VMLimitsEpoch = big.NewInt(2)
+	limited.MaxStackSize = 2048
+	limited.MaxCallDepth = 5
+	tests := []struct {
+		name   string
+		config *params.ChainConfig
+		epoch  int64
+		to     common.Address
+		want   uint64
+	}{
+		{"deep stack by default", params.TestChainConfig, 2, deepStack, types.ReceiptStatusFailed},
+		{"deep stack before the limits", &limited, 1, deepStack, types.ReceiptStatusFailed},
+		{"deep stack under a raised limit", &limited, 2, deepStack, types.ReceiptStatusSuccessful},
+		{"deep calls by default", params.TestChainConfig, 2, recursive, types.ReceiptStatusSuccessful},
+		{"deep calls before the limits", &limited, 1, recursive, types.ReceiptStatusSuccessful},
+		{"deep calls under a lowered limit", &limited, 2, recursive, types.ReceiptStatusFailed},
+	}
+	for _, test := range tests {
+		if got := run(test.config, test.epoch, test.to); got != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyTransactionCallStipend(t *testing.T) {
+	// Overwrite storage slot 0, which costs more than the default stipend:
+	// PUSH1 0x02 PUSH1 0x00 SSTORE STOP
+	receiver := common.HexToAddress("0x1050")
+	// Call the receiver with 1 wei and no gas but the stipend, and store
+	// whether the call succeeded:
+	//
+	//   PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x01
+	//   PUSH20 receiver PUSH1 0x00 CALL PUSH1 0x00 SSTORE STOP
+	caller := common.HexToAddress("0x1051")
+	callerCode := "60006000600060006001" + "73" + receiver.Hex()[2:] + "6000f1600055" + "00"
+
+	run := func(config *params.ChainConfig, epoch int64) bool {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(receiver, common.FromHex("600260005500"))
+		statedb.SetState(receiver, common.Hash{}, common.BigToHash(big.NewInt(1)))
+		statedb.SetCode(caller, common.FromHex(callerCode))
+		statedb.SetBalance(caller, big.NewInt(1))
+		statedb.Finalise(true)
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, caller, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("epoch %d: transaction failed", epoch)
+		}
+		succeeded := statedb.GetState(caller, common.Hash{}) != (common.Hash{})
+		written := statedb.GetState(receiver, common.Hash{}) == common.BigToHash(big.NewInt(2))
+		if succeeded != written {
+			t.Fatalf("epoch %d: call succeeded %v but receiver written %v", epoch, succeeded, written)
+		}
+		return succeeded
+	}
+
+	raised := *params.TestChainConfig
+	raised.CallStipendEpoch = big.NewInt(2)
+	raised.CallStipend = 8000
+	tests := []struct {
+		name   string
+		config *params.ChainConfig
+		epoch  int64
+		want   bool
+	}{
+		{"default stipend", params.TestChainConfig, 2, false},
+		{"before the stipend is raised", &raised, 1, false},
+		{"raised stipend", &raised, 2, true},
+	}
+	for _, test := range tests {
+		if got := run(test.config, test.epoch); got != test.want {
+			t.Errorf("%s: got call success %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyTransactionCodeSizeLimit(t *testing.T) {
+	// Deploy 24577 zero bytes, one more than the EIP-170 limit:
+	// PUSH2 0x6001 PUSH1 0x00 RETURN
+	initCode := common.FromHex("6160016000f3")
+
+	run := func(config *params.ChainConfig, epoch int64) bool {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewContractCreation(
+				0, 0, big.NewInt(0), 6000000, big.NewInt(1), initCode,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deployed := statedb.GetCodeSize(receipt.ContractAddress) == 0x6001
+		if deployed != (receipt.Status == types.ReceiptStatusSuccessful) {
+			t.Fatalf("epoch %d: got status %d but code deployed %v", epoch, receipt.Status, deployed)
+		}
+		return deployed
+	}
+
+	raised := *params.TestChainConfig
+	raised.CodeSizeLimitEpoch = big.NewInt(2)
+	raised.MaxCodeSize = 2 * params.MaxCodeSize
+	tests := []struct {
+		name   string
+		config *params.ChainConfig
+		epoch  int64
+		want   bool
+	}{
+		{"default limit", params.TestChainConfig, 2, false},
+		{"before the limit is raised", &raised, 1, false},
+		{"raised limit", &raised, 2, true},
+	}
+	for _, test := range tests {
+		if got := run(test.config, test.epoch); got != test.want {
+			t.Errorf("%s: got deployed %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyTransactionRefundCap(t *testing.T) {
+	// Clear storage slots 0 and 1:
+	// PUSH1 0x00 PUSH1 0x00 SSTORE PUSH1 0x00 PUSH1 0x01 SSTORE STOP
+	clearer := common.HexToAddress("0x1048")
+
+	run := func(config *params.ChainConfig, epoch int64) *types.Receipt {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(clearer, common.FromHex("6000600055"+"6000600155"+"00"))
+		statedb.SetState(clearer, common.Hash{}, common.BigToHash(big.NewInt(1)))
+		statedb.SetState(clearer, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+		statedb.Finalise(true)
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, clearer, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("epoch %d: transaction failed", epoch)
+		}
+		if got := statedb.GetState(clearer, common.Hash{}); got != (common.Hash{}) {
+			t.Fatalf("epoch %d: slot not cleared, got %x", epoch, got)
+		}
+		return receipt
+	}
+
+	config := *params.TestChainConfig
+	config.RefundCapEpoch = big.NewInt(2)
+	tests := []struct {
+		name     string
+		epoch    int64
+		quotient uint64
+		refund   uint64 // for clearing a slot
+	}{
+		{"before the refund cap", 1, params.RefundQuotient, params.SstoreRefundGas},
+		{"after the refund cap", 2, params.RefundQuotientEIP3529, params.SstoreClearRefundEIP3529},
+	}
+	for _, test := range tests {
+		receipt := run(&config, test.epoch)
+		// The clearing refunds exceed both caps, so the cap applies.
+		gas := receipt.GasUsed + receipt.GasRefund
+		if want := gas / test.quotient; receipt.GasRefund != want {
+			t.Errorf(
+				"%s: got refund %d of %d gas, want %d",
+				test.name, receipt.GasRefund, gas, want,
+			)
+		}
+		if receipt.GasRefund >= 2*test.refund {
+			t.Errorf("%s: refund %d is not capped", test.name, receipt.GasRefund)
+		}
+	}
+}
+
+func TestApplyTransactionEIP3529Refunds(t *testing.T) {
+	var (
+		// Clear storage slot 0: PUSH1 0x00 PUSH1 0x00 SSTORE STOP
+		clearer = common.HexToAddress("0x106c")
+		// CALLER SELFDESTRUCT
+		destructor = common.HexToAddress("0x106d")
+	)
+	config := *params.TestChainConfig
+	config.RefundCapEpoch = big.NewInt(2)
+	refund := func(epoch int64, contract common.Address) uint64 {
+		header := newTestHeader(epoch)
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		statedb.SetCode(clearer, common.FromHex("6000600055"+"00"))
+		statedb.SetState(clearer, common.Hash{}, common.BigToHash(big.NewInt(1)))
+		statedb.SetCode(destructor, common.FromHex("33ff"))
+		statedb.Finalise(true)
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		receipt, _, _, err := ApplyTransaction(
+			&config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, contract, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("epoch %d: transaction to %s failed", epoch, contract.Hex())
+		}
+		return receipt.GasRefund
+	}
+
+	if got := refund(1, destructor); got == 0 {
+		t.Error("SELFDESTRUCT refunds nothing before the fork")
+	}
+	if got := refund(2, destructor); got != 0 {
+		t.Errorf("SELFDESTRUCT refunds %d gas from the fork on, want 0", got)
+	}
+	// The refund of clearing a slot is below the cap from the fork on.
+	if got := refund(1, clearer); got <= params.SstoreClearRefundEIP3529 {
+		t.Errorf("clearing a slot refunds %d gas before the fork", got)
+	}
+	if got := refund(2, clearer); got != params.SstoreClearRefundEIP3529 {
+		t.Errorf("clearing a slot refunds %d gas from the fork on, want %d",
+			got, params.SstoreClearRefundEIP3529)
+	}
+}
+
+func TestProcessReadOnly(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	sender := crypto.PubkeyToAddress(keys[0].PublicKey)
+	recipient := common.HexToAddress("0x1015")
+	block := types.NewBlockWithHeader(header).WithBody(
+		types.Transactions{signTestTx(t, header, keys[0], types.NewTransaction(
+			0, recipient, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		))}, nil, nil, nil,
+	)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	receipts, _, _, _, _, accesses, err := p.ProcessReadOnly(
+		block, statedb, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("transfer failed: %v", receipts)
+	}
+	for _, addr := range []common.Address{sender, recipient, testCoinbase} {
+		if _, ok := accesses.WriteAccounts[addr]; !ok {
+			t.Errorf("%s not reported as written", addr.Hex())
+		}
+	}
+	if len(accesses.WriteAccounts) != 3 {
+		t.Errorf("got %d written accounts, want 3", len(accesses.WriteAccounts))
+	}
+	if got := statedb.GetBalance(recipient); got.Cmp(big.NewInt(1000)) != 0 {
+		t.Errorf("recipient balance %v, want 1000", got)
+	}
+
+	// The state is writable again afterwards, unless it was read-only before.
+	if statedb.ReadOnly() || statedb.AccessSet() != nil {
+		t.Error("state not restored after processing")
+	}
+	statedb.SetReadOnly(true)
+	if _, err := statedb.Commit(true); err != state.ErrReadOnly {
+		t.Errorf("committing read-only state: got error %v, want %v", err, state.ErrReadOnly)
+	}
+}
+
+func TestProcessWithTrieStats(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	root, err := statedb.Commit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is held in memory on a freshly opened state.
+	statedb, err = state.New(root, statedb.Database())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := common.HexToAddress("0x106e")
+	block := types.NewBlockWithHeader(header).WithBody(
+		types.Transactions{signTestTx(t, header, keys[0], types.NewTransaction(
+			0, recipient, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		))}, nil, nil, nil,
+	)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	_, _, _, _, _, stats, err := p.ProcessWithTrieStats(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sender is looked up once. The recipient and the coinbase are
+	// looked up until they are created, as they are missing from the trie,
+	// and the recipient is checked for being a validator.
+	want := state.TrieStats{AccountHits: stats.AccountHits, AccountMisses: 5, StorageMisses: 1}
+	if *stats != want {
+		t.Errorf("got %+v, want %+v", *stats, want)
+	}
+	if statedb.TrieStats() != nil {
+		t.Error("reads are still counted after processing")
+	}
+
+	// Everything the next transfer reads is held in memory by now.
+	header = newTestHeader(1).With().Number(big.NewInt(1)).Coinbase(testCoinbase).Header()
+	block = types.NewBlockWithHeader(header).WithBody(
+		types.Transactions{signTestTx(t, header, keys[0], types.NewTransaction(
+			1, recipient, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		))}, nil, nil, nil,
+	)
+	_, _, _, _, _, stats, err = p.ProcessWithTrieStats(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TrieReads() != 0 || stats.AccountHits == 0 || stats.StorageHits == 0 {
+		t.Errorf("got %+v, want only hits", *stats)
+	}
+}
+
+func TestProcessWithAccessSets(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 2)
+	// PUSH1 0x00 SLOAD PUSH1 0x01 SSTORE STOP, copying slot 0 to slot 1.
+	contract := common.HexToAddress("0x105e")
+	statedb.SetCode(contract, common.FromHex("60005460015500"))
+	statedb.SetState(contract, common.Hash{}, common.BigToHash(big.NewInt(7)))
+	recipient := common.HexToAddress("0x105f")
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, contract, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, recipient, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	receipts, _, _, _, _, sets, err := p.ProcessWithAccessSets(
+		block, statedb, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, receipt := range receipts {
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("transaction %d failed", i)
+		}
+	}
+	if got := statedb.GetState(contract, common.BigToHash(big.NewInt(1))); got.Big().Uint64() != 7 {
+		t.Errorf("slot 1 holds %x, want 7", got)
+	}
+	slot0 := StorageSlot{Address: contract, Key: common.Hash{}}
+	slot1 := StorageSlot{Address: contract, Key: common.BigToHash(big.NewInt(1))}
+	// Recipients are checked for being validators.
+	isValidator := func(addr common.Address) StorageSlot {
+		return StorageSlot{Address: addr, Key: staking2.IsValidatorKey}
+	}
+	sender0 := crypto.PubkeyToAddress(keys[0].PublicKey)
+	sender1 := crypto.PubkeyToAddress(keys[1].PublicKey)
+	sorted := func(addrs ...common.Address) []common.Address {
+		sort.Slice(addrs, func(i, j int) bool {
+			return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+		})
+		return addrs
+	}
+	want := []TransactionAccessSet{{
+		Hash:       txs[0].Hash(),
+		Accounts:   sorted(sender0, contract, testCoinbase),
+		ReadSlots:  []StorageSlot{slot0, slot1, isValidator(contract)},
+		WriteSlots: []StorageSlot{slot1},
+	}, {
+		Hash:       txs[1].Hash(),
+		Accounts:   sorted(sender1, recipient, testCoinbase),
+		ReadSlots:  []StorageSlot{isValidator(recipient)},
+		WriteSlots: []StorageSlot{},
+	}}
+	if !reflect.DeepEqual(sets, want) {
+		t.Errorf("got access sets %+v, want %+v", sets, want)
+	}
+	if statedb.AccessSet() != nil {
+		t.Error("access set of the state not restored after processing")
+	}
+}
+
+func TestCheckSlashes(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(2)
+	statedb := makeStateDBForStake(t)
+	header := newTestHeader(5)
+	offender := makeVWrapperByIndex(0).Address
+	record := func(offender common.Address, epoch *big.Int) slash.Record {
+		var r slash.Record
+		r.Evidence.Offender = offender
+		r.Evidence.Epoch = epoch
+		r.Reporter = makeTestAddr("reporter")
+		return r
+	}
+
+	valid := slash.Records{record(offender, big.NewInt(4))}
+	if err := checkSlashes(&config, statedb, header, valid); err != nil {
+		t.Fatalf("valid slash record: %v", err)
+	}
+	for name, records := range map[string]slash.Records{
+		"unknown validator": {record(makeTestAddr("nobody"), big.NewInt(4))},
+		"no epoch":          {record(offender, nil)},
+		"future epoch":      {record(offender, big.NewInt(6))},
+		"pre-staking epoch": {record(offender, big.NewInt(1))},
+		"second record":     {valid[0], record(makeTestAddr("nobody"), big.NewInt(4))},
+	} {
+		if err := checkSlashes(&config, statedb, header, records); errors.Cause(err) != ErrInvalidSlash {
+			t.Errorf("%s: got error %v, want %v", name, err, ErrInvalidSlash)
+		}
+	}
+}
+
+// slashingEngine finalizes blocks by applying their slash records at a fixed
+// rate, recording the outcome, against the given validator snapshots.
+type slashingEngine struct {
+	consensus_engine.Engine
+
+	snapshots map[common.Address]*staking.ValidatorWrapper
+	rate      numeric.Dec
+	applied   *slash.Application
+}
+
+func (e *slashingEngine) ReadValidatorSnapshotAtEpoch(
+	epoch *big.Int, addr common.Address,
+) (*staking.ValidatorSnapshot, error) {
+	if wrapper, ok := e.snapshots[addr]; ok {
+		return &staking.ValidatorSnapshot{Validator: wrapper, Epoch: epoch}, nil
+	}
+	return nil, errors.Errorf("no validator snapshot of %s", addr.Hex())
+}
+
+func (e *slashingEngine) Finalize(
+	chain consensus_engine.ChainReader, header *block.Header,
+	state *state.DB, txs []*types.Transaction,
+	receipts []*types.Receipt, outcxs []*types.CXReceipt,
+	incxs []*types.CXReceiptsProof, stks staking.StakingTransactions,
+	doubleSigners slash.Records,
+) (*types.Block, reward.Reader, error) {
+	applied, err := slash.Apply(e, state, doubleSigners, e.rate)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.applied = applied
+	return nil, network.EmptyPayout, nil
+}
+
+func TestProcessWithSlashes(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(2)
+	statedb := makeStateDBForStake(t)
+	offender := makeVWrapperByIndex(0)
+	var record slash.Record
+	record.Evidence.Offender = offender.Address
+	record.Evidence.Epoch = big.NewInt(4)
+	record.Reporter = makeTestAddr("reporter")
+	enc, err := rlp.EncodeToBytes(slash.Records{record})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block 0 credits the fees to its coinbase, so no chain is needed to
+	// resolve the one of a block in the staking era.
+	header := newTestHeader(5).With().Number(big.NewInt(0)).Header()
+	header.SetSlashes(enc)
+	block := types.NewBlockWithHeader(header)
+	engine := &slashingEngine{
+		snapshots: map[common.Address]*staking.ValidatorWrapper{
+			offender.Address: &offender,
+		},
+		rate: numeric.NewDecWithPrec(5, 1),
+	}
+	p := NewStateProcessor(&config, nil, engine)
+
+	_, _, _, _, _, slashed, err := p.ProcessWithSlashes(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slashed) != 1 {
+		t.Fatalf("got %d slashed validators, want 1", len(slashed))
+	}
+	got := slashed[0]
+	if got.Address != offender.Address {
+		t.Errorf("got slashed validator %s, want %s", got.Address.Hex(), offender.Address.Hex())
+	}
+	if got.Slashed.Sign() <= 0 || got.Slashed.Cmp(engine.applied.TotalSlashed) != 0 {
+		t.Errorf("got slashed %v, want %v", got.Slashed, engine.applied.TotalSlashed)
+	}
+	if got.StatusBefore == effective.Banned || got.StatusAfter != effective.Banned {
+		t.Errorf("got status %v -> %v, want banned", got.StatusBefore, got.StatusAfter)
+	}
+}
+
+func TestApplyTransactionWithStateDiff(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	var (
+		key, _   = crypto.GenerateKey()
+		sender   = crypto.PubkeyToAddress(key.PublicKey)
+		coinbase = common.HexToAddress("0xc0ffee")
+		signer   = types.MakeSigner(&config, big.NewInt(1))
+		header   = blockfactory.NewTestHeader().With().
+				Number(big.NewInt(1)).Epoch(big.NewInt(1)).GasLimit(1e9).Header()
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	statedb.AddBalance(sender, big.NewInt(1e18))
+	// Store 42 in slot 1: PUSH1 0x2a PUSH1 0x01 SSTORE STOP
+	var (
+		store = common.HexToAddress("0x1080")
+		code  = common.FromHex("602a60015500")
+		slot  = common.BigToHash(big.NewInt(1))
+	)
+	statedb.SetCode(store, code)
+	statedb.SetState(store, slot, common.BigToHash(big.NewInt(7)))
+	statedb.Finalise(true)
+
+	tx, _ := types.SignTx(types.NewTransaction(
+		0, store, 0, big.NewInt(1000), 100000, big.NewInt(1), nil,
+	), signer, key)
+	receipt, _, diff, gas, err := ApplyTransactionWithStateDiff(
+		&config, nil, &coinbase, gp, statedb, header, tx, &usedGas, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatal("transaction failed")
+	}
+	fee := new(big.Int).SetUint64(gas)
+	tests := []struct {
+		addr        common.Address
+		pre, post   *big.Int
+		preNonce    uint64
+		postNonce   uint64
+		preStorage  common.Hash
+		postStorage common.Hash
+	}{
+		{
+			sender,
+			big.NewInt(1e18),
+			new(big.Int).Sub(big.NewInt(1e18), new(big.Int).Add(fee, big.NewInt(1000))),
+			0, 1,
+			common.Hash{}, common.Hash{},
+		},
+		{
+			store,
+			big.NewInt(0), big.NewInt(1000),
+			0, 0,
+			common.BigToHash(big.NewInt(7)), common.BigToHash(big.NewInt(42)),
+		},
+		{
+			coinbase,
+			big.NewInt(0), fee,
+			0, 0,
+			common.Hash{}, common.Hash{},
+		},
+	}
+	if len(diff) != len(tests) {
+		t.Errorf("got %d accounts in the diff, want %d", len(diff), len(tests))
+	}
+	for i, test := range tests {
+		d := diff[test.addr]
+		if d == nil {
+			t.Errorf("index: %v, %x missing from the diff", i, test.addr)
+			continue
+		}
+		if d.Pre.Balance.Cmp(test.pre) != 0 || d.Post.Balance.Cmp(test.post) != 0 {
+			t.Errorf("index: %v, expected balance %v -> %v, got %v -> %v",
+				i, test.pre, test.post, d.Pre.Balance, d.Post.Balance)
+		}
+		if d.Pre.Nonce != test.preNonce || d.Post.Nonce != test.postNonce {
+			t.Errorf("index: %v, expected nonce %d -> %d, got %d -> %d",
+				i, test.preNonce, test.postNonce, d.Pre.Nonce, d.Post.Nonce)
+		}
+		if d.Pre.Storage[slot] != test.preStorage || d.Post.Storage[slot] != test.postStorage {
+			t.Errorf("index: %v, expected slot %x -> %x, got %x -> %x",
+				i, test.preStorage, test.postStorage, d.Pre.Storage[slot], d.Post.Storage[slot])
+		}
+	}
+	if to := diff[store]; to != nil && (!bytes.Equal(to.Pre.Code, code) || !bytes.Equal(to.Post.Code, code)) {
+		t.Errorf("callee: got code %x -> %x", to.Pre.Code, to.Post.Code)
+	}
+
+	// The diff covers contract creations, which set code.
+	tx, _ = types.SignTx(types.NewContractCreation(
+		1, 0, big.NewInt(0), 100000, big.NewInt(1), common.FromHex("60016000f3"),
+	), signer, key)
+	_, _, diff, _, err = ApplyTransactionWithStateDiff(
+		&config, nil, &coinbase, gp, statedb, header, tx, &usedGas, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := diff[crypto.CreateAddress(sender, 1)]
+	if created == nil || created.Pre.Code != nil || !bytes.Equal(created.Post.Code, []byte{0x00}) {
+		t.Errorf("created contract missing from the diff or with wrong code")
+	}
+}
+
+func TestApplyTransactionWithFeePayer(t *testing.T) {
+	header := newTestHeader(1)
+	payer := common.HexToAddress("0x1016")
+	recipient := common.HexToAddress("0x1017")
+	value := big.NewInt(1000)
+
+	apply := func(config *params.ChainConfig) (sent, paid *big.Int) {
+		statedb := newTestState()
+		keys := newTestKeys(t, statedb, 1)
+		sender := crypto.PubkeyToAddress(keys[0].PublicKey)
+		statedb.SetBalance(payer, big.NewInt(1000000))
+		senderBefore := statedb.GetBalance(sender)
+		payerBefore := statedb.GetBalance(payer)
+
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, _, err := ApplyTransactionWithFeePayer(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				0, recipient, 0, value, 50000, big.NewInt(2), nil,
+			)),
+			&usedGas, vm.Config{},
+			func(msg Message) (common.Address, bool) {
+				return payer, msg.From() == sender
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usedGas != 21000 {
+			t.Fatalf("used %d gas, want 21000", usedGas)
+		}
+		if nonce := statedb.GetNonce(sender); nonce != 1 {
+			t.Errorf("sender nonce %d, want 1", nonce)
+		}
+		if got := statedb.GetBalance(recipient); got.Cmp(value) != 0 {
+			t.Errorf("recipient balance %v, want %v", got, value)
+		}
+		return new(big.Int).Sub(senderBefore, statedb.GetBalance(sender)),
+			new(big.Int).Sub(payerBefore, statedb.GetBalance(payer))
+	}
+
+	fee := big.NewInt(21000 * 2)
+	sent, paid := apply(params.TestChainConfig)
+	if sent.Cmp(value) != 0 {
+		t.Errorf("sender spent %v, want only the value %v", sent, value)
+	}
+	if paid.Cmp(fee) != 0 {
+		t.Errorf("payer spent %v, want the fee %v", paid, fee)
+	}
+
+	// Before the fee delegation epoch the hook is not consulted.
+	config := *params.TestChainConfig
+	config.FeeDelegationEpoch = big.NewInt(2)
+	sent, paid = apply(&config)
+	if want := new(big.Int).Add(value, fee); sent.Cmp(want) != 0 {
+		t.Errorf("sender spent %v before fee delegation, want %v", sent, want)
+	}
+	if paid.Sign() != 0 {
+		t.Errorf("payer spent %v before fee delegation", paid)
+	}
+}
+
+// panickingTracer panics when the interpreter is about to execute op.
+type panickingTracer struct {
+	op vm.OpCode
+}
+
+func (t *panickingTracer) CaptureStart(common.Address, common.Address, bool, []byte, uint64, *big.Int) error {
+	return nil
+}
+
+func (t *panickingTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if op == t.op {
+		panic("deliberate interpreter panic")
+	}
+	return nil
+}
+
+func (t *panickingTracer) CaptureFault(*vm.EVM, uint64, vm.OpCode, uint64, uint64, *vm.Memory, *vm.Stack, *vm.Contract, int, error) error {
+	return nil
+}
+
+func (t *panickingTracer) CaptureEnd([]byte, uint64, time.Duration, error) error {
+	return nil
+}
+
+func TestApplyTransactionsPanic(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	sender := crypto.PubkeyToAddress(keys[0].PublicKey)
+	// PUSH1 0x01 PUSH1 0x00 SSTORE STOP, panicking on the STOP after the
+	// slot has been written.
+	store := common.HexToAddress("0x101b")
+	statedb.SetCode(store, common.FromHex("600160005500"))
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x101c"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			1, store, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+	}
+
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+		cfg     = vm.Config{Debug: true, Tracer: &panickingTracer{vm.STOP}}
+	)
+	_, _, _, err := applyTransactions(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+		common.Hash{}, txs, &usedGas, cfg,
+	)
+	if errors.Cause(err) != ErrTransactionPanicked {
+		t.Fatalf("got error %v, want %v", err, ErrTransactionPanicked)
+	}
+	if !strings.Contains(err.Error(), "transaction 1") {
+		t.Errorf("error %q does not name the panicking transaction", err)
+	}
+
+	// Only the first transaction is left in the state.
+	if usedGas != 21000 || gp.Gas() != header.GasLimit()-21000 {
+		t.Errorf("used %d gas with %d left, want only the first transaction's", usedGas, gp.Gas())
+	}
+	if nonce := statedb.GetNonce(sender); nonce != 1 {
+		t.Errorf("sender nonce %d, want 1", nonce)
+	}
+	if slot := statedb.GetState(store, common.Hash{}); slot != (common.Hash{}) {
+		t.Errorf("slot written by the panicking transaction: %x", slot)
+	}
+}
+
+func TestApplyTransactionsParallelPanic(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 2)
+	// PUSH1 0x01 PUSH1 0x00 SSTORE STOP, panicking on the STOP.
+	store := common.HexToAddress("0x1083")
+	statedb.SetCode(store, common.FromHex("600160005500"))
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x1084"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, store, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+	}
+	cfg := vm.Config{Debug: true, Tracer: &panickingTracer{vm.STOP}}
+
+	// A panicking worker yields an error instead of crashing the node.
+	results := speculate(
+		params.TestChainConfig, nil, &testCoinbase, statedb, header,
+		common.Hash{}, 0, txs, cfg,
+	)
+	if results[0].err != nil {
+		t.Errorf("transfer: got error %v", results[0].err)
+	}
+	if errors.Cause(results[1].err) != ErrTransactionPanicked {
+		t.Errorf("got error %v, want %v", results[1].err, ErrTransactionPanicked)
+	}
+
+	// The transaction is then applied serially, where it panics again.
+	var (
+		gp      = new(GasPool).AddGas(header.GasLimit())
+		usedGas uint64
+	)
+	_, _, _, err := applyTransactionsParallel(
+		params.TestChainConfig, nil, &testCoinbase, gp, statedb, header,
+		common.Hash{}, txs, &usedGas, cfg,
+	)
+	if errors.Cause(err) != ErrTransactionPanicked {
+		t.Fatalf("got error %v, want %v", err, ErrTransactionPanicked)
+	}
+	if !strings.Contains(err.Error(), "transaction 1") {
+		t.Errorf("error %q does not name the panicking transaction", err)
+	}
+}
+
+func TestProcessWithBeneficiary(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	block := types.NewBlockWithHeader(header).WithBody(
+		types.Transactions{signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x101d"), 0, big.NewInt(1000), 21000, big.NewInt(2), nil,
+		))}, nil, nil, nil,
+	)
+	fee := big.NewInt(21000 * 2)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	canonical := statedb.Copy()
+	if _, _, _, _, _, err := p.Process(block, canonical, vm.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := canonical.GetBalance(testCoinbase); got.Cmp(fee) != 0 {
+		t.Fatalf("coinbase balance %v, want %v", got, fee)
+	}
+
+	beneficiary := common.HexToAddress("0x101e")
+	simulated := statedb.Copy()
+	if _, _, _, _, _, err := p.ProcessWithBeneficiary(
+		block, simulated, vm.Config{}, beneficiary,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if got := simulated.GetBalance(beneficiary); got.Cmp(fee) != 0 {
+		t.Errorf("beneficiary balance %v, want %v", got, fee)
+	}
+	if got := simulated.GetBalance(testCoinbase); got.Sign() != 0 {
+		t.Errorf("coinbase balance %v, want 0", got)
+	}
+
+	// The beneficiary is not derived from the coinbase in the staking era
+	// either, which would need the committee of the chain.
+	staking := NewStateProcessor(params.TestChainConfig, nil, &offlineEngine{})
+	if _, _, _, _, _, err := staking.ProcessWithBeneficiary(
+		block, statedb.Copy(), vm.Config{}, beneficiary,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessLogIndex(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	// PUSH1 0x00 PUSH1 0x00 LOG0 PUSH1 0x00 PUSH1 0x00 LOG0 STOP
+	logger := common.HexToAddress("0x101f")
+	statedb.SetCode(logger, common.FromHex("60006000a060006000a000"))
+	var txs types.Transactions
+	for _, key := range keys {
+		txs = append(txs, signTestTx(t, header, key, types.NewTransaction(
+			0, logger, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)))
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	receipts, _, logs, _, _, err := p.Process(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 6 {
+		t.Fatalf("got %d logs, want 6", len(logs))
+	}
+	for i, log := range logs {
+		if log.Index != uint(i) {
+			t.Errorf("log %d: index %d", i, log.Index)
+		}
+		if log.TxIndex != uint(i/2) || log.TxHash != txs[i/2].Hash() {
+			t.Errorf("log %d: transaction %d (%s), want %d", i, log.TxIndex, log.TxHash.Hex(), i/2)
+		}
+		if log.BlockNumber != 1 || log.BlockHash != block.Hash() {
+			t.Errorf("log %d: block %d (%s)", i, log.BlockNumber, log.BlockHash.Hex())
+		}
+	}
+	for i, receipt := range receipts {
+		if len(receipt.Logs) != 2 || receipt.Logs[0] != logs[2*i] {
+			t.Errorf("receipt %d: logs differ from the block logs", i)
+		}
+	}
+}
+
+func TestApplyIncomingReceiptWithProof(t *testing.T) {
+	header := newTestHeader(1)
+	to := common.HexToAddress("0xbeef")
+	newProof := func() *types.CXReceiptsProof {
+		cxs := types.CXReceipts{{
+			TxHash:    common.HexToHash("0x02"),
+			To:        &to,
+			ShardID:   1,
+			ToShardID: 0,
+			Amount:    big.NewInt(5),
+		}}
+		source := newTestHeader(1).With().
+			ShardID(1).
+			OutgoingReceiptHash(cxs.ComputeMerkleRoot()).
+			Header()
+		return &types.CXReceiptsProof{
+			Receipts: cxs,
+			MerkleProof: &types.CXMerkleProof{
+				BlockNum:      source.Number(),
+				BlockHash:     source.Hash(),
+				ShardID:       1,
+				CXReceiptHash: source.OutgoingReceiptHash(),
+				ShardIDs:      []uint32{0},
+				CXShardHashes: []common.Hash{types.DeriveSha(cxs)},
+			},
+			Header: source,
+		}
+	}
+
+	statedb := newTestState()
+	if err := ApplyIncomingReceiptWithProof(
+		params.TestChainConfig, statedb, header, newProof(),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if got := statedb.GetBalance(to); got.Cmp(big.NewInt(5)) != 0 {
+		t.Errorf("got balance %v, want 5", got)
+	}
+
+	tampered := map[string]func(cxp *types.CXReceiptsProof){
+		"amount": func(cxp *types.CXReceiptsProof) {
+			cxp.Receipts[0].Amount = big.NewInt(5000)
+		},
+		"shard hash": func(cxp *types.CXReceiptsProof) {
+			cxp.MerkleProof.CXShardHashes[0] = types.DeriveSha(types.CXReceipts{})
+		},
+		"header": func(cxp *types.CXReceiptsProof) {
+			cxp.Header = cxp.Header.With().OutgoingReceiptHash(common.Hash{}).Header()
+		},
+		"destination": func(cxp *types.CXReceiptsProof) {
+			cxp.Receipts[0].ToShardID = 2
+		},
+	}
+	for name, tamper := range tampered {
+		statedb := newTestState()
+		proof := newProof()
+		tamper(proof)
+		err := ApplyIncomingReceiptWithProof(params.TestChainConfig, statedb, header, proof)
+		if errors.Cause(err) != ErrInvalidCXProof {
+			t.Errorf("%s: got error %v, want %v", name, err, ErrInvalidCXProof)
+		}
+		if got := statedb.GetBalance(to); got.Sign() != 0 {
+			t.Errorf("%s: got balance %v, want 0", name, got)
+		}
+	}
+
+	// The receipts must be destined to the shard applying them.
+	err := ApplyIncomingReceiptWithProof(
+		params.TestChainConfig, newTestState(),
+		newTestHeader(1).With().ShardID(2).Header(), newProof(),
+	)
+	if errors.Cause(err) != ErrInvalidCXProof {
+		t.Errorf("applying to another shard: got error %v, want %v", err, ErrInvalidCXProof)
+	}
+}
+
+func TestBuildCXReceiptsProofs(t *testing.T) {
+	to := common.HexToAddress("0x1061")
+	newCX := func(hash string, toShardID uint32, amount int64) *types.CXReceipt {
+		return &types.CXReceipt{
+			TxHash:    common.HexToHash(hash),
+			To:        &to,
+			ShardID:   0,
+			ToShardID: toShardID,
+			Amount:    big.NewInt(amount),
+		}
+	}
+	outcxs := types.CXReceipts{
+		newCX("0x01", 2, 1), newCX("0x02", 1, 10), newCX("0x03", 2, 100),
+	}
+	source := newTestHeader(1).With().
+		OutgoingReceiptHash(outcxs.ComputeMerkleRoot()).
+		Header()
+
+	proofs, err := BuildCXReceiptsProofs(source, outcxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]int64{1: 10, 2: 101}
+	if len(proofs) != len(want) {
+		t.Fatalf("got %d proofs, want %d", len(proofs), len(want))
+	}
+	for i, proof := range proofs {
+		toShardID, err := proof.GetToShardID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if toShardID != uint32(i+1) {
+			t.Errorf("proof %d: got destination shard %d, want %d", i, toShardID, i+1)
+		}
+		statedb := newTestState()
+		if err := ApplyIncomingReceiptWithProof(
+			params.TestChainConfig, statedb,
+			newTestHeader(1).With().ShardID(toShardID).Header(), proof,
+		); err != nil {
+			t.Errorf("proof %d: %v", i, err)
+			continue
+		}
+		if got := statedb.GetBalance(to); got.Cmp(big.NewInt(want[toShardID])) != 0 {
+			t.Errorf("shard %d: got balance %v, want %d", toShardID, got, want[toShardID])
+		}
+	}
+
+	// The header must commit to the receipts.
+	_, err = BuildCXReceiptsProofs(source, outcxs[:2])
+	if errors.Cause(err) != ErrInvalidCXProof {
+		t.Errorf("got error %v, want %v", err, ErrInvalidCXProof)
+	}
+}
+
+func TestProcessWithIntermediateRoots(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	config.S3Epoch = big.NewInt(2)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	var txs types.Transactions
+	for i, key := range keys {
+		txs = append(txs, signTestTx(t, header, key, types.NewTransaction(
+			0, common.BigToAddress(big.NewInt(int64(0x1023+i))), 0,
+			big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)))
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	receipts, _, _, _, _, roots, err := p.ProcessWithIntermediateRoots(
+		block, statedb, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != len(txs) {
+		t.Fatalf("got %d roots, want %d", len(roots), len(txs))
+	}
+	seen := map[common.Hash]bool{}
+	for i, root := range roots {
+		if !bytes.Equal(root[:], receipts[i].PostState) {
+			t.Errorf("root %d: %s, receipt carries %x", i, root.Hex(), receipts[i].PostState)
+		}
+		if seen[root] {
+			t.Errorf("root %d: %s repeated", i, root.Hex())
+		}
+		seen[root] = true
+	}
+	if last := statedb.IntermediateRoot(false); roots[len(roots)-1] != last {
+		t.Errorf("last root %s, state root %s", roots[len(roots)-1].Hex(), last.Hex())
+	}
+
+	// Receipts from S3 on carry no roots.
+	s3 := newTestHeader(2).With().Coinbase(testCoinbase).Header()
+	statedb = newTestState()
+	keys = newTestKeys(t, statedb, 1)
+	block = types.NewBlockWithHeader(s3).WithBody(types.Transactions{
+		signTestTx(t, s3, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x1023"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+	}, nil, nil, nil)
+	if _, _, _, _, _, roots, err := p.ProcessWithIntermediateRoots(
+		block, statedb, vm.Config{},
+	); err != nil || roots != nil {
+		t.Errorf("got roots %v (error %v) after S3, want none", roots, err)
+	}
+}
+
+func TestApplyTransactionForFuzz(t *testing.T) {
+	header := newTestHeader(1).With().Number(big.NewInt(5)).Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	// PUSH1 0x01 BLOCKHASH PUSH1 0x00 SSTORE PUSH1 0xaa PUSH1 0x00 PUSH1 0x00
+	// LOG1 STOP, looking up the hash of a block not known to any chain.
+	contract := common.HexToAddress("0x1026")
+	statedb.SetCode(contract, common.FromHex("60014060005560aa60006000a100"))
+	root := statedb.IntermediateRoot(true)
+	tx := signTestTx(t, header, keys[0], types.NewTransaction(
+		0, contract, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+	))
+
+	result, err := ApplyTransactionForFuzz(params.TestChainConfig, statedb, header, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != types.ReceiptStatusSuccessful || result.VMErr != nil {
+		t.Fatalf("transaction failed: %v", result.VMErr)
+	}
+	if len(result.Logs) != 1 || result.Logs[0].Topics[0] != common.BigToHash(big.NewInt(0xaa)) ||
+		result.Logs[0].TxHash != (common.Hash{}) {
+		t.Errorf("unexpected logs %v", result.Logs)
+	}
+	var written []common.Address
+	for _, diff := range result.StateDiff {
+		written = append(written, diff.Address)
+	}
+	sender := crypto.PubkeyToAddress(keys[0].PublicKey)
+	// The fees are burned in the staking era, so the coinbase is untouched.
+	if len(written) != 2 {
+		t.Errorf("written accounts %v, want the sender and the contract", written)
+	}
+	for _, addr := range []common.Address{sender, contract} {
+		if !containsAddress(written, addr) {
+			t.Errorf("%s not written", addr.Hex())
+		}
+	}
+
+	// Applying the transaction again yields the same outcome, since the
+	// state it was applied to is left unmodified.
+	if statedb.IntermediateRoot(true) != root {
+		t.Fatal("state modified")
+	}
+	again, err := ApplyTransactionForFuzz(params.TestChainConfig, statedb, header, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, again) {
+		t.Errorf("got different outcomes %+v and %+v", result, again)
+	}
+
+	tooHigh := signTestTx(t, header, keys[0], types.NewTransaction(
+		1, contract, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+	))
+	if _, err := ApplyTransactionForFuzz(
+		params.TestChainConfig, statedb, header, tooHigh,
+	); errors.Cause(err) != ErrNonceTooHigh {
+		t.Errorf("got error %v, want %v", err, ErrNonceTooHigh)
+	}
+}
+
+func containsAddress(addrs []common.Address, addr common.Address) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// invertingPrecompile is a precompiled contract inverting the bits of its
+// input.
+type invertingPrecompile struct{}
+
+func (invertingPrecompile) RequiredGas(input []byte) uint64 {
+	return 100
+}
+
+func (invertingPrecompile) Run(input []byte) ([]byte, error) {
+	output := make([]byte, len(input))
+	for i, b := range input {
+		output[i] = ^b
+	}
+	return output, nil
+}
+
+func TestExtraPrecompiles(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	precompile := common.HexToAddress("0x0100")
+	// Return the output of STATICCALL to the precompile with the call data:
+	//
+	//   CALLDATASIZE PUSH1 0x00 PUSH1 0x00 CALLDATACOPY
+	//   CALLDATASIZE PUSH1 0x00 CALLDATASIZE PUSH1 0x00 PUSH2 0x0100 GAS
+	//   STATICCALL CALLDATASIZE PUSH1 0x00 RETURN
+	forwarder := common.HexToAddress("0x1027")
+	statedb.SetCode(forwarder, common.FromHex("3660006000373660003660006101005afa366000f3"))
+	input := []byte{0x00, 0x0f, 0xf0}
+
+	call := func(config *params.ChainConfig, nonce uint64) []byte {
+		var (
+			gp      = new(GasPool).AddGas(header.GasLimit())
+			usedGas uint64
+		)
+		_, _, result, _, err := ApplyTransactionWithResult(
+			config, nil, &testCoinbase, gp, statedb, header,
+			signTestTx(t, header, keys[0], types.NewTransaction(
+				nonce, forwarder, 0, big.NewInt(0), 100000, big.NewInt(1), input,
+			)),
+			&usedGas, vm.Config{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Failed() {
+			t.Fatalf("call failed: %v", result.VMErr)
+		}
+		return result.ReturnData
+	}
+
+	config := *params.TestChainConfig
+	config.ExtraPrecompiles = map[common.Address]params.PrecompiledContract{
+		precompile: invertingPrecompile{},
+	}
+	if got, want := call(&config, 0), []byte{0xff, 0xf0, 0x0f}; !bytes.Equal(got, want) {
+		t.Errorf("got %x from the precompile, want %x", got, want)
+	}
+	// Without the precompile the call reaches an empty account.
+	if got := call(params.TestChainConfig, 1); !bytes.Equal(got, input) {
+		t.Errorf("got %x without the precompile, want %x", got, input)
+	}
+}
+
+func TestProcessWithBloom(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	// PUSH1 0x00 PUSH1 0x00 LOG0 STOP and CALLER PUSH1 0x00 PUSH1 0x00 LOG1 STOP
+	loggers := []common.Address{common.HexToAddress("0x1028"), common.HexToAddress("0x1029")}
+	statedb.SetCode(loggers[0], common.FromHex("60006000a000"))
+	statedb.SetCode(loggers[1], common.FromHex("3360006000a100"))
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, loggers[0], 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, common.HexToAddress("0x102a"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[2], types.NewTransaction(
+			0, loggers[1], 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	receipts, _, logs, _, _, bloom, err := p.ProcessWithBloom(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("got %d logs, want 2", len(logs))
+	}
+	if want := types.CreateBloom(receipts); bloom != want {
+		t.Errorf("got bloom %x, want %x", bloom, want)
+	}
+	for _, logger := range loggers {
+		if !ethtypes.BloomLookup(bloom, logger) {
+			t.Errorf("bloom misses %s", logger.Hex())
+		}
+	}
+
+	// Staking receipts carry no bloom of their own.
+	staking := &types.Receipt{Logs: []*types.Log{{Address: loggers[0]}}}
+	if got, want := receiptBloom(staking), types.CreateBloom(types.Receipts{staking}); got != want {
+		t.Errorf("got staking receipt bloom %x, want %x", got, want)
+	}
+}
+
+func TestProcessLogCallback(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	// PUSH1 0x00 PUSH1 0x00 LOG0 PUSH1 0x00 PUSH1 0x00 LOG0 STOP and
+	// CALLER PUSH1 0x00 PUSH1 0x00 LOG1 STOP
+	loggers := []common.Address{common.HexToAddress("0x1073"), common.HexToAddress("0x1074")}
+	statedb.SetCode(loggers[0], common.FromHex("60006000a060006000a000"))
+	statedb.SetCode(loggers[1], common.FromHex("3360006000a100"))
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, loggers[0], 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, common.HexToAddress("0x1075"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[2], types.NewTransaction(
+			0, loggers[1], 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	_, _, want, _, _, err := p.Process(block, statedb.Copy(), vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamed []*types.Log
+	p.SetLogCallback(func(log *types.Log) {
+		streamed = append(streamed, log)
+	})
+	_, _, allLogs, _, _, err := p.Process(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 3 {
+		t.Fatalf("got %d logs, want 3", len(want))
+	}
+	if !reflect.DeepEqual(allLogs, want) {
+		t.Errorf("got logs %v with the callback, want %v", allLogs, want)
+	}
+	if len(streamed) != len(want) {
+		t.Fatalf("streamed %d logs, want %d", len(streamed), len(want))
+	}
+	for i, log := range streamed {
+		if !reflect.DeepEqual(log, want[i]) {
+			t.Errorf("streamed log %d is %+v, want %+v", i, log, want[i])
+		}
+		if log == allLogs[i] {
+			t.Errorf("streamed log %d is the one returned", i)
+		}
+	}
+}
+
+// bloomTestReceipts returns n receipts with a few logs each.
+func bloomTestReceipts(n int) types.Receipts {
+	receipts := make(types.Receipts, n)
+	for i := range receipts {
+		receipt := &types.Receipt{}
+		for j := 0; j < 4; j++ {
+			receipt.Logs = append(receipt.Logs, &types.Log{
+				Address: common.BigToAddress(big.NewInt(int64(i))),
+				Topics:  []common.Hash{common.BigToHash(big.NewInt(int64(j)))},
+			})
+		}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+		receipts[i] = receipt
+	}
+	return receipts
+}
+
+func BenchmarkBlockBloomIncremental(b *testing.B) {
+	receipts := bloomTestReceipts(500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var bloom ethtypes.Bloom
+		for _, receipt := range receipts {
+			addBloom(&bloom, receiptBloom(receipt))
+		}
+	}
+}
+
+func BenchmarkBlockBloomRecompute(b *testing.B) {
+	receipts := bloomTestReceipts(500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		types.CreateBloom(receipts)
+	}
+}
+
+func TestProcessCXReceiptsPerShard(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	config.MaxCXReceiptsPerShard = 1
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	to := common.HexToAddress("0xbeef")
+	newBlock := func(statedb *state.DB, toShards ...uint32) *types.Block {
+		keys := newTestKeys(t, statedb, len(toShards))
+		var txs types.Transactions
+		for i, key := range keys {
+			txs = append(txs, signTestTx(t, header, key, types.NewCrossShardTransaction(
+				0, &to, 0, toShards[i], big.NewInt(1), 21000, big.NewInt(1), nil,
+			)))
+		}
+		return types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+	}
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	statedb := newTestState()
+	if _, _, _, _, _, err := p.Process(newBlock(statedb, 1, 2), statedb, vm.Config{}); err != nil {
+		t.Fatalf("one receipt per shard: %v", err)
+	}
+	statedb = newTestState()
+	_, _, _, _, _, err := p.Process(newBlock(statedb, 1, 2, 1), statedb, vm.Config{})
+	if errors.Cause(err) != ErrTooManyCXReceipts {
+		t.Errorf("two receipts for shard 1: got %v, want %v", err, ErrTooManyCXReceipts)
+	}
+}
+
+// slowDatabase is an in-memory database counting its reads and delaying each
+// of them by latency, like a disk would.
+type slowDatabase struct {
+	*ethdb.MemDatabase
+	latency time.Duration
+	reads   int64
+}
+
+func (db *slowDatabase) Get(key []byte) ([]byte, error) {
+	atomic.AddInt64(&db.reads, 1)
+	time.Sleep(db.latency)
+	return db.MemDatabase.Get(key)
+}
+
+// prefetchTestBlock commits n funded accounts to disk and returns the state
+// root and a block of transfers of each account to a distinct new one.
+func prefetchTestBlock(
+	tb testing.TB, disk ethdb.Database, n int,
+) (common.Hash, *types.Block) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(disk))
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	keys := newTestKeys(tb, statedb, n)
+	root, err := statedb.Commit(false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := statedb.Database().TrieDB().Commit(root, false); err != nil {
+		tb.Fatal(err)
+	}
+	txs := make(types.Transactions, n)
+	for i, key := range keys {
+		to := common.BigToAddress(big.NewInt(int64(0x10000 + i)))
+		txs[i] = signTestTx(tb, header, key, types.NewTransaction(
+			0, to, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		))
+	}
+	return root, types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+}
+
+func TestPrefetchTransactions(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	disk := &slowDatabase{MemDatabase: ethdb.NewMemDatabase()}
+	root, block := prefetchTestBlock(t, disk, 50)
+
+	// Once prefetched, the senders are read without touching the disk.
+	statedb, _ := state.New(root, state.NewDatabaseWithCache(disk, 16))
+	prefetcher := statedb.NewPrefetcher()
+	signer := types.MakeSigner(&config, block.Epoch())
+	var senders []common.Address
+	for _, tx := range block.Transactions() {
+		from, _ := types.Sender(signer, tx)
+		prefetcher.Prefetch(from)
+		senders = append(senders, from)
+	}
+	reads := atomic.LoadInt64(&disk.reads)
+	for _, from := range senders {
+		if statedb.GetBalance(from).Sign() == 0 {
+			t.Fatalf("sender %s is not funded", from.Hex())
+		}
+	}
+	if got := atomic.LoadInt64(&disk.reads) - reads; got != 0 {
+		t.Errorf("got %d disk reads for prefetched accounts, want 0", got)
+	}
+
+	// Prefetching does not change the outcome of processing.
+	var roots []common.Hash
+	for _, prefetch := range []bool{false, true} {
+		statedb, _ := state.New(root, state.NewDatabaseWithCache(disk, 16))
+		bc := newTestChain(t, &config)
+		defer bc.Stop()
+		p := NewStateProcessor(&config, bc, &offlineEngine{})
+		p.SetPrefetch(prefetch)
+		if _, _, _, _, _, err := p.Process(block, statedb, vm.Config{}); err != nil {
+			t.Fatalf("prefetch %v: %v", prefetch, err)
+		}
+		roots = append(roots, statedb.IntermediateRoot(true))
+	}
+	if roots[0] != roots[1] {
+		t.Errorf("got state root %x with prefetching, want %x", roots[1], roots[0])
+	}
+}
+
+func benchmarkProcessPrefetch(b *testing.B, prefetch bool) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	disk := &slowDatabase{MemDatabase: ethdb.NewMemDatabase()}
+	root, block := prefetchTestBlock(b, disk, 200)
+	disk.latency = 50 * time.Microsecond
+	p := NewStateProcessor(&config, nil, &offlineEngine{})
+	p.SetPrefetch(prefetch)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Start from a cold cache every time.
+		b.StopTimer()
+		statedb, _ := state.New(root, state.NewDatabaseWithCache(disk, 16))
+		b.StartTimer()
+		if _, _, _, _, _, err := p.Process(block, statedb, vm.Config{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessWithoutPrefetch(b *testing.B) {
+	benchmarkProcessPrefetch(b, false)
+}
+
+func BenchmarkProcessWithPrefetch(b *testing.B) {
+	benchmarkProcessPrefetch(b, true)
+}
+
+func TestProcessWithSelfDestructs(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	// CALLER SELFDESTRUCT, and a contract calling it, then reverting
+	var (
+		destructor = common.HexToAddress("0x1043")
+		reverter   = common.HexToAddress("0x1044")
+	)
+	statedb.SetCode(destructor, common.FromHex("33ff"))
+	statedb.SetCode(reverter, common.FromHex("60006000600060006000611043"+"5af160006000fd"))
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, common.HexToAddress("0x1045"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, reverter, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[2], types.NewTransaction(
+			0, destructor, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	_, _, _, _, _, destructs, err := p.ProcessWithSelfDestructs(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The self-destruct in the reverted call does not count.
+	want := [][]common.Address{nil, nil, {destructor}}
+	if !reflect.DeepEqual(destructs, want) {
+		t.Errorf("got self-destructs %v, want %v", destructs, want)
+	}
+	if statedb.Exist(destructor) {
+		t.Error("self-destructed contract still exists")
+	}
+	if !statedb.Exist(reverter) {
+		t.Error("reverting contract is gone")
+	}
+}
+
+// signedTransferBlock returns a block of transfers, one from each of n new
+// funded accounts, and their senders.
+func signedTransferBlock(
+	tb testing.TB, statedb *state.DB, n int,
+) (*types.Block, []common.Address) {
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	keys := newTestKeys(tb, statedb, n)
+	txs := make(types.Transactions, n)
+	senders := make([]common.Address, n)
+	for i, key := range keys {
+		txs[i] = signTestTx(tb, header, key, types.NewTransaction(
+			0, common.HexToAddress("0x104b"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		))
+		senders[i] = crypto.PubkeyToAddress(key.PublicKey)
+	}
+	return types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil), senders
+}
+
+// withFreshTransactions returns block with decoded copies of its
+// transactions, which have no sender cached.
+func withFreshTransactions(tb testing.TB, block *types.Block) *types.Block {
+	txs := make(types.Transactions, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		enc, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		txs[i] = new(types.Transaction)
+		if err := rlp.DecodeBytes(enc, txs[i]); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return types.NewBlockWithHeader(block.Header()).WithBody(txs, nil, nil, nil)
+}
+
+func TestProcessWithSenders(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	statedb := newTestState()
+	block, senders := signedTransferBlock(t, statedb, 5)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	verified := statedb.Copy()
+	want, _, _, _, _, err := p.Process(withFreshTransactions(t, block), verified, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := statedb.Copy()
+	got, _, _, _, _, err := p.ProcessWithSenders(
+		withFreshTransactions(t, block), trusted, vm.Config{}, senders,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := types.DeriveSha(got), types.DeriveSha(want); a != b {
+		t.Errorf("got receipts hash %x, want %x", a, b)
+	}
+	if a, b := trusted.IntermediateRoot(true), verified.IntermediateRoot(true); a != b {
+		t.Errorf("got state root %x, want %x", a, b)
+	}
+
+	if _, _, _, _, _, err := p.ProcessWithSenders(
+		block, statedb.Copy(), vm.Config{}, senders[1:],
+	); err == nil {
+		t.Error("missing sender was accepted")
+	}
+}
+
+func benchmarkProcessSenders(b *testing.B, trusted bool) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	statedb := newTestState()
+	block, senders := signedTransferBlock(b, statedb, 200)
+	p := NewStateProcessor(&config, nil, &offlineEngine{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Start without any sender cached every time.
+		b.StopTimer()
+		fresh := withFreshTransactions(b, block)
+		db := statedb.Copy()
+		b.StartTimer()
+		var err error
+		if trusted {
+			_, _, _, _, _, err = p.ProcessWithSenders(fresh, db, vm.Config{}, senders)
+		} else {
+			_, _, _, _, _, err = p.Process(fresh, db, vm.Config{})
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessRecoveringSenders(b *testing.B) {
+	benchmarkProcessSenders(b, false)
+}
+
+func BenchmarkProcessWithSenders(b *testing.B) {
+	benchmarkProcessSenders(b, true)
+}
+
+func TestStakingDirectives(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		createValidator = defaultMsgCreateValidator()
+		editValidator   = defaultMsgEditValidator()
+		delegate        = defaultMsgDelegate()
+		msgs            = []struct {
+			directive staking.Directive
+			msg       interface{}
+		}{
+			{staking.DirectiveCreateValidator, createValidator},
+			{staking.DirectiveEditValidator, editValidator},
+			{staking.DirectiveDelegate, delegate},
+		}
+		txs      staking.StakingTransactions
+		receipts types.Receipts
+	)
+	for i, msg := range msgs {
+		msg := msg
+		tx, err := staking.NewStakingTransaction(uint64(i), 1e6, big.NewInt(1), func() (staking.Directive, interface{}) {
+			return msg.directive, msg.msg
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx, err = staking.Sign(tx, staking.NewEIP155Signer(tx.ChainID()), key); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+		receipts = append(receipts, &types.Receipt{})
+	}
+
+	directives, err := stakingDirectives(txs, receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StakingDirective{
+		{
+			TxHash:           txs[0].Hash(),
+			Directive:        staking.DirectiveCreateValidator,
+			ValidatorAddress: createValidator.ValidatorAddress,
+			DelegatorAddress: createValidator.ValidatorAddress,
+			Amount:           createValidator.Amount,
+		},
+		{
+			TxHash:           txs[1].Hash(),
+			Directive:        staking.DirectiveEditValidator,
+			ValidatorAddress: editValidator.ValidatorAddress,
+			DelegatorAddress: editValidator.ValidatorAddress,
+		},
+		{
+			TxHash:           txs[2].Hash(),
+			Directive:        staking.DirectiveDelegate,
+			ValidatorAddress: delegate.ValidatorAddress,
+			DelegatorAddress: delegate.DelegatorAddress,
+			Amount:           delegate.Amount,
+		},
+	}
+	if len(directives) != len(want) {
+		t.Fatalf("got %d directives, want %d", len(directives), len(want))
+	}
+	for i := range want {
+		got, want := directives[i], want[i]
+		if got.TxHash != want.TxHash || got.Directive != want.Directive ||
+			got.ValidatorAddress != want.ValidatorAddress ||
+			got.DelegatorAddress != want.DelegatorAddress {
+			t.Errorf("directive %d: got %+v, want %+v", i, got, want)
+		}
+		if (got.Amount == nil) != (want.Amount == nil) ||
+			(got.Amount != nil && got.Amount.Cmp(want.Amount) != 0) {
+			t.Errorf("directive %d: got amount %v, want %v", i, got.Amount, want.Amount)
+		}
+	}
+}
+
+// rewardChain is a chain with the same committee in every epoch, whose
+// validator snapshots are the given ones.
+type rewardChain struct {
+	offlineChain
+
+	config     *params.ChainConfig
+	current    *block.Header
+	shardState *shard.State
+	snapshots  map[common.Address]*staking.ValidatorSnapshot
+}
+
+func (c *rewardChain) Config() *params.ChainConfig { return c.config }
+
+func (c *rewardChain) CurrentHeader() *block.Header { return c.current }
+
+func (c *rewardChain) GetHeaderByHash(hash common.Hash) *block.Header {
+	return c.headers[hash]
+}
+
+func (c *rewardChain) ReadShardState(*big.Int) (*shard.State, error) {
+	return c.shardState, nil
+}
+
+func (c *rewardChain) ReadValidatorSnapshot(
+	addr common.Address,
+) (*staking.ValidatorSnapshot, error) {
+	if snapshot, ok := c.snapshots[addr]; ok {
+		return snapshot, nil
+	}
+	return nil, errors.Errorf("no validator snapshot of %s", addr.Hex())
+}
+
+func TestComputeBlockReward(t *testing.T) {
+	// Give external validators voting power from the staking epoch on.
+	defer func(schedule shardingconfig.Schedule) { shard.Schedule = schedule }(shard.Schedule)
+	shard.Schedule = shardingconfig.LocalnetSchedule
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+
+	// A staked validator and a harmony node, both of which signed the
+	// parent block.
+	validator := makeVWrapperByIndex(0)
+	harmonyNode := common.HexToAddress("0x1049")
+	stake := numeric.NewDec(100)
+	committee := shard.Committee{
+		ShardID: shard.BeaconChainShardID,
+		Slots: shard.SlotList{
+			{
+				EcdsaAddress:   validator.Address,
+				BLSPublicKey:   validator.SlotPubKeys[0],
+				EffectiveStake: &stake,
+			},
+			{EcdsaAddress: harmonyNode, BLSPublicKey: blsKeys[19].pub},
+		},
+	}
+
+	run := func(epoch int64) (reward.Reader, *state.DB) {
+		// The payout of the staking era is only reported for blocks that
+		// carry crosslinks, even if there are none.
+		crossLinks, err := rlp.EncodeToBytes(types.CrossLinks{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent := newTestHeader(epoch)
+		header := newTestHeader(epoch).With().
+			Number(big.NewInt(2)).
+			ParentHash(parent.Hash()).
+			LastCommitBitmap([]byte{0x03}).
+			CrossLinks(crossLinks).
+			Header()
+		chain := &rewardChain{
+			offlineChain: offlineChain{headers: map[common.Hash]*block.Header{
+				parent.Hash(): parent,
+			}},
+			config:     &config,
+			current:    parent,
+			shardState: &shard.State{Epoch: big.NewInt(epoch), Shards: []shard.Committee{committee}},
+			snapshots: map[common.Address]*staking.ValidatorSnapshot{
+				validator.Address: {Validator: &validator, Epoch: big.NewInt(epoch)},
+			},
+		}
+		statedb := newTestState()
+		wrapper := validator
+		if err := statedb.UpdateValidatorWrapper(validator.Address, &wrapper); err != nil {
+			t.Fatal(err)
+		}
+		root := statedb.IntermediateRoot(true)
+
+		payout, err := computeBlockReward(chain, chain, header, statedb)
+		if err != nil {
+			t.Fatalf("epoch %d: %v", epoch, err)
+		}
+		if got := statedb.IntermediateRoot(true); got != root {
+			t.Errorf("epoch %d: state modified", epoch)
+		}
+		return payout, statedb
+	}
+
+	// Before staking, the fixed reward is split evenly among the signers.
+	payout, statedb := run(1)
+	if got := payout.ReadRoundResult().Total; got.Cmp(network.BlockReward) != 0 {
+		t.Errorf("before staking: got total %v, want %v", got, network.BlockReward)
+	}
+	for _, addr := range []common.Address{validator.Address, harmonyNode} {
+		if got := statedb.GetBalance(addr); got.Sign() != 0 {
+			t.Errorf("before staking: %s credited %v", addr.Hex(), got)
+		}
+	}
+
+	// From staking on, the staked validator earns the whole staked reward,
+	// as it is the only external signer.
+	payout, _ = run(10)
+	want := network.BaseStakedReward.RoundInt()
+	if got := payout.ReadRoundResult().Total; got.Cmp(want) != 0 {
+		t.Errorf("staking: got total %v, want %v", got, want)
+	}
+	awards := payout.ReadRoundResult().BeaconchainAward
+	if len(awards) != 1 || awards[0].Addr != validator.Address {
+		t.Errorf("staking: got awards %+v, want one to %s", awards, validator.Address.Hex())
+	}
+}
+
+// ReadValidatorSnapshotAtEpoch returns the snapshot of the validator with the
+// given address, whatever the epoch.
+func (c *rewardChain) ReadValidatorSnapshotAtEpoch(
+	epoch *big.Int, addr common.Address,
+) (*staking.ValidatorSnapshot, error) {
+	snapshot, err := c.ReadValidatorSnapshot(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &staking.ValidatorSnapshot{Validator: snapshot.Validator, Epoch: epoch}, nil
+}
+
+func TestFinalizeDeterministic(t *testing.T) {
+	defer func(schedule shardingconfig.Schedule) { shard.Schedule = schedule }(shard.Schedule)
+	shard.Schedule = shardingconfig.LocalnetSchedule
+	defer chain2.Engine.SetBeaconchain(chain2.Engine.Beaconchain())
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	epoch := big.NewInt(10)
+
+	// Staked validators with an external delegator each, all of which signed
+	// the parent block, two of them having double-signed at different heights.
+	validators := make([]staking.ValidatorWrapper, 4)
+	stake := numeric.NewDec(100)
+	committee := shard.Committee{ShardID: shard.BeaconChainShardID}
+	for i := range validators {
+		validators[i] = makeVWrapperByIndex(i)
+		validators[i].Delegations = append(validators[i].Delegations, staking.NewDelegation(
+			makeTestAddr(100+i), big.NewInt(1e18),
+		))
+		committee.Slots = append(committee.Slots, shard.Slot{
+			EcdsaAddress:   validators[i].Address,
+			BLSPublicKey:   validators[i].SlotPubKeys[0],
+			EffectiveStake: &stake,
+		})
+	}
+	slashes := slash.Records{}
+	for i, height := range []uint64{7, 3} {
+		offender := validators[i+1]
+		var record slash.Record
+		record.Evidence.Moment = slash.Moment{
+			Epoch: big.NewInt(9), ShardID: shard.BeaconChainShardID,
+			Height: height, ViewID: height,
+		}
+		record.Evidence.SecondVote.SignerPubKey = offender.SlotPubKeys[0]
+		record.Evidence.Offender = offender.Address
+		record.Reporter = makeTestAddr("reporter")
+		slashes = append(slashes, record)
+	}
+	crossLinks, err := rlp.EncodeToBytes(types.CrossLinks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finalize := func() (common.Hash, reward.Reader) {
+		parent := newTestHeader(epoch.Int64())
+		header := newTestHeader(epoch.Int64()).With().
+			Number(big.NewInt(2)).
+			ParentHash(parent.Hash()).
+			LastCommitBitmap([]byte{0x0f}).
+			CrossLinks(crossLinks).
+			Header()
+		chain := &rewardChain{
+			offlineChain: offlineChain{headers: map[common.Hash]*block.Header{
+				parent.Hash(): parent,
+			}},
+			config:     &config,
+			current:    parent,
+			shardState: &shard.State{Epoch: epoch, Shards: []shard.Committee{committee}},
+			snapshots:  map[common.Address]*staking.ValidatorSnapshot{},
+		}
+		chain2.Engine.SetBeaconchain(chain)
+		statedb := newTestState()
+		for i := range validators {
+			snapshot := staketest.CopyValidatorWrapper(validators[i])
+			chain.snapshots[snapshot.Address] = &staking.ValidatorSnapshot{
+				Validator: &snapshot, Epoch: epoch,
+			}
+			wrapper := staketest.CopyValidatorWrapper(validators[i])
+			if err := statedb.UpdateValidatorWrapper(wrapper.Address, &wrapper); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, payout, err := chain2.Engine.Finalize(
+			chain, header, statedb, nil, nil, nil, nil, nil, slashes,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range slashes {
+			wrapper, err := statedb.ValidatorWrapper(record.Evidence.Offender)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wrapper.Status != effective.Banned {
+				t.Fatalf("%s not slashed", record.Evidence.Offender.Hex())
+			}
+		}
+		return header.Root(), payout
+	}
+
+	root, payout := finalize()
+	awards := payout.ReadRoundResult().BeaconchainAward
+	if len(awards) != len(validators) {
+		t.Fatalf("got %d awards, want %d", len(awards), len(validators))
+	}
+	for i := 0; i < 10; i++ {
+		gotRoot, gotPayout := finalize()
+		if gotRoot != root {
+			t.Fatalf("run %d: got state root %s, want %s", i, gotRoot.Hex(), root.Hex())
+		}
+		if got := gotPayout.ReadRoundResult().BeaconchainAward; !reflect.DeepEqual(got, awards) {
+			t.Fatalf("run %d: got awards %+v, want %+v", i, got, awards)
+		}
+	}
+}
+
+func TestProcessWithHeavyTransactions(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().
+		Coinbase(testCoinbase).
+		GasLimit(1000000).
+		Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 10)
+	// JUMPDEST PUSH1 0x00 JUMP, burning all the gas it is given.
+	spinner := common.HexToAddress("0x1059")
+	statedb.SetCode(spinner, common.FromHex("5b600056"))
+	txs := make(types.Transactions, len(keys))
+	for i, key := range keys {
+		txs[i] = signTestTx(t, header, key, types.NewTransaction(
+			0, common.HexToAddress("0x104b"), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		))
+	}
+	txs[5] = signTestTx(t, header, keys[5], types.NewTransaction(
+		0, spinner, 0, big.NewInt(0), 300000, big.NewInt(1), nil,
+	))
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	receipts, _, _, usedGas, _, err := p.Process(block, statedb.Copy(), vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotReceipts, _, _, gotUsedGas, _, heavy, err := p.ProcessWithHeavyTransactions(
+		block, statedb.Copy(), vm.Config{}, 10,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotUsedGas != usedGas || len(gotReceipts) != len(receipts) {
+		t.Errorf("got %d receipts using %d gas, want %d using %d",
+			len(gotReceipts), gotUsedGas, len(receipts), usedGas)
+	}
+	want := []HeavyTransaction{{Index: 5, Hash: txs[5].Hash(), GasUsed: 300000}}
+	if !reflect.DeepEqual(heavy, want) {
+		t.Errorf("got heavy transactions %+v, want %+v", heavy, want)
+	}
+
+	// Every transaction uses more than nothing.
+	_, _, _, _, _, heavy, err = p.ProcessWithHeavyTransactions(
+		block, statedb.Copy(), vm.Config{}, 0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heavy) != len(txs) {
+		t.Errorf("got %d heavy transactions, want %d", len(heavy), len(txs))
+	}
+	if _, _, _, _, _, _, err := p.ProcessWithHeavyTransactions(
+		block, statedb.Copy(), vm.Config{}, 101,
+	); err == nil {
+		t.Errorf("accepted a percentage above 100")
+	}
+}
+
+func TestProcessWithGasForwarding(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().
+		Coinbase(testCoinbase).
+		GasLimit(1000000).
+		Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	var (
+		greedy = common.HexToAddress("0x107d")
+		polite = common.HexToAddress("0x107e")
+		callee = common.HexToAddress("0x107f")
+	)
+	// Call the callee with no value and all the gas, or only 1000 gas:
+	//
+	//   PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00
+	//   PUSH20 callee GAS CALL POP STOP
+	//   PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00
+	//   PUSH20 callee PUSH2 0x03e8 CALL POP STOP
+	call := "60006000600060006000" + "73" + callee.Hex()[2:]
+	statedb.SetCode(greedy, common.FromHex(call+"5af15000"))
+	statedb.SetCode(polite, common.FromHex(call+"6103e8f15000"))
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, greedy, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, polite, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[2], types.NewTransaction(
+			0, callee, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	want := statedb.Copy()
+	_, _, _, usedGas, _, err := p.Process(block, want, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		got   = statedb.Copy()
+		calls int
+	)
+	_, _, _, gotUsedGas, _, flagged, err := p.ProcessWithGasForwarding(
+		block, got, vm.Config{OnCallGas: func(vm.CallGas) { calls++ }}, 90,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotUsedGas != usedGas {
+		t.Errorf("used %d gas, want %d", gotUsedGas, usedGas)
+	}
+	if got, want := got.IntermediateRoot(false), want.IntermediateRoot(false); got != want {
+		t.Errorf("got state root %x, want %x", got, want)
+	}
+	if calls != 2 {
+		t.Errorf("reported %d calls to the callback, want 2", calls)
+	}
+	if len(flagged) != 3 || len(flagged[0]) != 1 || len(flagged[1]) != 0 || len(flagged[2]) != 0 {
+		t.Fatalf("got flagged calls %+v, want only the one of the first transaction", flagged)
+	}
+	// All but one 64th of the available gas is forwarded.
+	forward := flagged[0][0]
+	if forward.Type != vm.CALL || forward.From != greedy || forward.To != callee ||
+		forward.Depth != 1 || forward.Forwarded != forward.Available-forward.Available/64 {
+		t.Errorf("got flagged call %+v", forward)
+	}
+
+	if _, _, _, _, _, _, err := p.ProcessWithGasForwarding(
+		block, statedb.Copy(), vm.Config{}, 101,
+	); err == nil {
+		t.Errorf("accepted a percentage above 100")
+	}
+}
+
+func TestProcessWithSelfTransfers(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().
+		Coinbase(testCoinbase).
+		GasLimit(1000000).
+		Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 5)
+	self := func(i int) common.Address {
+		return crypto.PubkeyToAddress(keys[i].PublicKey)
+	}
+	other := common.HexToAddress("0x1072")
+	txs := types.Transactions{
+		// Zero-value self-transfers.
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, self(0), 0, big.NewInt(0), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			1, self(0), 0, big.NewInt(0), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewTransaction(
+			0, self(1), 0, big.NewInt(0), 21000, big.NewInt(1), nil,
+		)),
+		// A self-transfer of value, a zero-value transfer to someone else
+		// and a plain transfer.
+		signTestTx(t, header, keys[2], types.NewTransaction(
+			0, self(2), 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[3], types.NewTransaction(
+			0, other, 0, big.NewInt(0), 21000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[4], types.NewTransaction(
+			0, other, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	want := statedb.Copy()
+	_, _, _, usedGas, _, err := p.Process(block, want, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, gotUsedGas, _, count, err := p.ProcessWithSelfTransfers(
+		block, statedb, vm.Config{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("got %d self-transfers, want 3", count)
+	}
+	if gotUsedGas != usedGas {
+		t.Errorf("used %d gas, want %d", gotUsedGas, usedGas)
+	}
+	if got, want := statedb.IntermediateRoot(false), want.IntermediateRoot(false); got != want {
+		t.Errorf("got state root %x, want %x", got, want)
+	}
+}
+
+func TestProcessDuplicateTransaction(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	statedb := newTestState()
+	block, _ := signedTransferBlock(t, statedb, 3)
+	txs := block.Transactions()
+	duplicated := types.NewBlockWithHeader(block.Header()).WithBody(
+		append(txs[:len(txs):len(txs)], txs[1]), nil, nil, nil,
+	)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	if _, _, _, _, _, err := p.Process(block, statedb.Copy(), vm.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, _, err := p.Process(duplicated, statedb.Copy(), vm.Config{})
+	if errors.Cause(err) != ErrDuplicateTxInBlock {
+		t.Fatalf("got %v, want %v", err, ErrDuplicateTxInBlock)
+	}
+	if msg := err.Error(); !strings.Contains(msg, txs[1].Hash().Hex()) ||
+		!strings.Contains(msg, "transaction 3") {
+		t.Errorf("error %q does not name the duplicate", msg)
+	}
+}
+
+func TestProcessInvalidGasLimit(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	statedb := newTestState()
+	block, _ := signedTransferBlock(t, statedb, 1)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	for _, gasLimit := range []uint64{0, params.MinGasLimit - 1, params.MaxGasLimit + 1} {
+		header := block.Header().With().GasLimit(gasLimit).Header()
+		invalid := types.NewBlockWithHeader(header).WithBody(
+			block.Transactions(), nil, nil, nil,
+		)
+		db := statedb.Copy()
+		root := db.IntermediateRoot(false)
+		_, _, _, _, _, err := p.Process(invalid, db, vm.Config{})
+		if errors.Cause(err) != ErrInvalidGasLimit {
+			t.Errorf("gas limit %d: got %v, want %v", gasLimit, err, ErrInvalidGasLimit)
+		}
+		if got := db.IntermediateRoot(false); got != root {
+			t.Errorf("gas limit %d: state modified", gasLimit)
+		}
+	}
+}
+
+func TestProcessBlockTooLarge(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 3)
+	// PUSH1 0x00 PUSH1 0x00 LOG0 STOP, emitting one log per call.
+	logger := common.HexToAddress("0x1062")
+	statedb.SetCode(logger, common.FromHex("60006000a000"))
+	txs := make(types.Transactions, len(keys))
+	for i, key := range keys {
+		txs[i] = signTestTx(t, header, key, types.NewTransaction(
+			0, logger, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		))
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	tests := []struct {
+		maxReceipts, maxLogs int
+		want                 error
+	}{
+		{0, 0, nil},
+		{3, 3, nil},
+		{2, 0, ErrBlockTooLarge},
+		{0, 2, ErrBlockTooLarge},
+	}
+	for _, test := range tests {
+		if err := p.SetBlockSizeLimits(test.maxReceipts, test.maxLogs); err != nil {
+			t.Fatal(err)
+		}
+		_, _, logs, _, _, err := p.Process(block, statedb.Copy(), vm.Config{})
+		if errors.Cause(err) != test.want {
+			t.Errorf("%d receipts and %d logs allowed: got error %v, want %v",
+				test.maxReceipts, test.maxLogs, err, test.want)
+		}
+		if err == nil && len(logs) != len(txs) {
+			t.Errorf("got %d logs, want %d", len(logs), len(txs))
+		}
+	}
+	if err := p.SetBlockSizeLimits(-1, 0); err == nil {
+		t.Error("accepted a negative limit")
+	}
+}
+
+func TestProcessWithCreatedAccounts(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 2)
+	existing := crypto.PubkeyToAddress(keys[1].PublicKey)
+	var (
+		transferred = common.HexToAddress("0x104c")
+		received    = common.HexToAddress("0x104d")
+		touched     = common.HexToAddress("0x104e")
+	)
+	receipt := func(n int64, to common.Address) *types.CXReceipt {
+		return &types.CXReceipt{
+			TxHash:    common.BigToHash(big.NewInt(n)),
+			To:        &to,
+			ShardID:   1,
+			ToShardID: 0,
+			Amount:    big.NewInt(5),
+		}
+	}
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, transferred, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		// Touches a new account without funding it, which deletes it again.
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			1, touched, 0, big.NewInt(0), 21000, big.NewInt(1), nil,
+		)),
+	}
+	proofs := types.CXReceiptsProofs{
+		{Receipts: types.CXReceipts{receipt(1, received), receipt(2, existing)}},
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, proofs)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	_, _, _, _, _, created, err := p.ProcessWithCreatedAccounts(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The incoming receipts are recorded as applied in a system account,
+	// which their first one creates.
+	want := []common.Address{transferred, received, testCoinbase, appliedCXReceiptsAddr}
+	sort.Slice(want, func(i, j int) bool {
+		return bytes.Compare(want[i][:], want[j][:]) < 0
+	})
+	if !reflect.DeepEqual(created, want) {
+		t.Errorf("got created %x, want %x", created, want)
+	}
+	if got := statedb.CreatedAccounts(); got != nil {
+		t.Errorf("still recording created accounts: %x", got)
+	}
+}
+
+func TestProcessWithReceiptsRoot(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	statedb := newTestState()
+	block, _ := signedTransferBlock(t, statedb, 5)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	receipts, _, _, _, _, root, err := p.ProcessWithReceiptsRoot(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := types.DeriveSha(receipts); root != want {
+		t.Errorf("got receipts root %x, want %x", root, want)
+	}
+
+	empty := types.NewBlockWithHeader(block.Header())
+	_, _, _, _, _, root, err = p.ProcessWithReceiptsRoot(empty, newTestState(), vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != types.EmptyRootHash {
+		t.Errorf("got receipts root %x of an empty block, want %x", root, types.EmptyRootHash)
+	}
+}
+
+func TestProcessWithOptionsCombined(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	statedb := newTestState()
+	block, _ := signedTransferBlock(t, statedb, 5)
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+
+	processed := statedb.Copy()
+	receipts, _, _, usedGas, _, err := p.Process(block, processed, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := statedb.IntermediateRoot(true)
+	result, err := p.ProcessWithOptions(block, statedb, vm.Config{}, ProcessOptions{
+		Context:      context.Background(),
+		DryRun:       true,
+		Parallel:     true,
+		Bloom:        true,
+		ReceiptsRoot: true,
+		Fees:         true,
+		Expected:     &state.Dump{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statedb.IntermediateRoot(true); got != root {
+		t.Errorf("dry run modified the state: root %x, want %x", got, root)
+	}
+	if result.UsedGas != usedGas || types.DeriveSha(result.Receipts) != types.DeriveSha(receipts) {
+		t.Error("options changed the outcome of the block")
+	}
+	if result.ReceiptsRoot != types.DeriveSha(receipts) {
+		t.Errorf("got receipts root %x, want %x", result.ReceiptsRoot, types.DeriveSha(receipts))
+	}
+	if result.Bloom != types.CreateBloom(receipts) {
+		t.Error("got a different bloom")
+	}
+	if result.Fees == nil || result.Fees.Collected.Sign() == 0 {
+		t.Errorf("got fees %+v", result.Fees)
+	}
+	// The header of the block does not carry the root of its post-state.
+	if len(result.StateDiffs) == 0 {
+		t.Error("no state differences reported for a mismatching root")
+	}
+	if result.AccessSet != nil || result.SelfDestructs != nil || result.Failed != nil {
+		t.Errorf("reported what was not asked for: %+v", result)
+	}
+}
+
+func benchmarkProcessReceiptsRoot(b *testing.B, incremental bool) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	statedb := newTestState()
+	block, _ := signedTransferBlock(b, statedb, 1000)
+	p := NewStateProcessor(&config, nil, &offlineEngine{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := statedb.Copy()
+		b.StartTimer()
+		if incremental {
+			if _, _, _, _, _, _, err := p.ProcessWithReceiptsRoot(block, db, vm.Config{}); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		receipts, _, _, _, _, err := p.Process(block, db, vm.Config{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		types.DeriveSha(receipts)
+	}
+}
+
+func BenchmarkProcessDerivingReceiptsRoot(b *testing.B) {
+	benchmarkProcessReceiptsRoot(b, false)
+}
+
+func BenchmarkProcessWithReceiptsRoot(b *testing.B) {
+	benchmarkProcessReceiptsRoot(b, true)
+}
+
+func TestProcessWithValueTransferred(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	keys := newTestKeys(t, statedb, 1)
+	var (
+		recipient = common.HexToAddress("0x1052")
+		// PUSH1 0x00 PUSH1 0x00 REVERT
+		reverter = common.HexToAddress("0x1053")
+		// Send the value received on to the recipient:
+		//
+		//   PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 PUSH1 0x00 CALLVALUE
+		//   PUSH20 recipient GAS CALL STOP
+		forwarder = common.HexToAddress("0x1054")
+	)
+	statedb.SetCode(reverter, common.FromHex("60006000fd"))
+	statedb.SetCode(forwarder, common.FromHex(
+		"600060006000600034"+"73"+recipient.Hex()[2:]+"5af100",
+	))
+	transfer := func(nonce uint64, to common.Address, value int64) *types.Transaction {
+		return signTestTx(t, header, keys[0], types.NewTransaction(
+			nonce, to, 0, big.NewInt(value), 100000, big.NewInt(1), nil,
+		))
+	}
+	txs := types.Transactions{
+		transfer(0, recipient, 1000),
+		transfer(1, reverter, 500),
+		transfer(2, forwarder, 300),
+	}
+	receipt := func(n int64, amount int64) *types.CXReceipt {
+		return &types.CXReceipt{
+			TxHash:    common.BigToHash(big.NewInt(n)),
+			To:        &recipient,
+			ShardID:   1,
+			ToShardID: 0,
+			Amount:    big.NewInt(amount),
+		}
+	}
+	proofs := types.CXReceiptsProofs{
+		{Receipts: types.CXReceipts{receipt(1, 5), receipt(2, 7)}},
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, proofs)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	receipts, _, _, _, _, value, err := p.ProcessWithValueTransferred(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipts[1].Status != types.ReceiptStatusFailed {
+		t.Fatal("transfer to the reverting contract succeeded")
+	}
+	// The forwarded value counts once, and the failed transfer not at all.
+	if want := big.NewInt(1300); value.Transactions.Cmp(want) != 0 {
+		t.Errorf("got %v transferred by transactions, want %v", value.Transactions, want)
+	}
+	if want := big.NewInt(12); value.IncomingReceipts.Cmp(want) != 0 {
+		t.Errorf("got %v transferred by incoming receipts, want %v", value.IncomingReceipts, want)
+	}
+	if got, want := statedb.GetBalance(recipient), big.NewInt(1312); got.Cmp(want) != 0 {
+		t.Errorf("got recipient balance %v, want %v", got, want)
+	}
+}
+
+func TestProcessToJSON(t *testing.T) {
+	config := *params.TestChainConfig
+	config.StakingEpoch = big.NewInt(10)
+	header := newTestHeader(1).With().Coinbase(testCoinbase).Header()
+	statedb := newTestState()
+	// Fixed keys, so that the document is the same every time.
+	var keys []*ecdsa.PrivateKey
+	for _, hex := range []string{
+		"b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291",
+		"8a1f9a8f95be41cd7ccb6168179afb4504aefe388d1e14474d32c45c72ce7b7a",
+	} {
+		key, err := crypto.HexToECDSA(hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statedb.AddBalance(crypto.PubkeyToAddress(key.PublicKey), big.NewInt(1e18))
+		keys = append(keys, key)
+	}
+	// PUSH1 0x2a PUSH1 0x00 MSTORE PUSH1 0x01 PUSH1 0x20 PUSH1 0x00 LOG1 STOP
+	logger := common.HexToAddress("0x1056")
+	statedb.SetCode(logger, common.FromHex("602a600052600160206000a100"))
+	statedb = deployTestToken(t, statedb, keys)
+	to := common.HexToAddress("0x1055")
+	txs := types.Transactions{
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			0, to, 0, big.NewInt(1000), 21000, big.NewInt(1), nil,
+		)),
+		tokenTransfer(t, header, keys[1], 0, to, 7),
+		signTestTx(t, header, keys[0], types.NewTransaction(
+			1, logger, 0, big.NewInt(0), 100000, big.NewInt(1), nil,
+		)),
+		signTestTx(t, header, keys[1], types.NewCrossShardTransaction(
+			1, &to, 0, 1, big.NewInt(500), 21000, big.NewInt(1), nil,
+		)),
+	}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil, nil, nil)
+
+	bc := newTestChain(t, &config)
+	defer bc.Stop()
+	p := NewStateProcessor(&config, bc, &offlineEngine{})
+	got, err := p.ProcessToJSON(block, statedb.Copy(), vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/processed_block.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.TrimSpace(want)) {
+		t.Errorf("got document\n%s\nwant\n%s", got, want)
+	}
+	again, err := p.ProcessToJSON(block, statedb.Copy(), vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, again) {
+		t.Error("processing the block again yields a different document")
+	}
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/internal/params"
+)
+
+// TransactionTrace is the outcome of tracing a single transaction.
+type TransactionTrace struct {
+	Receipt   *types.Receipt
+	CXReceipt *types.CXReceipt // nil unless a cross-shard receipt was produced
+	Gas       uint64
+
+	StructLogs []vm.StructLog // opcode level steps, including gas at each step
+	Output     []byte         // return value of the top level call
+	VMErr      error          // error the EVM execution ended with, if any
+
+	StateDiff []AccountDiff // post-state of everything written, by address
+}
+
+// AccountDiff is the post-transaction state of an account written by a
+// traced transaction. Storage only holds the slots that were written.
+type AccountDiff struct {
+	Address common.Address
+	Deleted bool
+	Balance *big.Int
+	Nonce   uint64
+	Storage map[common.Hash]common.Hash
+}
+
+// TraceTransaction applies tx exactly like ApplyTransaction does while
+// recording an opcode level trace of its execution with a vm.StructLogger
+// configured by logCfg (which may be nil). Tracing affects neither the gas
+// accounting nor the resulting state.
+func TraceTransaction(
+	config *params.ChainConfig, bc ChainContext, author *common.Address,
+	gp *GasPool, statedb *state.DB, header *block.Header,
+	tx *types.Transaction, usedGas *uint64, logCfg *vm.LogConfig,
+) (*TransactionTrace, error) {
+	var (
+		tracer   = vm.NewStructLogger(logCfg)
+		accesses = state.NewAccessSet()
+		prev     = statedb.AccessSet()
+	)
+	statedb.SetAccessSet(accesses)
+	receipt, cxReceipt, gas, err := ApplyTransaction(
+		config, bc, author, gp, statedb, header, tx, usedGas,
+		vm.Config{Debug: true, Tracer: tracer},
+	)
+	statedb.SetAccessSet(prev)
+	if prev != nil {
+		prev.Merge(accesses)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionTrace{
+		Receipt:    receipt,
+		CXReceipt:  cxReceipt,
+		Gas:        gas,
+		StructLogs: tracer.StructLogs(),
+		Output:     tracer.Output(),
+		VMErr:      tracer.Error(),
+		StateDiff:  writtenAccounts(statedb, accesses),
+	}, nil
+}
+
+// writtenAccounts reads the current state of everything written according to
+// accesses, ordered by address.
+func writtenAccounts(statedb *state.DB, accesses *state.AccessSet) []AccountDiff {
+	touched := map[common.Address]struct{}{}
+	for addr := range accesses.WriteAccounts {
+		touched[addr] = struct{}{}
+	}
+	for addr := range accesses.WriteSlots {
+		touched[addr] = struct{}{}
+	}
+	diffs := make([]AccountDiff, 0, len(touched))
+	for addr := range touched {
+		diff := AccountDiff{
+			Address: addr,
+			Deleted: !statedb.Exist(addr),
+			Balance: statedb.GetBalance(addr),
+			Nonce:   statedb.GetNonce(addr),
+		}
+		if keys := accesses.WriteSlots[addr]; len(keys) > 0 {
+			diff.Storage = make(map[common.Hash]common.Hash, len(keys))
+			for key := range keys {
+				diff.Storage[key] = statedb.GetState(addr, key)
+			}
+		}
+		diffs = append(diffs, diff)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return bytes.Compare(diffs[i].Address[:], diffs[j].Address[:]) < 0
+	})
+	return diffs
+}
@@ -21,10 +21,11 @@ import (
 	"math/big"
 
 	staking2 "github.com/harmony-one/harmony/staking"
-	"github.com/harmony-one/harmony/staking/network"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/core/state"
 	"github.com/harmony-one/harmony/core/types"
 	"github.com/harmony-one/harmony/core/vm"
 	"github.com/harmony-one/harmony/internal/params"
@@ -68,6 +69,7 @@ The state transitioning model does all the necessary work to work out a valid ne
 type StateTransition struct {
 	gp         *GasPool
 	msg        Message
+	payer      common.Address // account buying the gas, msg.From() by default
 	gas        uint64
 	gasPrice   *big.Int
 	initialGas uint64
@@ -76,6 +78,9 @@ type StateTransition struct {
 	state      vm.StateDB
 	evm        *vm.EVM
 	bc         ChainContext
+	refund     uint64
+	vmErr      error // error the EVM execution ended with, if any
+	quiet      bool  // do not log the error of the EVM execution
 }
 
 // Message represents a message sent to a contract.
@@ -93,10 +98,12 @@ type Message interface {
 	Data() []byte
 	Type() types.TransactionType
 	BlockNum() *big.Int
+	AccessList() types.AccessList
 }
 
-// IntrinsicGas computes the 'intrinsic gas' for a message with the given data.
-func IntrinsicGas(data []byte, contractCreation, homestead, isValidatorCreation bool) (uint64, error) {
+// IntrinsicGas computes the 'intrinsic gas' for a message with the given data
+// and access list.
+func IntrinsicGas(data []byte, accessList types.AccessList, contractCreation, homestead, isValidatorCreation bool) (uint64, error) {
 	// Set the starting gas for the raw transaction
 	var gas uint64
 	if contractCreation && homestead {
@@ -127,6 +134,10 @@ func IntrinsicGas(data []byte, contractCreation, homestead, isValidatorCreation
 		}
 		gas += z * params.TxDataZeroGas
 	}
+	if accessList != nil {
+		gas += uint64(len(accessList)) * params.TxAccessListAddressGas
+		gas += uint64(accessList.StorageKeys()) * params.TxAccessListStorageKeyGas
+	}
 	return gas, nil
 }
 
@@ -136,6 +147,7 @@ func NewStateTransition(evm *vm.EVM, msg Message, gp *GasPool, bc ChainContext)
 		gp:       gp,
 		evm:      evm,
 		msg:      msg,
+		payer:    msg.From(),
 		gasPrice: msg.GasPrice(),
 		value:    msg.Value(),
 		data:     msg.Data(),
@@ -155,6 +167,29 @@ func ApplyMessage(evm *vm.EVM, msg Message, gp *GasPool) ([]byte, uint64, bool,
 	return NewStateTransition(evm, msg, gp, nil).TransitionDb()
 }
 
+// applyMessage is ApplyMessage that returns the outcome of the execution and
+// also the amount of gas refunded, which is already deducted from the gas
+// used. The gas is bought from and refunded to payer rather than to the
+// sender of msg. If quiet is set, errors of the EVM are not logged.
+func applyMessage(evm *vm.EVM, msg Message, gp *GasPool, payer common.Address, quiet bool) (*ExecutionResult, uint64, uint64, error) {
+	st := NewStateTransition(evm, msg, gp, nil)
+	st.payer = payer
+	st.quiet = quiet
+	ret, gas, _, err := st.TransitionDb()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	result := &ExecutionResult{
+		ReturnData: ret,
+		VMErr:      st.vmErr,
+		CallTree:   evm.CallTree(),
+	}
+	if st.vmErr == vm.ErrOutOfGas {
+		result.OutOfGas = evm.OutOfGas()
+	}
+	return result, gas, st.refund, nil
+}
+
 // ApplyStakingMessage computes the new state for staking message
 func ApplyStakingMessage(evm *vm.EVM, msg Message, gp *GasPool, bc ChainContext) (uint64, error) {
 	return NewStateTransition(evm, msg, gp, bc).StakingTransitionDb()
@@ -179,7 +214,7 @@ func (st *StateTransition) useGas(amount uint64) error {
 
 func (st *StateTransition) buyGas() error {
 	mgval := new(big.Int).Mul(new(big.Int).SetUint64(st.msg.Gas()), st.gasPrice)
-	if have := st.state.GetBalance(st.msg.From()); have.Cmp(mgval) < 0 {
+	if have := st.state.GetBalance(st.payer); have.Cmp(mgval) < 0 {
 		return errors.Wrapf(
 			errInsufficientBalanceForGas,
 			"had: %s but need: %s", have.String(), mgval.String(),
@@ -191,7 +226,7 @@ func (st *StateTransition) buyGas() error {
 	st.gas += st.msg.Gas()
 
 	st.initialGas = st.msg.Gas()
-	st.state.SubBalance(st.msg.From(), mgval)
+	st.state.SubBalance(st.payer, mgval)
 	return nil
 }
 
@@ -206,6 +241,12 @@ func (st *StateTransition) preCheck() error {
 			return ErrNonceTooLow
 		}
 	}
+	// The base fee is burned out of the transaction fee, which must cover it.
+	if baseFee := st.evm.BaseFee; baseFee != nil && st.gasPrice.Cmp(baseFee) < 0 {
+		return errors.Wrapf(
+			ErrGasPriceBelowBaseFee, "gas price %v, base fee %v", st.gasPrice, baseFee,
+		)
+	}
 	return st.buyGas()
 }
 
@@ -213,16 +254,20 @@ func (st *StateTransition) preCheck() error {
 // returning the result including the used gas. It returns an error if failed.
 // An error indicates a consensus issue.
 func (st *StateTransition) TransitionDb() (ret []byte, usedGas uint64, failed bool, err error) {
+	msg := st.msg
+	accessList := st.evm.ChainConfig().IsAccessList(st.evm.EpochNumber)
+	if len(msg.AccessList()) > 0 && !accessList {
+		return nil, 0, false, ErrAccessListNotSupported
+	}
 	if err = st.preCheck(); err != nil {
 		return
 	}
-	msg := st.msg
 	sender := vm.AccountRef(msg.From())
 	homestead := st.evm.ChainConfig().IsS3(st.evm.EpochNumber) // s3 includes homestead
 	contractCreation := msg.To() == nil
 
 	// Pay intrinsic gas
-	gas, err := IntrinsicGas(st.data, contractCreation, homestead, false)
+	gas, err := IntrinsicGas(st.data, msg.AccessList(), contractCreation, homestead, false)
 	if err != nil {
 		return nil, 0, false, err
 	}
@@ -230,6 +275,13 @@ func (st *StateTransition) TransitionDb() (ret []byte, usedGas uint64, failed bo
 		return nil, 0, false, err
 	}
 
+	if accessList {
+		st.state.PrepareAccessList(
+			msg.From(), msg.To(), st.evm.ActivePrecompiles(),
+			msg.AccessList(),
+		)
+	}
+
 	var (
 		evm = st.evm
 		// vm errors do not effect consensus and are therefor
@@ -245,7 +297,9 @@ func (st *StateTransition) TransitionDb() (ret []byte, usedGas uint64, failed bo
 		ret, st.gas, vmerr = evm.Call(sender, st.to(), st.data, st.gas, st.value)
 	}
 	if vmerr != nil {
-		utils.Logger().Debug().Err(vmerr).Msg("VM returned with error")
+		if !st.quiet {
+			utils.Logger().Debug().Err(vmerr).Msg("VM returned with error")
+		}
 		// The only possible consensus-error would be if there wasn't
 		// sufficient balance to make the transfer happen. The first
 		// balance transfer may never fail.
@@ -254,6 +308,7 @@ func (st *StateTransition) TransitionDb() (ret []byte, usedGas uint64, failed bo
 			return nil, 0, false, vmerr
 		}
 	}
+	st.vmErr = vmerr
 	st.refundGas()
 
 	// Burn Txn Fees after staking epoch
@@ -266,16 +321,17 @@ func (st *StateTransition) TransitionDb() (ret []byte, usedGas uint64, failed bo
 }
 
 func (st *StateTransition) refundGas() {
-	// Apply refund counter, capped to half of the used gas.
-	refund := st.gasUsed() / 2
+	// Apply refund counter, capped to a fraction of the used gas.
+	refund := st.gasUsed() / st.evm.ChainConfig().RefundQuotient(st.evm.EpochNumber)
 	if refund > st.state.GetRefund() {
 		refund = st.state.GetRefund()
 	}
 	st.gas += refund
+	st.refund = refund
 
 	// Return ETH for remaining gas, exchanged at the original rate.
 	remaining := new(big.Int).Mul(new(big.Int).SetUint64(st.gas), st.gasPrice)
-	st.state.AddBalance(st.msg.From(), remaining)
+	st.state.AddBalance(st.payer, remaining)
 
 	// Also return remaining gas to the block gas counter so it is
 	// available for the next transaction.
@@ -289,18 +345,30 @@ func (st *StateTransition) gasUsed() uint64 {
 
 // StakingTransitionDb will transition the state by applying the staking message and
 // returning the result including the used gas. It returns an error if failed.
-// It is used for staking transaction only
+// It is used for staking transaction only. The directive of the message is
+// verified against the state before gas is bought for it, so that one that
+// cannot be applied leaves the state untouched.
 func (st *StateTransition) StakingTransitionDb() (usedGas uint64, err error) {
+	msg := st.msg
+	gasCost := new(big.Int)
+	if st.payer == msg.From() {
+		gasCost.Mul(new(big.Int).SetUint64(msg.Gas()), st.gasPrice)
+	}
+	verified, err := validateStakingMsg(
+		st.bc, st.state, st.evm.EpochNumber, st.evm.BlockNumber, msg, gasCost,
+	)
+	if err != nil {
+		return 0, err
+	}
 	if err = st.preCheck(); err != nil {
 		return 0, err
 	}
-	msg := st.msg
 
 	sender := vm.AccountRef(msg.From())
 	homestead := st.evm.ChainConfig().IsS3(st.evm.EpochNumber) // s3 includes homestead
 
 	// Pay intrinsic gas
-	gas, err := IntrinsicGas(st.data, false, homestead, msg.Type() == types.StakeCreateVal)
+	gas, err := IntrinsicGas(st.data, nil, false, homestead, msg.Type() == types.StakeCreateVal)
 
 	if err != nil {
 		return 0, err
@@ -312,149 +380,200 @@ func (st *StateTransition) StakingTransitionDb() (usedGas uint64, err error) {
 	// Increment the nonce for the next transaction
 	st.state.SetNonce(msg.From(), st.state.GetNonce(sender.Address())+1)
 
+	utils.Logger().Info().Msgf(
+		"[DEBUG STAKING] staking type: %s, gas: %d, txn: %+v",
+		msg.Type(), gas, verified.directive,
+	)
+	err = verified.apply()
+	st.refundGas()
+
+	// Burn Txn Fees
+	//txFee := new(big.Int).Mul(new(big.Int).SetUint64(st.gasUsed()), st.gasPrice)
+	//st.state.AddBalance(st.evm.Coinbase, txFee)
+
+	return st.gasUsed(), err
+}
+
+// ValidateStakingTx checks the staking transaction tx against statedb, as of
+// the block with the given header, without modifying it: that its directive is
+// signed by the account it acts for and can be applied, e.g. that a delegation
+// is not below the minimum, and that the sender can afford the stake on top of
+// the gas. These are the checks StakingTransitionDb makes before buying gas,
+// so the transaction pool and RPC can reject such a transaction up front.
+func ValidateStakingTx(
+	config *params.ChainConfig, bc ChainContext, statedb *state.DB,
+	header *block.Header, tx *staking.StakingTransaction,
+) error {
+	if !config.IsPreStaking(header.Epoch()) {
+		return errors.Wrapf(
+			ErrInvalidTxType, "staking transaction in epoch %v", header.Epoch(),
+		)
+	}
+	if getStakingTransactionType(header, tx) == types.InvalidTx {
+		return errors.Wrapf(
+			ErrInvalidTxType, "staking transaction on shard %d", header.ShardID(),
+		)
+	}
+	msg, err := StakingToMessage(tx, header.Number())
+	if err != nil {
+		return err
+	}
+	gasCost := new(big.Int).Mul(new(big.Int).SetUint64(msg.Gas()), msg.GasPrice())
+	_, err = validateStakingMsg(
+		bc, statedb, header.Epoch(), header.Number(), msg, gasCost,
+	)
+	return err
+}
+
+// validateStakingMsg is the validation shared by ValidateStakingTx and
+// StakingTransitionDb: it verifies the directive of the staking message msg
+// against statedb, leaving it untouched, and checks that the sender can
+// afford the stake, if any, on top of gasCost, as the stake is deducted from
+// what it has left after buying gas.
+func validateStakingMsg(
+	bc ChainContext, statedb vm.StateDB, epoch, blockNum *big.Int,
+	msg Message, gasCost *big.Int,
+) (*verifiedStakingMsg, error) {
+	verified, err := verifyStakingMsg(bc, statedb, epoch, blockNum, msg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s staking transaction", msg.Type())
+	}
+	if verified.stake == nil {
+		return verified, nil
+	}
+	need := new(big.Int).Add(verified.stake, gasCost)
+	if !CanTransfer(statedb, msg.From(), need) {
+		return nil, errors.Wrapf(
+			errInsufficientBalanceForStake, "had %v, need %v with gas",
+			statedb.GetBalance(msg.From()), need,
+		)
+	}
+	return verified, nil
+}
+
+// verifiedStakingMsg is a staking message whose directive was verified
+// against the state.
+type verifiedStakingMsg struct {
+	directive interface{} // the decoded directive, e.g. *staking.Delegate
+	stake     *big.Int    // deducted from the balance of the sender, if any
+	apply     func() error
+}
+
+// verifyStakingMsg verifies the directive of the staking message msg against
+// statedb, as of the block of the given epoch and number, leaving it
+// untouched, and returns it with the function applying it to statedb.
+func verifyStakingMsg(
+	bc ChainContext, statedb vm.StateDB, epoch, blockNum *big.Int,
+	msg Message,
+) (*verifiedStakingMsg, error) {
 	switch msg.Type() {
 	case types.StakeCreateVal:
 		stkMsg := &staking.CreateValidator{}
-		if err = rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
-			return 0, err
+		if err := rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
+			return nil, err
 		}
-		utils.Logger().Info().
-			Msgf("[DEBUG STAKING] staking type: %s, gas: %d, txn: %+v", msg.Type(), gas, stkMsg)
 		if msg.From() != stkMsg.ValidatorAddress {
-			return 0, errInvalidSigner
+			return nil, errInvalidSigner
+		}
+		wrapper, err := VerifyAndCreateValidatorFromMsg(
+			statedb, bc, epoch, msg.BlockNum(), stkMsg,
+		)
+		if err != nil {
+			return nil, err
 		}
-		err = st.verifyAndApplyCreateValidatorTx(stkMsg, msg.BlockNum())
+		return &verifiedStakingMsg{stkMsg, stkMsg.Amount, func() error {
+			if err := statedb.UpdateValidatorWrapper(wrapper.Address, wrapper); err != nil {
+				return err
+			}
+			statedb.SetValidatorFlag(stkMsg.ValidatorAddress)
+			statedb.SubBalance(stkMsg.ValidatorAddress, stkMsg.Amount)
+			return nil
+		}}, nil
 	case types.StakeEditVal:
 		stkMsg := &staking.EditValidator{}
-		if err = rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
-			return 0, err
+		if err := rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
+			return nil, err
 		}
-		utils.Logger().Info().
-			Msgf("[DEBUG STAKING] staking type: %s, gas: %d, txn: %+v", msg.Type(), gas, stkMsg)
 		if msg.From() != stkMsg.ValidatorAddress {
-			return 0, errInvalidSigner
+			return nil, errInvalidSigner
+		}
+		wrapper, err := VerifyAndEditValidatorFromMsg(
+			statedb, bc, epoch, msg.BlockNum(), stkMsg,
+		)
+		if err != nil {
+			return nil, err
 		}
-		err = st.verifyAndApplyEditValidatorTx(stkMsg, msg.BlockNum())
+		return &verifiedStakingMsg{stkMsg, nil, func() error {
+			return statedb.UpdateValidatorWrapper(wrapper.Address, wrapper)
+		}}, nil
 	case types.Delegate:
 		stkMsg := &staking.Delegate{}
-		if err = rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
-			return 0, err
+		if err := rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
+			return nil, err
 		}
-		utils.Logger().Info().Msgf("[DEBUG STAKING] staking type: %s, gas: %d, txn: %+v", msg.Type(), gas, stkMsg)
 		if msg.From() != stkMsg.DelegatorAddress {
-			return 0, errInvalidSigner
+			return nil, errInvalidSigner
+		}
+		wrapper, balanceToBeDeducted, err := VerifyAndDelegateFromMsg(statedb, stkMsg)
+		if err != nil {
+			return nil, err
 		}
-		err = st.verifyAndApplyDelegateTx(stkMsg)
+		return &verifiedStakingMsg{stkMsg, balanceToBeDeducted, func() error {
+			statedb.SubBalance(stkMsg.DelegatorAddress, balanceToBeDeducted)
+			return statedb.UpdateValidatorWrapper(wrapper.Address, wrapper)
+		}}, nil
 	case types.Undelegate:
 		stkMsg := &staking.Undelegate{}
-		if err = rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
-			return 0, err
+		if err := rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
+			return nil, err
 		}
-		utils.Logger().Info().Msgf("[DEBUG STAKING] staking type: %s, gas: %d, txn: %+v", msg.Type(), gas, stkMsg)
 		if msg.From() != stkMsg.DelegatorAddress {
-			return 0, errInvalidSigner
+			return nil, errInvalidSigner
 		}
-		err = st.verifyAndApplyUndelegateTx(stkMsg)
+		wrapper, err := VerifyAndUndelegateFromMsg(statedb, epoch, stkMsg)
+		if err != nil {
+			return nil, err
+		}
+		return &verifiedStakingMsg{stkMsg, nil, func() error {
+			return statedb.UpdateValidatorWrapper(wrapper.Address, wrapper)
+		}}, nil
 	case types.CollectRewards:
 		stkMsg := &staking.CollectRewards{}
-		if err = rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
-			return 0, err
+		if err := rlp.DecodeBytes(msg.Data(), stkMsg); err != nil {
+			return nil, err
 		}
-		utils.Logger().Info().Msgf("[DEBUG STAKING] staking type: %s, gas: %d, txn: %+v", msg.Type(), gas, stkMsg)
 		if msg.From() != stkMsg.DelegatorAddress {
-			return 0, errInvalidSigner
+			return nil, errInvalidSigner
+		}
+		if bc == nil {
+			return nil, errors.New("[CollectRewards] No chain context provided")
 		}
-		collectedRewards, tempErr := st.verifyAndApplyCollectRewards(stkMsg)
-		err = tempErr
-		if err == nil {
-			st.state.AddLog(&types.Log{
+		delegations, err := bc.ReadDelegationsByDelegator(stkMsg.DelegatorAddress)
+		if err != nil {
+			return nil, err
+		}
+		wrappers, totalRewards, err := VerifyAndCollectRewardsFromDelegation(
+			statedb, delegations,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &verifiedStakingMsg{stkMsg, nil, func() error {
+			for _, wrapper := range wrappers {
+				if err := statedb.UpdateValidatorWrapper(wrapper.Address, wrapper); err != nil {
+					return err
+				}
+			}
+			statedb.AddBalance(stkMsg.DelegatorAddress, totalRewards)
+			statedb.AddLog(&types.Log{
 				Address:     stkMsg.DelegatorAddress,
 				Topics:      []common.Hash{staking2.CollectRewardsTopic},
-				Data:        collectedRewards.Bytes(),
-				BlockNumber: st.evm.BlockNumber.Uint64(),
+				Data:        totalRewards.Bytes(),
+				BlockNumber: blockNum.Uint64(),
 			})
-		}
+			return nil
+		}}, nil
 	default:
-		return 0, staking.ErrInvalidStakingKind
-	}
-	st.refundGas()
-
-	// Burn Txn Fees
-	//txFee := new(big.Int).Mul(new(big.Int).SetUint64(st.gasUsed()), st.gasPrice)
-	//st.state.AddBalance(st.evm.Coinbase, txFee)
-
-	return st.gasUsed(), err
-}
-
-func (st *StateTransition) verifyAndApplyCreateValidatorTx(
-	createValidator *staking.CreateValidator, blockNum *big.Int,
-) error {
-	wrapper, err := VerifyAndCreateValidatorFromMsg(
-		st.state, st.bc, st.evm.EpochNumber, blockNum, createValidator,
-	)
-	if err != nil {
-		return err
-	}
-	if err := st.state.UpdateValidatorWrapper(wrapper.Address, wrapper); err != nil {
-		return err
-	}
-	st.state.SetValidatorFlag(createValidator.ValidatorAddress)
-	st.state.SubBalance(createValidator.ValidatorAddress, createValidator.Amount)
-	return nil
-}
-
-func (st *StateTransition) verifyAndApplyEditValidatorTx(
-	editValidator *staking.EditValidator, blockNum *big.Int,
-) error {
-	wrapper, err := VerifyAndEditValidatorFromMsg(
-		st.state, st.bc, st.evm.EpochNumber, blockNum, editValidator,
-	)
-	if err != nil {
-		return err
-	}
-	return st.state.UpdateValidatorWrapper(wrapper.Address, wrapper)
-}
-
-func (st *StateTransition) verifyAndApplyDelegateTx(delegate *staking.Delegate) error {
-	wrapper, balanceToBeDeducted, err := VerifyAndDelegateFromMsg(st.state, delegate)
-	if err != nil {
-		return err
-	}
-
-	st.state.SubBalance(delegate.DelegatorAddress, balanceToBeDeducted)
-
-	return st.state.UpdateValidatorWrapper(wrapper.Address, wrapper)
-}
-
-func (st *StateTransition) verifyAndApplyUndelegateTx(
-	undelegate *staking.Undelegate,
-) error {
-	wrapper, err := VerifyAndUndelegateFromMsg(st.state, st.evm.EpochNumber, undelegate)
-	if err != nil {
-		return err
-	}
-	return st.state.UpdateValidatorWrapper(wrapper.Address, wrapper)
-}
-
-func (st *StateTransition) verifyAndApplyCollectRewards(collectRewards *staking.CollectRewards) (*big.Int, error) {
-	if st.bc == nil {
-		return network.NoReward, errors.New("[CollectRewards] No chain context provided")
-	}
-	delegations, err := st.bc.ReadDelegationsByDelegator(collectRewards.DelegatorAddress)
-	if err != nil {
-		return network.NoReward, err
-	}
-	updatedValidatorWrappers, totalRewards, err := VerifyAndCollectRewardsFromDelegation(
-		st.state, delegations,
-	)
-	if err != nil {
-		return network.NoReward, err
-	}
-	for _, wrapper := range updatedValidatorWrappers {
-		if err := st.state.UpdateValidatorWrapper(wrapper.Address, wrapper); err != nil {
-			return network.NoReward, err
-		}
+		return nil, staking.ErrInvalidStakingKind
 	}
-	st.state.AddBalance(collectRewards.DelegatorAddress, totalRewards)
-	return totalRewards, nil
 }
@@ -72,6 +72,10 @@ var (
 	// than required to start the invocation.
 	ErrIntrinsicGas = errors.New("intrinsic gas too low")
 
+	// ErrAccessListNotSupported is returned if a transaction carries an access
+	// list before the access list epoch.
+	ErrAccessListNotSupported = errors.New("access list not supported yet")
+
 	// ErrGasLimit is returned if a transaction's requested gas limit exceeds the
 	// maximum allowance of the current block.
 	ErrGasLimit = errors.New("exceeds block gas limit")
@@ -251,7 +255,8 @@ type TxPool struct {
 
 	txErrorSink *types.TransactionErrorSink // All failed txs gets reported here
 
-	homestead bool
+	homestead  bool
+	accessList bool
 }
 
 // NewTxPool creates a new transaction pool to gather, sort and filter inbound
@@ -335,6 +340,9 @@ func (pool *TxPool) loop() {
 				if pool.chainconfig.IsS3(ev.Block.Epoch()) {
 					pool.homestead = true
 				}
+				if pool.chainconfig.IsAccessList(ev.Block.Epoch()) {
+					pool.accessList = true
+				}
 				pool.reset(head.Header(), ev.Block.Header())
 				head = ev.Block
 				pool.mu.Unlock()
@@ -738,9 +746,16 @@ func (pool *TxPool) validateTx(tx types.PoolTransaction, local bool) error {
 	intrGas := uint64(0)
 	stakingTx, isStakingTx := tx.(*staking.StakingTransaction)
 	if isStakingTx {
-		intrGas, err = IntrinsicGas(tx.Data(), false, pool.homestead, stakingTx.StakingType() == staking.DirectiveCreateValidator)
+		intrGas, err = IntrinsicGas(tx.Data(), nil, false, pool.homestead, stakingTx.StakingType() == staking.DirectiveCreateValidator)
 	} else {
-		intrGas, err = IntrinsicGas(tx.Data(), tx.To() == nil, pool.homestead, false)
+		var accessList types.AccessList
+		if plainTx, ok := tx.(*types.Transaction); ok {
+			accessList = plainTx.AccessList()
+		}
+		if len(accessList) > 0 && !pool.accessList {
+			return ErrAccessListNotSupported
+		}
+		intrGas, err = IntrinsicGas(tx.Data(), accessList, tx.To() == nil, pool.homestead, false)
 	}
 	if err != nil {
 		return err
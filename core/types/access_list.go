@@ -0,0 +1,49 @@
+package types
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AccessList is an EIP-2930 access list: the accounts and storage slots a
+// transaction declares it is going to touch, which are warmed up before it
+// executes.
+type AccessList []AccessTuple
+
+// AccessTuple is the element type of an access list.
+type AccessTuple struct {
+	Address     common.Address `json:"address"     gencodec:"required"`
+	StorageKeys []common.Hash  `json:"storageKeys" gencodec:"required"`
+}
+
+// StorageKeys returns the total number of storage keys in the access list.
+func (al AccessList) StorageKeys() int {
+	sum := 0
+	for _, tuple := range al {
+		sum += len(tuple.StorageKeys)
+	}
+	return sum
+}
+
+// Copy makes a deep copy of the access list.
+func (al AccessList) Copy() AccessList {
+	if al == nil {
+		return nil
+	}
+	cpy := make(AccessList, len(al))
+	for i, tuple := range al {
+		cpy[i] = AccessTuple{
+			Address:     tuple.Address,
+			StorageKeys: append(tuple.StorageKeys[:0:0], tuple.StorageKeys...),
+		}
+	}
+	return cpy
+}
+
+// appendAccessList appends the tuples of al to the fields of a signing hash.
+// Transactions without an access list keep their legacy signing hash.
+func appendAccessList(fields []interface{}, al AccessList) []interface{} {
+	for _, tuple := range al {
+		fields = append(fields, tuple)
+	}
+	return fields
+}
@@ -57,6 +57,27 @@ func DeriveSha(list ...DerivableBase) common.Hash {
 	return trie.Hash()
 }
 
+// TrieHasher derives the same hash as DeriveSha from items that are added one
+// at a time, e.g. as they are produced. The zero value is ready to use.
+type TrieHasher struct {
+	keybuf bytes.Buffer
+	trie   trie.Trie
+	num    uint
+}
+
+// Add adds the item with the RLP encoding enc after the items added so far.
+func (h *TrieHasher) Add(enc []byte) {
+	h.keybuf.Reset()
+	rlp.Encode(&h.keybuf, h.num)
+	h.trie.Update(h.keybuf.Bytes(), enc)
+	h.num++
+}
+
+// Hash returns the hash of the trie of the items added so far.
+func (h *TrieHasher) Hash() common.Hash {
+	return h.trie.Hash()
+}
+
 //// Legacy forked logic. Keep as is, but do not use it anymore ->
 
 // DeriveOneShardSha calculates the hash of the trie of
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math/big"
 	"unsafe"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -56,6 +57,18 @@ type Receipt struct {
 	TxHash          common.Hash    `json:"transactionHash" gencodec:"required"`
 	ContractAddress common.Address `json:"contractAddress"`
 	GasUsed         uint64         `json:"gasUsed" gencodec:"required"`
+	// GasRefund is the part of the gas consumed during execution that was
+	// refunded, e.g. for clearing storage; GasUsed is net of it. It is set
+	// when the receipt is created, but neither hashed nor stored.
+	GasRefund uint64 `json:"gasRefund"`
+	// EffectiveGasPrice is the price per gas the transaction paid, see
+	// core.EffectiveGasPrice. It is set when the receipt is created, but
+	// neither hashed nor stored.
+	EffectiveGasPrice *big.Int `json:"effectiveGasPrice"`
+	// OpcodeGas is the gas consumed by each opcode, by name, if summing it up
+	// was enabled in debug mode when the receipt was created. It is neither
+	// hashed, stored nor marshaled to JSON.
+	OpcodeGas map[string]uint64 `json:"-"`
 }
 
 type receiptMarshaling struct {
@@ -63,6 +76,8 @@ type receiptMarshaling struct {
 	Status            hexutil.Uint64
 	CumulativeGasUsed hexutil.Uint64
 	GasUsed           hexutil.Uint64
+	GasRefund         hexutil.Uint64
+	EffectiveGasPrice *hexutil.Big
 }
 
 // receiptRLP is the consensus encoding of a receipt.
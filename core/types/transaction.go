@@ -109,6 +109,11 @@ type txdata struct {
 
 	// This is only used when marshaling to JSON.
 	Hash *common.Hash `json:"hash" rlp:"-"`
+
+	// AccessList is optional and must stay the last field: it is encoded as
+	// the trailing elements of the list, so that transactions without one
+	// keep their legacy encoding and hash.
+	AccessList AccessList `json:"accessList,omitempty" rlp:"tail"`
 }
 
 func copyAddr(addr *common.Address) *common.Address {
@@ -136,6 +141,7 @@ func (d *txdata) CopyFrom(d2 *txdata) {
 	d.Recipient = copyAddr(d2.Recipient)
 	d.Amount = new(big.Int).Set(d2.Amount)
 	d.Payload = append(d2.Payload[:0:0], d2.Payload...)
+	d.AccessList = d2.AccessList.Copy()
 	d.V = new(big.Int).Set(d2.V)
 	d.R = new(big.Int).Set(d2.R)
 	d.S = new(big.Int).Set(d2.S)
@@ -325,6 +331,21 @@ func (tx *Transaction) Nonce() uint64 {
 	return tx.data.AccountNonce
 }
 
+// AccessList returns the EIP-2930 access list of Transaction, if any.
+func (tx *Transaction) AccessList() AccessList {
+	return tx.data.AccessList
+}
+
+// WithAccessList returns an unsigned copy of the transaction carrying the
+// given access list. The copy has to be signed again.
+func (tx *Transaction) WithAccessList(al AccessList) *Transaction {
+	cpy := &Transaction{}
+	cpy.data.CopyFrom(&tx.data)
+	cpy.data.AccessList = al.Copy()
+	cpy.data.V, cpy.data.R, cpy.data.S = new(big.Int), new(big.Int), new(big.Int)
+	return cpy
+}
+
 // CheckNonce returns check nonce from Transaction.
 func (tx *Transaction) CheckNonce() bool {
 	return true
@@ -377,6 +398,7 @@ func (tx *Transaction) AsMessage(s Signer) (Message, error) {
 		amount:     tx.data.Amount,
 		data:       tx.data.Payload,
 		checkNonce: true,
+		accessList: tx.data.AccessList,
 	}
 
 	var err error
@@ -580,6 +602,7 @@ type Message struct {
 	checkNonce bool
 	blockNum   *big.Int
 	txType     TransactionType
+	accessList AccessList
 }
 
 // NewMessage returns new message.
@@ -665,6 +688,16 @@ func (m Message) BlockNum() *big.Int {
 	return m.blockNum
 }
 
+// AccessList returns the access list of the Message.
+func (m Message) AccessList() AccessList {
+	return m.accessList
+}
+
+// SetAccessList sets the access list of the Message.
+func (m *Message) SetAccessList(al AccessList) {
+	m.accessList = al
+}
+
 // RecentTxsStats is a recent transactions stats map tracking stats like BlockTxsCounts.
 type RecentTxsStats map[uint64]BlockTxsCounts
 
@@ -89,6 +89,14 @@ func Sender(signer Signer, tx *Transaction) (common.Address, error) {
 	return addr, nil
 }
 
+// CacheSender records from as the sender of tx derived by signer, without
+// verifying the signature of tx, so that Sender returns it instead of
+// deriving it. It must only be used with senders known to be valid, e.g.
+// ones recovered earlier from the same trusted transaction.
+func CacheSender(signer Signer, tx *Transaction, from common.Address) {
+	tx.from.Store(sigCache{signer: signer, from: from})
+}
+
 // Signer encapsulates transaction signature handling. Note that this interface is not a
 // stable API and may change at any time to accommodate new protocol rules.
 type Signer interface {
@@ -157,7 +165,7 @@ func (s EIP155Signer) SignatureValues(tx *Transaction, sig []byte) (R, S, V *big
 // Hash returns the hash to be signed by the sender.
 // It does not uniquely identify the transaction.
 func (s EIP155Signer) Hash(tx *Transaction) common.Hash {
-	return hash.FromRLP([]interface{}{
+	return hash.FromRLP(appendAccessList([]interface{}{
 		tx.data.AccountNonce,
 		tx.data.Price,
 		tx.data.GasLimit,
@@ -167,7 +175,7 @@ func (s EIP155Signer) Hash(tx *Transaction) common.Hash {
 		tx.data.Amount,
 		tx.data.Payload,
 		s.chainID, uint(0), uint(0),
-	})
+	}, tx.data.AccessList))
 }
 
 // HomesteadSigner implements TransactionInterface using the
@@ -215,7 +223,7 @@ func (fs FrontierSigner) SignatureValues(tx *Transaction, sig []byte) (r, s, v *
 // Hash returns the hash to be signed by the sender.
 // It does not uniquely identify the transaction.
 func (fs FrontierSigner) Hash(tx *Transaction) common.Hash {
-	return hash.FromRLP([]interface{}{
+	return hash.FromRLP(appendAccessList([]interface{}{
 		tx.data.AccountNonce,
 		tx.data.Price,
 		tx.data.GasLimit,
@@ -224,7 +232,7 @@ func (fs FrontierSigner) Hash(tx *Transaction) common.Hash {
 		tx.data.Recipient,
 		tx.data.Amount,
 		tx.data.Payload,
-	})
+	}, tx.data.AccessList))
 }
 
 // Sender returns the sender address of the given transaction.
@@ -20,10 +20,12 @@ import (
 	"crypto/ecdsa"
 	"encoding/json"
 	"math/big"
+	"sync/atomic"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 func defaultTestKey() (*ecdsa.PrivateKey, common.Address) {
@@ -133,3 +135,64 @@ func TestTransactionJSON(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the access list is encoded as trailing elements, so that
+// transactions without one keep their legacy encoding, and that it is covered
+// by the signature.
+func TestTransactionAccessListRLP(t *testing.T) {
+	key, from := defaultTestKey()
+	signer := NewEIP155Signer(common.Big1)
+	legacy, err := SignTx(
+		NewTransaction(0, common.Address{1}, 0, common.Big0, 1, common.Big2, nil),
+		signer, key,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := rlp.EncodeToBytes(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := []interface{}{
+		legacy.data.AccountNonce, legacy.data.Price, legacy.data.GasLimit,
+		legacy.data.ShardID, legacy.data.ToShardID, legacy.data.Recipient,
+		legacy.data.Amount, legacy.data.Payload,
+		legacy.data.V, legacy.data.R, legacy.data.S,
+	}
+	if want, _ := rlp.EncodeToBytes(fields); string(enc) != string(want) {
+		t.Fatalf("legacy encoding changed:\n got %x\nwant %x", enc, want)
+	}
+
+	al := AccessList{{
+		Address:     common.Address{1},
+		StorageKeys: []common.Hash{{1}, {2}},
+	}}
+	tx, err := SignTx(legacy.WithAccessList(al), signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Hash() == legacy.Hash() {
+		t.Error("access list does not change the transaction hash")
+	}
+	enc, err = rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Transaction
+	if err := rlp.DecodeBytes(enc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hash() != tx.Hash() || decoded.AccessList().StorageKeys() != 2 {
+		t.Errorf("access list lost in round trip: %v", decoded.AccessList())
+	}
+	if sender, err := Sender(signer, &decoded); err != nil || sender != from {
+		t.Errorf("wrong sender %x (%v), want %x", sender, err, from)
+	}
+
+	// The access list is signed: tampering with it changes the sender.
+	decoded.data.AccessList[0].StorageKeys[1] = common.Hash{3}
+	decoded.from = atomic.Value{}
+	if sender, _ := Sender(signer, &decoded); sender == from {
+		t.Error("access list is not covered by the signature")
+	}
+}
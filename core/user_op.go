@@ -0,0 +1,65 @@
+package core
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/core/vm"
+	"github.com/harmony-one/harmony/internal/params"
+)
+
+// UserOpValidation is the outcome of the validation phase of an ERC-4337
+// user operation, see ValidateUserOp.
+type UserOpValidation struct {
+	Valid   bool
+	GasUsed uint64 // gas used by the validation call, intrinsic gas included
+	// Result is the outcome of the validation call, with the data returned
+	// by the entry point, or its revert data if the operation is invalid.
+	Result *ExecutionResult
+}
+
+// ValidateUserOp runs the validation phase of a user operation, as a bundler
+// does before including it in a bundle, without executing the operation
+// itself. input is the call to the validation entry of the entry point
+// contract with the operation, e.g. an ABI-encoded simulateValidation call,
+// which is made from bundler with up to gas gas on top of statedb in the
+// block with the given header. The operation passes validation if the call
+// does not fail; an entry point reverting with its validation result even
+// for valid operations needs its revert data decoded from the result
+// instead.
+//
+// The gas is priced at the base fee of the block, if any, so bundler must be
+// able to pay for it, but the call is made on a copy of statedb, which is
+// left unmodified. An error is only returned if the call cannot be made at
+// all, e.g. because gas is below its intrinsic gas or bundler cannot pay for
+// it.
+func ValidateUserOp(
+	config *params.ChainConfig, bc ChainContext, statedb *state.DB,
+	header *block.Header, entryPoint, bundler common.Address,
+	input []byte, gas uint64,
+) (*UserOpValidation, error) {
+	gasPrice := new(big.Int)
+	if baseFee := header.BaseFee(); baseFee != nil {
+		gasPrice.Set(baseFee)
+	}
+	msg := types.NewMessage(
+		bundler, &entryPoint, 0, new(big.Int), gas, gasPrice, input, false,
+	)
+	coinbase := header.Coinbase()
+	context := NewEVMContext(msg, header, bc, &coinbase)
+	vmenv := vm.NewEVM(context, statedb.Copy(), config, vm.Config{})
+	result, gasUsed, _, err := applyMessage(
+		vmenv, msg, new(GasPool).AddGas(gas), bundler, true,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &UserOpValidation{
+		Valid:   !result.Failed(),
+		GasUsed: gasUsed,
+		Result:  result,
+	}, nil
+}
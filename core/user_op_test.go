@@ -0,0 +1,97 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/harmony-one/harmony/internal/params"
+	"github.com/pkg/errors"
+)
+
+func TestValidateUserOp(t *testing.T) {
+	header := newTestHeader(1)
+	statedb := newTestState()
+	var (
+		entryPoint = common.HexToAddress("0x1076")
+		bundler    = common.HexToAddress("0x1077")
+	)
+	// An entry point stub accepting operations whose first word is 1:
+	// PUSH1 0x01 PUSH1 0x00 SSTORE PUSH1 0x00 CALLDATALOAD PUSH1 0x01 EQ
+	// PUSH1 0x13 JUMPI PUSH1 0x00 PUSH1 0x00 REVERT JUMPDEST STOP
+	statedb.SetCode(entryPoint, common.FromHex("600160005560003560011460135760006000fd5b00"))
+	root := statedb.IntermediateRoot(true)
+	op := func(word int64) []byte {
+		return common.BigToHash(big.NewInt(word)).Bytes()
+	}
+
+	valid, err := ValidateUserOp(
+		params.TestChainConfig, nil, statedb, header, entryPoint, bundler, op(1), 100000,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid.Valid || valid.Result.Failed() {
+		t.Errorf("valid operation failed validation: %v", valid.Result.VMErr)
+	}
+	if valid.GasUsed <= params.TxGas || valid.GasUsed >= 100000 {
+		t.Errorf("validation used %d gas", valid.GasUsed)
+	}
+
+	invalid, err := ValidateUserOp(
+		params.TestChainConfig, nil, statedb, header, entryPoint, bundler, op(2), 100000,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invalid.Valid || !invalid.Result.Reverted() {
+		t.Errorf("invalid operation passed validation")
+	}
+	if invalid.GasUsed <= params.TxGas || invalid.GasUsed >= 100000 {
+		t.Errorf("rejected validation used %d gas", invalid.GasUsed)
+	}
+
+	if _, err := ValidateUserOp(
+		params.TestChainConfig, nil, statedb, header, entryPoint, bundler, op(1), params.TxGas,
+	); err == nil {
+		t.Error("validated an operation with less than its intrinsic gas")
+	}
+	if statedb.IntermediateRoot(true) != root {
+		t.Error("validating operations modified the state")
+	}
+}
+
+func TestValidateUserOpBaseFee(t *testing.T) {
+	baseFee := big.NewInt(2)
+	header := newTestHeader(1).With().BaseFee(baseFee).Header()
+	statedb := newTestState()
+	var (
+		entryPoint = common.HexToAddress("0x1088")
+		bundler    = common.HexToAddress("0x1089")
+		gas        = uint64(100000)
+	)
+	// STOP, accepting every operation.
+	statedb.SetCode(entryPoint, common.FromHex("00"))
+
+	_, err := ValidateUserOp(
+		params.TestChainConfig, nil, statedb, header, entryPoint, bundler, nil, gas,
+	)
+	if errors.Cause(err) != errInsufficientBalanceForGas {
+		t.Fatalf("bundler without funds: got error %v", err)
+	}
+
+	funds := new(big.Int).Mul(baseFee, new(big.Int).SetUint64(gas))
+	statedb.AddBalance(bundler, funds)
+	valid, err := ValidateUserOp(
+		params.TestChainConfig, nil, statedb, header, entryPoint, bundler, nil, gas,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid.Valid {
+		t.Errorf("valid operation failed validation: %v", valid.Result.VMErr)
+	}
+	if got := statedb.GetBalance(bundler); got.Cmp(funds) != 0 {
+		t.Errorf("bundler balance: got %v, want %v", got, funds)
+	}
+}
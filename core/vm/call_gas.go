@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CallGas is the gas a CALL, CALLCODE, DELEGATECALL or STATICCALL forwarded
+// to its callee, see Config.OnCallGas.
+type CallGas struct {
+	Type  OpCode
+	From  common.Address
+	To    common.Address
+	Depth int // call depth of the caller, 1 for the top level call
+	// Available is the gas the caller could have forwarded, once the
+	// call itself was paid for.
+	Available uint64
+	// Forwarded is the gas given to the callee, without the stipend of
+	// calls transferring value.
+	Forwarded uint64
+}
+
+// reportCallGas reports the gas the call of type typ from contract to to
+// forwards, which contract has already been charged for, to the configured
+// callback, if any.
+func (evm *EVM) reportCallGas(typ OpCode, contract *Contract, to common.Address, gas uint64) {
+	if evm.vmConfig.OnCallGas == nil {
+		return
+	}
+	evm.vmConfig.OnCallGas(CallGas{
+		Type:      typ,
+		From:      contract.Address(),
+		To:        to,
+		Depth:     evm.depth,
+		Available: contract.Gas + gas,
+		Forwarded: gas,
+	})
+}
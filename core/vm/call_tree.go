@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CallFrame is a call or contract creation made while executing a message,
+// with the ones it made in turn, see Config.CallTree.
+type CallFrame struct {
+	Type    OpCode // CALL, CALLCODE, DELEGATECALL, STATICCALL, CREATE or CREATE2
+	From    common.Address
+	To      common.Address // the created contract for CREATE and CREATE2
+	Value   *big.Int       // nil for DELEGATECALL and STATICCALL
+	Gas     uint64         // gas given to the frame
+	GasUsed uint64
+	Input   []byte // the init code for CREATE and CREATE2
+	Output  []byte // the return or revert data, or the code deployed
+	Error   error  // error the frame ended with, if any
+	Calls   []*CallFrame
+}
+
+// CallTree returns the frame of the top level call or contract creation
+// executed so far, or nil unless enabled in the configuration.
+func (evm *EVM) CallTree() *CallFrame {
+	return evm.callTree
+}
+
+// enterFrame records the start of a frame within the current one.
+func (evm *EVM) enterFrame(
+	typ OpCode, from, to common.Address, input []byte, gas uint64, value *big.Int,
+) {
+	frame := &CallFrame{
+		Type:  typ,
+		From:  from,
+		To:    to,
+		Gas:   gas,
+		Input: common.CopyBytes(input),
+	}
+	if value != nil {
+		frame.Value = new(big.Int).Set(value)
+	}
+	if n := len(evm.callFrames); n > 0 {
+		parent := evm.callFrames[n-1]
+		parent.Calls = append(parent.Calls, frame)
+	} else {
+		evm.callTree = frame
+	}
+	evm.callFrames = append(evm.callFrames, frame)
+}
+
+// exitFrame records the end of the current frame.
+func (evm *EVM) exitFrame(output []byte, gasUsed uint64, err error) {
+	n := len(evm.callFrames)
+	frame := evm.callFrames[n-1]
+	evm.callFrames = evm.callFrames[:n-1]
+	frame.Output = common.CopyBytes(output)
+	frame.GasUsed = gasUsed
+	frame.Error = err
+}
@@ -17,9 +17,11 @@
 package vm
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"math/big"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
@@ -59,6 +61,93 @@ var PrecompiledContractsByzantium = map[common.Address]PrecompiledContract{
 	common.BytesToAddress([]byte{8}): &bn256Pairing{},
 }
 
+// PrecompiledContractsModExpGas contains the pre-compiled contracts of the
+// Byzantium release, with MODEXP priced following EIP-2565.
+var PrecompiledContractsModExpGas = map[common.Address]PrecompiledContract{
+	common.BytesToAddress([]byte{1}): &ecrecover{},
+	common.BytesToAddress([]byte{2}): &sha256hash{},
+	common.BytesToAddress([]byte{3}): &ripemd160hash{},
+	common.BytesToAddress([]byte{4}): &dataCopy{},
+	common.BytesToAddress([]byte{5}): &bigModExp{eip2565: true},
+	common.BytesToAddress([]byte{6}): &bn256Add{},
+	common.BytesToAddress([]byte{7}): &bn256ScalarMul{},
+	common.BytesToAddress([]byte{8}): &bn256Pairing{},
+}
+
+// ActivePrecompiles returns the addresses of the precompiled contracts
+// enabled under the given rules, in ascending order.
+func ActivePrecompiles(rules params.Rules) []common.Address {
+	precompiles := PrecompiledContractsHomestead
+	if rules.IsS3 {
+		precompiles = PrecompiledContractsByzantium
+	}
+	addrs := make([]common.Address, 0, len(precompiles))
+	for i := 1; len(addrs) < len(precompiles); i++ {
+		addr := common.BytesToAddress([]byte{byte(i)})
+		if _, ok := precompiles[addr]; ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// precompiledContracts returns the precompiled contracts of the given epoch:
+// the built-in ones and the extra ones registered in chainConfig.
+func precompiledContracts(
+	chainConfig *params.ChainConfig, epoch *big.Int,
+) map[common.Address]PrecompiledContract {
+	precompiles := PrecompiledContractsHomestead
+	if chainConfig.IsS3(epoch) {
+		precompiles = PrecompiledContractsByzantium
+		if chainConfig.IsModExpGas(epoch) {
+			precompiles = PrecompiledContractsModExpGas
+		}
+	}
+	if len(chainConfig.ExtraPrecompiles) == 0 {
+		return precompiles
+	}
+	merged := make(
+		map[common.Address]PrecompiledContract,
+		len(precompiles)+len(chainConfig.ExtraPrecompiles),
+	)
+	for addr, p := range precompiles {
+		merged[addr] = p
+	}
+	for addr, p := range chainConfig.ExtraPrecompiles {
+		merged[addr] = p
+	}
+	return merged
+}
+
+// ActivePrecompiles returns the addresses of the precompiled contracts of the
+// EVM: the built-in ones of its epoch, then the extra ones registered in its
+// chain config in ascending order.
+func (evm *EVM) ActivePrecompiles() []common.Address {
+	addrs := ActivePrecompiles(evm.chainRules)
+	extra := make([]common.Address, 0, len(evm.chainConfig.ExtraPrecompiles))
+	for addr := range evm.chainConfig.ExtraPrecompiles {
+		extra = append(extra, addr)
+	}
+	sort.Slice(extra, func(i, j int) bool {
+		return bytes.Compare(extra[i][:], extra[j][:]) < 0
+	})
+	for _, addr := range extra {
+		if !containsAddress(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func containsAddress(addrs []common.Address, addr common.Address) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
 // RunPrecompiledContract runs and evaluates the output of a precompiled contract.
 func RunPrecompiledContract(p PrecompiledContract, input []byte, contract *Contract) (ret []byte, err error) {
 	gas := p.RequiredGas(input)
@@ -147,7 +236,9 @@ func (c *dataCopy) Run(in []byte) ([]byte, error) {
 }
 
 // bigModExp implements a native big integer exponential modular operation.
-type bigModExp struct{}
+type bigModExp struct {
+	eip2565 bool // price following EIP-2565 instead of EIP-198
+}
 
 var (
 	big1      = big.NewInt(1)
@@ -198,6 +289,9 @@ func (c *bigModExp) RequiredGas(input []byte) uint64 {
 	}
 	adjExpLen.Add(adjExpLen, big.NewInt(int64(msb)))
 
+	if c.eip2565 {
+		return modExpGasEIP2565(math.BigMax(modLen, baseLen), adjExpLen)
+	}
 	// Calculate the gas cost of the operation
 	gas := new(big.Int).Set(math.BigMax(modLen, baseLen))
 	switch {
@@ -223,6 +317,26 @@ func (c *bigModExp) RequiredGas(input []byte) uint64 {
 	return gas.Uint64()
 }
 
+// modExpGasEIP2565 returns the EIP-2565 price of a modular exponentiation
+// of operands up to maxLen bytes long with an adjusted exponent length of
+// adjExpLen.
+func modExpGasEIP2565(maxLen, adjExpLen *big.Int) uint64 {
+	// The multiplication complexity is the square of the number of words
+	words := new(big.Int).Add(maxLen, big.NewInt(7))
+	words.Div(words, big8)
+	gas := new(big.Int).Mul(words, words)
+	gas.Mul(gas, math.BigMax(adjExpLen, big1))
+	gas.Div(gas, new(big.Int).SetUint64(params.ModExpQuadCoeffDivEIP2565))
+
+	if gas.BitLen() > 64 {
+		return math.MaxUint64
+	}
+	if gas.Uint64() < params.ModExpMinGasEIP2565 {
+		return params.ModExpMinGasEIP2565
+	}
+	return gas.Uint64()
+}
+
 func (c *bigModExp) Run(input []byte) ([]byte, error) {
 	var (
 		baseLen = new(big.Int).SetBytes(getData(input, 0, 32)).Uint64()
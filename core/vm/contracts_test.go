@@ -432,6 +432,32 @@ func TestPrecompiledModExp(t *testing.T) {
 	}
 }
 
+// Tests the pricing of the sample inputs from the ModExp EIP 198 before and
+// after EIP-2565.
+func TestPrecompiledModExpGas(t *testing.T) {
+	tests := map[string][2]uint64{
+		"eip_example1":          {13056, 1360},
+		"nagydani-1-square":     {204, 200},
+		"nagydani-1-pow0x10001": {3276, 341},
+		"nagydani-3-square":     {1894, 341},
+		"nagydani-5-pow0x10001": {285900, 87381},
+	}
+	addr := common.BytesToAddress([]byte{5})
+	for _, test := range modexpTests {
+		want, ok := tests[test.name]
+		if !ok {
+			continue
+		}
+		in := common.Hex2Bytes(test.input)
+		if gas := PrecompiledContractsByzantium[addr].RequiredGas(in); gas != want[0] {
+			t.Errorf("%s: got %d gas, want %d", test.name, gas, want[0])
+		}
+		if gas := PrecompiledContractsModExpGas[addr].RequiredGas(in); gas != want[1] {
+			t.Errorf("%s: got %d gas after EIP-2565, want %d", test.name, gas, want[1])
+		}
+	}
+}
+
 // Benchmarks the sample inputs from the ModExp EIP 198.
 func BenchmarkPrecompiledModExp(bench *testing.B) {
 	for _, test := range modexpTests {
@@ -133,7 +133,7 @@ func gasSStore(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, m
 		case current == (common.Hash{}) && y.Sign() != 0: // 0 => non 0
 			return params.SstoreSetGas, nil
 		case current != (common.Hash{}) && y.Sign() == 0: // non 0 => 0
-			evm.StateDB.AddRefund(params.SstoreRefundGas)
+			evm.StateDB.AddRefund(sstoreClearRefund(evm, params.SstoreRefundGas))
 			return params.SstoreClearGas, nil
 		default: // non 0 => non 0 (or 0 => 0)
 			return params.SstoreResetGas, nil
@@ -163,15 +163,15 @@ func gasSStore(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, m
 			return params.NetSstoreInitGas, nil
 		}
 		if value == (common.Hash{}) { // delete slot (2.1.2b)
-			evm.StateDB.AddRefund(params.NetSstoreClearRefund)
+			evm.StateDB.AddRefund(sstoreClearRefund(evm, params.NetSstoreClearRefund))
 		}
 		return params.NetSstoreCleanGas, nil // write existing slot (2.1.2)
 	}
 	if original != (common.Hash{}) {
 		if current == (common.Hash{}) { // recreate slot (2.2.1.1)
-			evm.StateDB.SubRefund(params.NetSstoreClearRefund)
+			evm.StateDB.SubRefund(sstoreClearRefund(evm, params.NetSstoreClearRefund))
 		} else if value == (common.Hash{}) { // delete slot (2.2.1.2)
-			evm.StateDB.AddRefund(params.NetSstoreClearRefund)
+			evm.StateDB.AddRefund(sstoreClearRefund(evm, params.NetSstoreClearRefund))
 		}
 	}
 	if original == value {
@@ -184,6 +184,16 @@ func gasSStore(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, m
 	return params.NetSstoreDirtyGas, nil
 }
 
+// sstoreClearRefund returns the gas refunded for clearing a storage slot:
+// refund, the one of the metering in use, or the reduced one of EIP-3529
+// from RefundCapEpoch on.
+func sstoreClearRefund(evm *EVM, refund uint64) uint64 {
+	if evm.chainRules.IsRefundCap {
+		return params.SstoreClearRefundEIP3529
+	}
+	return refund
+}
+
 func makeGasLog(n uint64) gasFunc {
 	return func(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
 		requestedSize, overflow := bigUint64(stack.Back(1))
@@ -476,7 +486,8 @@ func gasSuicide(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack,
 		}
 	}
 
-	if !evm.StateDB.HasSuicided(contract.Address()) {
+	// SELFDESTRUCT refunds nothing from RefundCapEpoch on (EIP-3529).
+	if !evm.chainRules.IsRefundCap && !evm.StateDB.HasSuicided(contract.Address()) {
 		evm.StateDB.AddRefund(params.SuicideRefundGas)
 	}
 	return gas, nil
@@ -469,6 +469,46 @@ func TestOpMstore(t *testing.T) {
 	poolOfIntPools.put(evmInterpreter.intPool)
 }
 
+func TestOpBaseFee(t *testing.T) {
+	for _, baseFee := range []*big.Int{nil, big.NewInt(0), big.NewInt(7e9)} {
+		var (
+			env            = NewEVM(Context{BaseFee: baseFee}, nil, params.TestChainConfig, Config{})
+			stack          = newstack()
+			evmInterpreter = NewEVMInterpreter(env, env.vmConfig)
+		)
+		env.interpreter = evmInterpreter
+		evmInterpreter.intPool = poolOfIntPools.get()
+		pc := uint64(0)
+		opBaseFee(&pc, evmInterpreter, nil, nil, stack)
+		expected := new(big.Int)
+		if baseFee != nil {
+			expected.Set(baseFee)
+		}
+		if got := stack.pop(); got.Cmp(expected) != 0 {
+			t.Errorf("base fee %v: expected %v, got %v", baseFee, expected, got)
+		}
+		poolOfIntPools.put(evmInterpreter.intPool)
+	}
+}
+
+func TestBaseFeeInstructionSet(t *testing.T) {
+	config := *params.TestChainConfig
+	config.BaseFeeEpoch = big.NewInt(2)
+	for _, test := range []struct {
+		epoch int64
+		valid bool
+	}{{1, false}, {2, true}, {3, true}} {
+		env := NewEVM(Context{EpochNumber: big.NewInt(test.epoch)}, nil, &config, Config{})
+		evmInterpreter := NewEVMInterpreter(env, env.vmConfig)
+		if valid := evmInterpreter.cfg.JumpTable[BASEFEE].valid; valid != test.valid {
+			t.Errorf("epoch %d: BASEFEE valid = %v, expected %v", test.epoch, valid, test.valid)
+		}
+		if !evmInterpreter.cfg.JumpTable[SLOAD].valid {
+			t.Errorf("epoch %d: SLOAD not valid", test.epoch)
+		}
+	}
+}
+
 func BenchmarkOpMstore(bench *testing.B) {
 	var (
 		env            = NewEVM(Context{}, nil, params.TestChainConfig, Config{})
@@ -46,6 +46,28 @@ type Config struct {
 	EWASMInterpreter string
 	// Type of the EVM interpreter
 	EVMInterpreter string
+
+	// Interrupt, when set, makes the interpreter stop with
+	// ErrExecutionInterrupted as soon as it points to a non-zero value.
+	// The outcome of an interrupted execution must be discarded.
+	Interrupt *int32
+
+	// OpcodeGas enables summing up the gas consumed by each opcode, see
+	// EVM.OpcodeGas. It only takes effect in Debug mode.
+	OpcodeGas bool
+
+	// CallTree enables recording the calls and contract creations made by
+	// the execution, see EVM.CallTree.
+	CallTree bool
+
+	// OutOfGasPoint enables recording where the execution last ran out of
+	// gas, see EVM.OutOfGas. It only takes effect in Debug mode.
+	OutOfGasPoint bool
+
+	// OnCallGas, if set, is called with the gas every call forwards to its
+	// callee before the call is made, e.g. to spot contracts forwarding
+	// nearly all their gas. It must not modify the state.
+	OnCallGas func(CallGas)
 }
 
 // Interpreter is used to run Ethereum based contracts and will utilise the
@@ -109,7 +131,16 @@ func NewEVMInterpreter(evm *EVM, cfg Config) *EVMInterpreter {
 		//default:
 		//	cfg.JumpTable = frontierInstructionSet
 		//}
-		cfg.JumpTable = constantinopleInstructionSet
+		switch {
+		case evm.chainRules.IsAccessList && evm.chainRules.IsBaseFee:
+			cfg.JumpTable = accessListBaseFeeInstructionSet
+		case evm.chainRules.IsAccessList:
+			cfg.JumpTable = accessListInstructionSet
+		case evm.chainRules.IsBaseFee:
+			cfg.JumpTable = baseFeeInstructionSet
+		default:
+			cfg.JumpTable = constantinopleInstructionSet
+		}
 	}
 
 	return &EVMInterpreter{
@@ -140,7 +171,7 @@ func (in *EVMInterpreter) enforceRestrictions(op OpCode, operation operation, st
 //
 // It's important to note that any errors returned by the interpreter should be
 // considered a revert-and-consume-all-gas operation except for
-// errExecutionReverted which means revert-and-keep-gas-left.
+// ErrExecutionReverted which means revert-and-keep-gas-left.
 func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (ret []byte, err error) {
 	if in.intPool == nil {
 		in.intPool = poolOfIntPools.get()
@@ -205,6 +236,9 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 	// the execution of one of the operations or until the done flag is set by the
 	// parent context.
 	for atomic.LoadInt32(&in.evm.abort) == 0 {
+		if in.cfg.Interrupt != nil && atomic.LoadInt32(in.cfg.Interrupt) != 0 {
+			return nil, ErrExecutionInterrupted
+		}
 		if in.cfg.Debug {
 			// Capture pre-execution values for tracing.
 			logged, pcCopy, gasCopy = false, pc, contract.Gas
@@ -217,7 +251,7 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		if !operation.valid {
 			return nil, fmt.Errorf("invalid opcode 0x%x", int(op))
 		}
-		if err := operation.validateStack(stack); err != nil {
+		if err := operation.validateStack(stack, int(in.evm.chainRules.StackLimit)); err != nil {
 			return nil, err
 		}
 		// If the operation is valid, enforce and write restrictions
@@ -243,6 +277,15 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		// cost is explicitly set so that the capture state defer method can get the proper cost
 		cost, err = operation.gasCost(in.gasTable, in.evm, contract, stack, mem, memorySize)
 		if err != nil || !contract.UseGas(cost) {
+			if in.cfg.Debug && in.cfg.OutOfGasPoint {
+				in.evm.outOfGas = &OutOfGasPoint{
+					Contract: contract.Address(),
+					PC:       pc,
+					Op:       op,
+					Depth:    in.evm.depth,
+					GasLeft:  contract.Gas,
+				}
+			}
 			return nil, ErrOutOfGas
 		}
 		if memorySize > 0 {
@@ -253,6 +296,9 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 			in.cfg.Tracer.CaptureState(in.evm, pc, op, gasCopy, cost, mem, stack, contract, in.evm.depth, err)
 			logged = true
 		}
+		if in.evm.opcodeGas != nil {
+			in.evm.opcodeGas[op] += cost
+		}
 
 		// execute the operation
 		res, err := operation.execute(&pc, in, contract, mem, stack)
@@ -271,7 +317,7 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		case err != nil:
 			return nil, err
 		case operation.reverts:
-			return res, errExecutionReverted
+			return res, ErrExecutionReverted
 		case operation.halts:
 			return res, nil
 		case !operation.jumps:
@@ -26,7 +26,7 @@ import (
 type (
 	executionFunc       func(pc *uint64, interpreter *EVMInterpreter, contract *Contract, memory *Memory, stack *Stack) ([]byte, error)
 	gasFunc             func(params.GasTable, *EVM, *Contract, *Stack, *Memory, uint64) (uint64, error) // last parameter is the requested memory size as a uint64
-	stackValidationFunc func(*Stack) error
+	stackValidationFunc func(stack *Stack, limit int) error
 	memorySizeFunc      func(*Stack) *big.Int
 )
 
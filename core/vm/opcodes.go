@@ -103,6 +103,10 @@ const (
 	GASLIMIT
 )
 
+const (
+	BASEFEE OpCode = 0x48
+)
+
 // 0x50 range - 'storage' and execution.
 const (
 	POP OpCode = 0x50 + iota
@@ -277,6 +281,7 @@ var opCodeToString = map[OpCode]string{
 	NUMBER:     "NUMBER",
 	DIFFICULTY: "DIFFICULTY",
 	GASLIMIT:   "GASLIMIT",
+	BASEFEE:    "BASEFEE",
 
 	// 0x50 range - 'storage' and execution.
 	POP: "POP",
@@ -444,6 +449,7 @@ var stringToOp = map[string]OpCode{
 	"NUMBER":         NUMBER,
 	"DIFFICULTY":     DIFFICULTY,
 	"GASLIMIT":       GASLIMIT,
+	"BASEFEE":        BASEFEE,
 	"POP":            POP,
 	"MLOAD":          MLOAD,
 	"MSTORE":         MSTORE,
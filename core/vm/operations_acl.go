@@ -0,0 +1,151 @@
+package vm
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/harmony-one/harmony/internal/params"
+)
+
+const (
+	// coldSloadCost is the cost of the first access to a storage slot within
+	// a transaction on top of the warm access cost of the gas table.
+	coldSloadCost = params.ColdSloadCostEIP2929 - params.WarmStorageReadCostEIP2929
+	// coldAccountAccessCost is the cost of the first access to an account
+	// within a transaction on top of the warm access cost of the gas table.
+	coldAccountAccessCost = params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929
+)
+
+var (
+	accessListInstructionSet = newAccessListInstructionSet()
+)
+
+// newAccessListInstructionSet returns the constantinople instructions with
+// EIP-2929 access list gas accounting. Along with params.GasTableAccessList,
+// which reprices accesses to accounts and storage slots to the warm access
+// cost, the first access to a storage slot or to an account within a
+// transaction costs the cold access cost in total, while accesses to anything
+// warmed up beforehand, e.g. through the transaction's access list, cost the
+// warm access cost.
+func newAccessListInstructionSet() [256]operation {
+	instructionSet := newConstantinopleInstructionSet()
+	instructionSet[SLOAD].gasCost = gasSLoadEIP2929
+	instructionSet[SSTORE].gasCost = gasSStoreEIP2929
+	for _, op := range []OpCode{BALANCE, EXTCODESIZE, EXTCODECOPY, EXTCODEHASH} {
+		instructionSet[op].gasCost = makeAccountAccessGas(
+			instructionSet[op].gasCost, coldAccountAccessCost,
+		)
+	}
+	// SELFDESTRUCT has no warm access cost: a cold beneficiary costs the
+	// whole cold access cost on top of the regular cost.
+	instructionSet[SELFDESTRUCT].gasCost = makeAccountAccessGas(
+		instructionSet[SELFDESTRUCT].gasCost, params.ColdAccountAccessCostEIP2929,
+	)
+	for _, op := range []OpCode{CALL, CALLCODE, DELEGATECALL, STATICCALL} {
+		instructionSet[op].gasCost = makeCallAccessGas(instructionSet[op].gasCost)
+	}
+	return instructionSet
+}
+
+// accessSlot marks the storage slot of contract warm and returns coldCost if
+// it had not been accessed yet, or else nothing.
+func accessSlot(evm *EVM, contract *Contract, slot common.Hash, coldCost uint64) uint64 {
+	if _, slotPresent := evm.StateDB.SlotInAccessList(contract.Address(), slot); slotPresent {
+		return 0
+	}
+	evm.StateDB.AddSlotToAccessList(contract.Address(), slot)
+	return coldCost
+}
+
+// accessAccount marks the account warm and returns coldCost if it had not
+// been accessed yet, or else nothing.
+func accessAccount(evm *EVM, addr common.Address, coldCost uint64) uint64 {
+	if evm.StateDB.AddressInAccessList(addr) {
+		return 0
+	}
+	evm.StateDB.AddAddressToAccessList(addr)
+	return coldCost
+}
+
+// gasSLoadEIP2929 charges the warm access cost for the storage slot on top
+// of the stack, or the cold one if it has not been accessed yet.
+func gasSLoadEIP2929(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
+	cost := accessSlot(evm, contract, common.BigToHash(stack.Back(0)), coldSloadCost)
+	return gt.SLoad + cost, nil
+}
+
+// gasSStoreEIP2929 is gasSStore repriced by EIP-2929: the first access to
+// the slot within a transaction costs the whole cold access cost on top, and
+// writes that do not create the slot cost that much less. The net gas
+// metering, only in use before S3Epoch, is not repriced.
+func gasSStoreEIP2929(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
+	var (
+		y, x = stack.Back(1), stack.Back(0)
+		slot = common.BigToHash(x)
+		// A write has no warm access cost, so the cold one is charged in
+		// full.
+		cost = accessSlot(evm, contract, slot, params.ColdSloadCostEIP2929)
+	)
+	if !evm.chainRules.IsS3 {
+		gas, err := gasSStore(gt, evm, contract, stack, mem, memorySize)
+		if err != nil {
+			return 0, err
+		}
+		return gas + cost, nil
+	}
+	current := evm.StateDB.GetState(contract.Address(), slot)
+	switch {
+	case current == (common.Hash{}) && y.Sign() != 0: // 0 => non 0
+		return cost + params.SstoreSetGas, nil
+	case current != (common.Hash{}) && y.Sign() == 0: // non 0 => 0
+		evm.StateDB.AddRefund(sstoreClearRefund(evm, params.SstoreRefundGas))
+		return cost + params.SstoreClearGas - params.ColdSloadCostEIP2929, nil
+	default: // non 0 => non 0 (or 0 => 0)
+		return cost + params.SstoreResetGas - params.ColdSloadCostEIP2929, nil
+	}
+}
+
+// makeAccountAccessGas charges coldCost on top of gasFunc if the account on
+// top of the stack has not been accessed yet, and marks it warm.
+func makeAccountAccessGas(gasFunc gasFunc, coldCost uint64) gasFunc {
+	return func(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
+		gas, err := gasFunc(gt, evm, contract, stack, mem, memorySize)
+		if err != nil {
+			return 0, err
+		}
+		cost := accessAccount(evm, common.BigToAddress(stack.Back(0)), coldCost)
+		var overflow bool
+		if gas, overflow = math.SafeAdd(gas, cost); overflow {
+			return 0, errGasUintOverflow
+		}
+		return gas, nil
+	}
+}
+
+// makeCallAccessGas charges coldAccountAccessCost on top of gasFunc if the
+// callee has not been accessed yet, and marks it warm. The gas passed on to
+// the callee is then computed from the gas left after the cold access cost, so
+// that it is subject to the 63/64 rule just like the regular call cost.
+func makeCallAccessGas(gasFunc gasFunc) gasFunc {
+	return func(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
+		cost := accessAccount(evm, common.BigToAddress(stack.Back(1)), coldAccountAccessCost)
+		if cost > contract.Gas {
+			return 0, ErrOutOfGas
+		}
+		gas, err := gasFunc(gt, evm, contract, stack, mem, memorySize)
+		if err != nil || cost == 0 {
+			return gas, err
+		}
+		// gasFunc returns the regular call cost plus evm.callGasTemp, the gas
+		// passed on to the callee, which it computed from all the gas left.
+		base := gas - evm.callGasTemp
+		evm.callGasTemp, err = callGas(gt, contract.Gas-cost, base, stack.Back(0))
+		if err != nil {
+			return 0, err
+		}
+		var overflow bool
+		if gas, overflow = math.SafeAdd(base+cost, evm.callGasTemp); overflow {
+			return 0, errGasUintOverflow
+		}
+		return gas, nil
+	}
+}
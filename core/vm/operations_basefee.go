@@ -0,0 +1,18 @@
+package vm
+
+var (
+	baseFeeInstructionSet           = newBaseFeeInstructionSet(newConstantinopleInstructionSet())
+	accessListBaseFeeInstructionSet = newBaseFeeInstructionSet(newAccessListInstructionSet())
+)
+
+// newBaseFeeInstructionSet returns instructionSet with the BASEFEE opcode,
+// which pushes the base fee of the current block, enabled.
+func newBaseFeeInstructionSet(instructionSet [256]operation) [256]operation {
+	instructionSet[BASEFEE] = operation{
+		execute:       opBaseFee,
+		gasCost:       constGasFunc(GasQuickStep),
+		validateStack: makeStackFunc(0, 1),
+		valid:         true,
+	}
+	return instructionSet
+}
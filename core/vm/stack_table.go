@@ -18,18 +18,16 @@ package vm
 
 import (
 	"fmt"
-
-	"github.com/harmony-one/harmony/internal/params"
 )
 
 func makeStackFunc(pop, push int) stackValidationFunc {
-	return func(stack *Stack) error {
+	return func(stack *Stack, limit int) error {
 		if err := stack.require(pop); err != nil {
 			return err
 		}
 
-		if stack.len()+push-pop > int(params.StackLimit) {
-			return fmt.Errorf("stack limit reached %d (%d)", stack.len(), params.StackLimit)
+		if stack.len()+push-pop > limit {
+			return fmt.Errorf("stack limit reached %d (%d)", stack.len(), limit)
 		}
 		return nil
 	}
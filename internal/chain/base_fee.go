@@ -0,0 +1,77 @@
+package chain
+
+import (
+	"math/big"
+
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/consensus/engine"
+	"github.com/harmony-one/harmony/internal/params"
+	"github.com/pkg/errors"
+)
+
+// CalcBaseFee computes the EIP-1559 style base fee of the block of the given
+// epoch following parent, or nil if blocks of that epoch carry none. The first
+// block of BaseFeeEpoch starts at params.InitialBaseFee. From then on the base
+// fee rises when the parent used more than half of its gas limit, falls when
+// it used less, and changes by at most one eighth per block.
+func CalcBaseFee(
+	config *params.ChainConfig, parent *block.Header, epoch *big.Int,
+) *big.Int {
+	if !config.IsBaseFee(epoch) {
+		return nil
+	}
+	if !config.IsBaseFee(parent.Epoch()) {
+		return new(big.Int).SetUint64(params.InitialBaseFee)
+	}
+	var (
+		parentBaseFee = parent.BaseFee()
+		gasTarget     = parent.GasLimit() / params.ElasticityMultiplier
+		gasUsed       = parent.GasUsed()
+	)
+	if parentBaseFee == nil {
+		parentBaseFee = new(big.Int)
+	}
+	if gasUsed == gasTarget || gasTarget == 0 {
+		return parentBaseFee
+	}
+	// delta = parentBaseFee * |gasUsed - gasTarget| / gasTarget / 8
+	delta := new(big.Int)
+	if gasUsed > gasTarget {
+		delta.SetUint64(gasUsed - gasTarget)
+	} else {
+		delta.SetUint64(gasTarget - gasUsed)
+	}
+	delta.Mul(delta, parentBaseFee)
+	delta.Div(delta, new(big.Int).SetUint64(gasTarget))
+	delta.Div(delta, new(big.Int).SetUint64(params.BaseFeeChangeDenominator))
+	if gasUsed > gasTarget {
+		// A base fee of zero must be able to rise.
+		if delta.Sign() == 0 {
+			delta.SetUint64(1)
+		}
+		return delta.Add(parentBaseFee, delta)
+	}
+	baseFee := delta.Sub(parentBaseFee, delta)
+	if baseFee.Sign() < 0 {
+		baseFee.SetUint64(0)
+	}
+	return baseFee
+}
+
+// verifyBaseFee checks that header carries the base fee computed from its
+// parent, as the gas price of its transactions is checked against it and the
+// part of their fees it accounts for is burned.
+func verifyBaseFee(
+	config *params.ChainConfig, parent, header *block.Header,
+) error {
+	want := CalcBaseFee(config, parent, header.Epoch())
+	if want == nil {
+		return nil
+	}
+	if got := header.BaseFee(); got == nil || got.Cmp(want) != 0 {
+		return errors.Wrapf(
+			engine.ErrInvalidBaseFee, "have %v, want %v", got, want,
+		)
+	}
+	return nil
+}
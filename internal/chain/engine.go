@@ -27,11 +27,12 @@ import (
 )
 
 type engineImpl struct {
-	beacon engine.ChainReader
+	beacon  engine.ChainReader
+	rewards RewardDistributor // pays out rewards in place of the built-in scheme, if set
 }
 
 // Engine is an algorithm-agnostic consensus engine.
-var Engine = &engineImpl{nil}
+var Engine = &engineImpl{}
 
 func (e *engineImpl) Beaconchain() engine.ChainReader {
 	return e.beacon
@@ -91,6 +92,9 @@ func (e *engineImpl) VerifyHeader(chain engine.ChainReader, header *block.Header
 	if parentHeader == nil {
 		return engine.ErrUnknownAncestor
 	}
+	if err := verifyBaseFee(chain.Config(), parentHeader, header); err != nil {
+		return err
+	}
 	if seal {
 		if err := e.VerifySeal(chain, header); err != nil {
 			return err
@@ -291,13 +295,14 @@ func (e *engineImpl) Finalize(
 
 	// Accumulate block rewards and commit the final state root
 	// Header seems complete, assemble into a block and return
-	payout, err := AccumulateRewardsAndCountSigs(
-		chain, state, header, e.Beaconchain(),
-	)
+	payout, err := e.accumulateRewards(chain, state, header)
 	if err != nil {
 		return nil, nil, errors.New("cannot pay block reward")
 	}
 
+	// Burn the base fee portion of the transaction fees paid to the proposer
+	BurnBaseFee(chain.Config(), header, state, txs, receipts)
+
 	// Apply slashes
 	if isBeaconChain && inStakingEra && len(doubleSigners) > 0 {
 		if err := applySlashes(chain, header, state, doubleSigners); err != nil {
@@ -308,7 +313,7 @@ func (e *engineImpl) Finalize(
 	}
 
 	// Finalize the state root
-	header.SetRoot(state.IntermediateRoot(chain.Config().IsS3(header.Epoch())))
+	header.SetRoot(state.IntermediateRoot(chain.Config().IsStateClearing(header.Epoch())))
 	return types.NewBlock(header, txs, receipts, outcxs, incxs, stks), payout, nil
 }
 
@@ -408,17 +413,37 @@ func applySlashes(
 		sortedKeys = append(sortedKeys, key)
 	}
 
-	// Sort them so the slashes are always consistent
-	sort.SliceStable(sortedKeys, func(i, j int) bool {
-		if sortedKeys[i].shardID < sortedKeys[j].shardID {
-			return true
-		} else if sortedKeys[i].height < sortedKeys[j].height {
-			return true
-		} else if sortedKeys[i].viewID < sortedKeys[j].viewID {
-			return true
-		}
-		return false
-	})
+	// Sort them so the slashes are always consistent, whatever the order
+	// the map yields the groups in: by shard, height, view and epoch. Before
+	// SlashOrderEpoch they are sorted as they always were, by a comparator
+	// that is not a strict ordering, so that past blocks are finalized the
+	// same.
+	if chain.Config().IsSlashOrder(header.Epoch()) {
+		sort.Slice(sortedKeys, func(i, j int) bool {
+			a, b := sortedKeys[i], sortedKeys[j]
+			if a.shardID != b.shardID {
+				return a.shardID < b.shardID
+			}
+			if a.height != b.height {
+				return a.height < b.height
+			}
+			if a.viewID != b.viewID {
+				return a.viewID < b.viewID
+			}
+			return a.epoch < b.epoch
+		})
+	} else {
+		sort.SliceStable(sortedKeys, func(i, j int) bool {
+			if sortedKeys[i].shardID < sortedKeys[j].shardID {
+				return true
+			} else if sortedKeys[i].height < sortedKeys[j].height {
+				return true
+			} else if sortedKeys[i].viewID < sortedKeys[j].viewID {
+				return true
+			}
+			return false
+		})
+	}
 
 	// Do the slashing by groups in the sorted order
 	for _, key := range sortedKeys {
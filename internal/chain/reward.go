@@ -16,6 +16,7 @@ import (
 	"github.com/harmony-one/harmony/consensus/votepower"
 	"github.com/harmony-one/harmony/core/state"
 	"github.com/harmony-one/harmony/core/types"
+	"github.com/harmony-one/harmony/internal/params"
 	"github.com/harmony-one/harmony/internal/utils"
 	"github.com/harmony-one/harmony/shard"
 	"github.com/harmony-one/harmony/staking/availability"
@@ -442,3 +443,31 @@ func AccumulateRewardsAndCountSigs(
 
 	return network.NewPreStakingEraRewarded(totalAmount), nil
 }
+
+// BurnBaseFee burns the base fee portion of the fees paid by txs, whose
+// receipts are among receipts, by deducting it from the block proposer and
+// returns the amount burned. Before the staking era the full fee of a plain
+// transaction is credited to the proposer as it is applied; from then on all
+// fees are burned already, so nothing is deducted.
+func BurnBaseFee(
+	config *params.ChainConfig, header *block.Header, state *state.DB,
+	txs []*types.Transaction, receipts []*types.Receipt,
+) *big.Int {
+	baseFee := header.BaseFee()
+	if baseFee == nil || baseFee.Sign() == 0 || config.IsStaking(header.Epoch()) {
+		return new(big.Int)
+	}
+	plain := make(map[common.Hash]struct{}, len(txs))
+	for _, tx := range txs {
+		plain[tx.Hash()] = struct{}{}
+	}
+	gasUsed := new(big.Int)
+	for _, receipt := range receipts {
+		if _, ok := plain[receipt.TxHash]; ok {
+			gasUsed.Add(gasUsed, new(big.Int).SetUint64(receipt.GasUsed))
+		}
+	}
+	burned := gasUsed.Mul(gasUsed, baseFee)
+	state.SubBalance(header.Coinbase(), burned)
+	return burned
+}
@@ -0,0 +1,120 @@
+package chain
+
+import (
+	"math/big"
+
+	"github.com/harmony-one/harmony/block"
+	"github.com/harmony-one/harmony/consensus/engine"
+	"github.com/harmony-one/harmony/consensus/reward"
+	"github.com/harmony-one/harmony/core/state"
+	"github.com/harmony-one/harmony/shard"
+	"github.com/harmony-one/harmony/staking/network"
+	"github.com/pkg/errors"
+)
+
+// RewardDistributor pays out the rewards of blocks by rules of its own, e.g.
+// a fixed split among the committee of a sidechain, see
+// SetRewardDistributor.
+type RewardDistributor interface {
+	// DistributeRewards credits the rewards of the block with the given
+	// header to statedb, given the committee of the shard of the block in
+	// its epoch, and returns what was paid out.
+	DistributeRewards(
+		header *block.Header, statedb *state.DB, committee *shard.Committee,
+	) (reward.Reader, error)
+}
+
+// SetRewardDistributor sets the distributor Finalize pays out the rewards of
+// blocks with in place of the built-in scheme, which then neither pays out
+// rewards nor counts the signatures of validators; nil restores the built-in
+// scheme. As Finalize runs both when a block is proposed and when it is
+// validated, the payout is part of consensus: all nodes of a network must
+// set the same distributor. It must not be called while blocks are being
+// finalized.
+func (e *engineImpl) SetRewardDistributor(distributor RewardDistributor) {
+	e.rewards = distributor
+}
+
+// accumulateRewards pays out the rewards of the block with the given header
+// on top of state, by the distributor set with SetRewardDistributor if any,
+// or else by the reward schedule of the chain configuration if it has a
+// reward for the epoch of the block, or else by the built-in scheme, which
+// also counts the signatures of validators.
+func (e *engineImpl) accumulateRewards(
+	chain engine.ChainReader, state *state.DB, header *block.Header,
+) (reward.Reader, error) {
+	distributor := e.rewards
+	if distributor == nil {
+		if amount := chain.Config().ScheduledBlockReward(header.Epoch()); amount != nil {
+			distributor = scheduledRewards{amount}
+		}
+	}
+	if distributor == nil {
+		return AccumulateRewardsAndCountSigs(
+			chain, state, header, e.Beaconchain(),
+		)
+	}
+	if header.Number().Sign() == 0 {
+		// genesis block has no parent to reward.
+		return network.EmptyPayout, nil
+	}
+	return distributeRewards(distributor, chain, header, state)
+}
+
+// scheduledRewards splits a block reward of the reward schedule of a chain
+// configuration evenly among the slots of the committee of the block, see
+// params.ChainConfig.RewardSchedule.
+type scheduledRewards struct {
+	amount *big.Int
+}
+
+// DistributeRewards pays every slot of committee its share of the block
+// reward, the remainder of the split going to the last slots.
+func (d scheduledRewards) DistributeRewards(
+	header *block.Header, statedb *state.DB, committee *shard.Committee,
+) (reward.Reader, error) {
+	var (
+		payouts = []reward.Payout{}
+		count   = big.NewInt(int64(len(committee.Slots)))
+		paid    = big.NewInt(0)
+	)
+	for i, slot := range committee.Slots {
+		// The share of the slots so far minus what was paid out before.
+		share := new(big.Int).Mul(d.amount, big.NewInt(int64(i+1)))
+		share.Div(share, count).Sub(share, paid)
+		paid.Add(paid, share)
+		statedb.AddBalance(slot.EcdsaAddress, share)
+		payouts = append(payouts, reward.Payout{
+			ShardID:     committee.ShardID,
+			Addr:        slot.EcdsaAddress,
+			NewlyEarned: share,
+			EarningKey:  slot.BLSPublicKey,
+		})
+	}
+	return network.NewStakingEraRewardForRound(paid, nil, nil, payouts), nil
+}
+
+// distributeRewards has distributor pay out the rewards of the block with the
+// given header of chain on top of statedb.
+func distributeRewards(
+	distributor RewardDistributor, chain engine.ChainReader,
+	header *block.Header, statedb *state.DB,
+) (reward.Reader, error) {
+	shardState, err := chain.ReadShardState(header.Epoch())
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "cannot read the shard state of epoch %v", header.Epoch(),
+		)
+	}
+	committee, err := shardState.FindCommitteeByID(header.ShardID())
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "cannot find the committee of shard %d", header.ShardID(),
+		)
+	}
+	payout, err := distributor.DistributeRewards(header, statedb, committee)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot distribute rewards")
+	}
+	return payout, nil
+}
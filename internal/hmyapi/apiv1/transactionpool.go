@@ -311,10 +311,12 @@ func (s *PublicTransactionPoolAPI) GetTransactionReceipt(ctx context.Context, ha
 		if err = s.fillTransactionFields(tx, fields); err != nil {
 			return nil, err
 		}
+		fields["effectiveGasPrice"] = (*hexutil.Big)(core.EffectiveGasPrice(tx.GasPrice()))
 	} else { // stx not nil
 		if err = s.fillStakingTransactionFields(stx, fields); err != nil {
 			return nil, err
 		}
+		fields["effectiveGasPrice"] = (*hexutil.Big)(core.EffectiveGasPrice(stx.GasPrice()))
 	}
 	// Assign receipt status or post state.
 	if len(receipt.PostState) > 0 {
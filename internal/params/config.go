@@ -25,83 +25,161 @@ var EpochTBD = big.NewInt(10000000)
 var (
 	// MainnetChainConfig is the chain parameters to run a node on the main network.
 	MainnetChainConfig = &ChainConfig{
-		ChainID:          MainnetChainID,
-		CrossTxEpoch:     big.NewInt(28),
-		CrossLinkEpoch:   big.NewInt(186),
-		StakingEpoch:     big.NewInt(186),
-		PreStakingEpoch:  big.NewInt(185),
-		QuickUnlockEpoch: big.NewInt(191),
-		EIP155Epoch:      big.NewInt(28),
-		S3Epoch:          big.NewInt(28),
-		ReceiptLogEpoch:  big.NewInt(101),
+		ChainID:            MainnetChainID,
+		CrossTxEpoch:       big.NewInt(28),
+		CrossLinkEpoch:     big.NewInt(186),
+		StakingEpoch:       big.NewInt(186),
+		PreStakingEpoch:    big.NewInt(185),
+		QuickUnlockEpoch:   big.NewInt(191),
+		EIP155Epoch:        big.NewInt(28),
+		S3Epoch:            big.NewInt(28),
+		ReceiptLogEpoch:    big.NewInt(101),
+		AccessListEpoch:    EpochTBD,
+		CXReplayEpoch:      EpochTBD,
+		BaseFeeEpoch:       EpochTBD,
+		FeeDelegationEpoch: EpochTBD,
+		VMLimitsEpoch:      EpochTBD,
+		VRFEpoch:           EpochTBD,
+		RefundCapEpoch:     EpochTBD,
+		CallStipendEpoch:   EpochTBD,
+		CodeSizeLimitEpoch: EpochTBD,
+		MinGasPriceEpoch:   EpochTBD,
+		ModExpGasEpoch:     EpochTBD,
+		StateClearingEpoch: big.NewInt(28),
+		SlashOrderEpoch:    EpochTBD,
 	}
 
 	// TestnetChainConfig contains the chain parameters to run a node on the harmony test network.
 	TestnetChainConfig = &ChainConfig{
-		ChainID:          TestnetChainID,
-		CrossTxEpoch:     big.NewInt(0),
-		CrossLinkEpoch:   big.NewInt(2),
-		StakingEpoch:     big.NewInt(2),
-		PreStakingEpoch:  big.NewInt(1),
-		QuickUnlockEpoch: big.NewInt(0),
-		EIP155Epoch:      big.NewInt(0),
-		S3Epoch:          big.NewInt(0),
-		ReceiptLogEpoch:  big.NewInt(0),
+		ChainID:            TestnetChainID,
+		CrossTxEpoch:       big.NewInt(0),
+		CrossLinkEpoch:     big.NewInt(2),
+		StakingEpoch:       big.NewInt(2),
+		PreStakingEpoch:    big.NewInt(1),
+		QuickUnlockEpoch:   big.NewInt(0),
+		EIP155Epoch:        big.NewInt(0),
+		S3Epoch:            big.NewInt(0),
+		ReceiptLogEpoch:    big.NewInt(0),
+		AccessListEpoch:    EpochTBD,
+		CXReplayEpoch:      EpochTBD,
+		BaseFeeEpoch:       EpochTBD,
+		FeeDelegationEpoch: EpochTBD,
+		VMLimitsEpoch:      EpochTBD,
+		VRFEpoch:           EpochTBD,
+		RefundCapEpoch:     EpochTBD,
+		CallStipendEpoch:   EpochTBD,
+		CodeSizeLimitEpoch: EpochTBD,
+		MinGasPriceEpoch:   EpochTBD,
+		ModExpGasEpoch:     EpochTBD,
+		StateClearingEpoch: big.NewInt(0),
+		SlashOrderEpoch:    EpochTBD,
 	}
 
 	// PangaeaChainConfig contains the chain parameters for the Pangaea network.
 	// All features except for CrossLink are enabled at launch.
 	PangaeaChainConfig = &ChainConfig{
-		ChainID:          PangaeaChainID,
-		CrossTxEpoch:     big.NewInt(0),
-		CrossLinkEpoch:   big.NewInt(2),
-		StakingEpoch:     big.NewInt(2),
-		PreStakingEpoch:  big.NewInt(1),
-		QuickUnlockEpoch: big.NewInt(0),
-		EIP155Epoch:      big.NewInt(0),
-		S3Epoch:          big.NewInt(0),
-		ReceiptLogEpoch:  big.NewInt(0),
+		ChainID:            PangaeaChainID,
+		CrossTxEpoch:       big.NewInt(0),
+		CrossLinkEpoch:     big.NewInt(2),
+		StakingEpoch:       big.NewInt(2),
+		PreStakingEpoch:    big.NewInt(1),
+		QuickUnlockEpoch:   big.NewInt(0),
+		EIP155Epoch:        big.NewInt(0),
+		S3Epoch:            big.NewInt(0),
+		ReceiptLogEpoch:    big.NewInt(0),
+		AccessListEpoch:    EpochTBD,
+		CXReplayEpoch:      EpochTBD,
+		BaseFeeEpoch:       EpochTBD,
+		FeeDelegationEpoch: EpochTBD,
+		VMLimitsEpoch:      EpochTBD,
+		VRFEpoch:           EpochTBD,
+		RefundCapEpoch:     EpochTBD,
+		CallStipendEpoch:   EpochTBD,
+		CodeSizeLimitEpoch: EpochTBD,
+		MinGasPriceEpoch:   EpochTBD,
+		ModExpGasEpoch:     EpochTBD,
+		StateClearingEpoch: big.NewInt(0),
+		SlashOrderEpoch:    EpochTBD,
 	}
 
 	// PartnerChainConfig contains the chain parameters for the Partner network.
 	// All features except for CrossLink are enabled at launch.
 	PartnerChainConfig = &ChainConfig{
-		ChainID:          PartnerChainID,
-		CrossTxEpoch:     big.NewInt(0),
-		CrossLinkEpoch:   big.NewInt(2),
-		StakingEpoch:     big.NewInt(2),
-		PreStakingEpoch:  big.NewInt(1),
-		QuickUnlockEpoch: big.NewInt(0),
-		EIP155Epoch:      big.NewInt(0),
-		S3Epoch:          big.NewInt(0),
-		ReceiptLogEpoch:  big.NewInt(0),
+		ChainID:            PartnerChainID,
+		CrossTxEpoch:       big.NewInt(0),
+		CrossLinkEpoch:     big.NewInt(2),
+		StakingEpoch:       big.NewInt(2),
+		PreStakingEpoch:    big.NewInt(1),
+		QuickUnlockEpoch:   big.NewInt(0),
+		EIP155Epoch:        big.NewInt(0),
+		S3Epoch:            big.NewInt(0),
+		ReceiptLogEpoch:    big.NewInt(0),
+		AccessListEpoch:    EpochTBD,
+		CXReplayEpoch:      EpochTBD,
+		BaseFeeEpoch:       EpochTBD,
+		FeeDelegationEpoch: EpochTBD,
+		VMLimitsEpoch:      EpochTBD,
+		VRFEpoch:           EpochTBD,
+		RefundCapEpoch:     EpochTBD,
+		CallStipendEpoch:   EpochTBD,
+		CodeSizeLimitEpoch: EpochTBD,
+		MinGasPriceEpoch:   EpochTBD,
+		ModExpGasEpoch:     EpochTBD,
+		StateClearingEpoch: big.NewInt(0),
+		SlashOrderEpoch:    EpochTBD,
 	}
 
 	// StressnetChainConfig contains the chain parameters for the Stress test network.
 	// All features except for CrossLink are enabled at launch.
 	StressnetChainConfig = &ChainConfig{
-		ChainID:          StressnetChainID,
-		CrossTxEpoch:     big.NewInt(0),
-		CrossLinkEpoch:   big.NewInt(2),
-		StakingEpoch:     big.NewInt(2),
-		PreStakingEpoch:  big.NewInt(1),
-		QuickUnlockEpoch: big.NewInt(0),
-		EIP155Epoch:      big.NewInt(0),
-		S3Epoch:          big.NewInt(0),
-		ReceiptLogEpoch:  big.NewInt(0),
+		ChainID:            StressnetChainID,
+		CrossTxEpoch:       big.NewInt(0),
+		CrossLinkEpoch:     big.NewInt(2),
+		StakingEpoch:       big.NewInt(2),
+		PreStakingEpoch:    big.NewInt(1),
+		QuickUnlockEpoch:   big.NewInt(0),
+		EIP155Epoch:        big.NewInt(0),
+		S3Epoch:            big.NewInt(0),
+		ReceiptLogEpoch:    big.NewInt(0),
+		AccessListEpoch:    EpochTBD,
+		CXReplayEpoch:      EpochTBD,
+		BaseFeeEpoch:       EpochTBD,
+		FeeDelegationEpoch: EpochTBD,
+		VMLimitsEpoch:      EpochTBD,
+		VRFEpoch:           EpochTBD,
+		RefundCapEpoch:     EpochTBD,
+		CallStipendEpoch:   EpochTBD,
+		CodeSizeLimitEpoch: EpochTBD,
+		MinGasPriceEpoch:   EpochTBD,
+		ModExpGasEpoch:     EpochTBD,
+		StateClearingEpoch: big.NewInt(0),
+		SlashOrderEpoch:    EpochTBD,
 	}
 
 	// LocalnetChainConfig contains the chain parameters to run for local development.
 	LocalnetChainConfig = &ChainConfig{
-		ChainID:          TestnetChainID,
-		CrossTxEpoch:     big.NewInt(0),
-		CrossLinkEpoch:   big.NewInt(2),
-		StakingEpoch:     big.NewInt(2),
-		PreStakingEpoch:  big.NewInt(0),
-		QuickUnlockEpoch: big.NewInt(0),
-		EIP155Epoch:      big.NewInt(0),
-		S3Epoch:          big.NewInt(0),
-		ReceiptLogEpoch:  big.NewInt(0),
+		ChainID:            TestnetChainID,
+		CrossTxEpoch:       big.NewInt(0),
+		CrossLinkEpoch:     big.NewInt(2),
+		StakingEpoch:       big.NewInt(2),
+		PreStakingEpoch:    big.NewInt(0),
+		QuickUnlockEpoch:   big.NewInt(0),
+		EIP155Epoch:        big.NewInt(0),
+		S3Epoch:            big.NewInt(0),
+		ReceiptLogEpoch:    big.NewInt(0),
+		AccessListEpoch:    EpochTBD,
+		CXReplayEpoch:      EpochTBD,
+		BaseFeeEpoch:       EpochTBD,
+		FeeDelegationEpoch: EpochTBD,
+		VMLimitsEpoch:      EpochTBD,
+		VRFEpoch:           EpochTBD,
+		RefundCapEpoch:     EpochTBD,
+		CallStipendEpoch:   EpochTBD,
+		CodeSizeLimitEpoch: EpochTBD,
+		MinGasPriceEpoch:   EpochTBD,
+		ModExpGasEpoch:     EpochTBD,
+		StateClearingEpoch: big.NewInt(0),
+		SlashOrderEpoch:    EpochTBD,
 	}
 
 	// AllProtocolChanges ...
@@ -117,6 +195,28 @@ var (
 		big.NewInt(0),             // EIP155Epoch
 		big.NewInt(0),             // S3Epoch
 		big.NewInt(0),             // ReceiptLogEpoch
+		big.NewInt(0),             // AccessListEpoch
+		big.NewInt(0),             // CXReplayEpoch
+		big.NewInt(0),             // BaseFeeEpoch
+		big.NewInt(0),             // FeeDelegationEpoch
+		big.NewInt(0),             // VMLimitsEpoch
+		big.NewInt(0),             // VRFEpoch
+		big.NewInt(0),             // RefundCapEpoch
+		big.NewInt(0),             // CallStipendEpoch
+		big.NewInt(0),             // CodeSizeLimitEpoch
+		big.NewInt(0),             // MinGasPriceEpoch
+		big.NewInt(0),             // ModExpGasEpoch
+		big.NewInt(0),             // StateClearingEpoch
+		big.NewInt(0),             // SlashOrderEpoch
+		0,                         // MaxCXReceiptsPerShard
+		0,                         // MaxCallDepth
+		0,                         // MaxStackSize
+		0,                         // CallStipend
+		0,                         // MaxCodeSize
+		nil,                       // MinGasPrices
+		nil,                       // RewardSchedule
+		nil,                       // ExtraPrecompiles
+		nil,                       // StateRoot
 	}
 
 	// TestChainConfig ...
@@ -132,6 +232,28 @@ var (
 		big.NewInt(0), // EIP155Epoch
 		big.NewInt(0), // S3Epoch
 		big.NewInt(0), // ReceiptLogEpoch
+		big.NewInt(0), // AccessListEpoch
+		big.NewInt(0), // CXReplayEpoch
+		big.NewInt(0), // BaseFeeEpoch
+		big.NewInt(0), // FeeDelegationEpoch
+		big.NewInt(0), // VMLimitsEpoch
+		big.NewInt(0), // VRFEpoch
+		big.NewInt(0), // RefundCapEpoch
+		big.NewInt(0), // CallStipendEpoch
+		big.NewInt(0), // CodeSizeLimitEpoch
+		big.NewInt(0), // MinGasPriceEpoch
+		big.NewInt(0), // ModExpGasEpoch
+		big.NewInt(0), // StateClearingEpoch
+		big.NewInt(0), // SlashOrderEpoch
+		0,             // MaxCXReceiptsPerShard
+		0,             // MaxCallDepth
+		0,             // MaxStackSize
+		0,             // CallStipend
+		0,             // MaxCodeSize
+		nil,           // MinGasPrices
+		nil,           // RewardSchedule
+		nil,           // ExtraPrecompiles
+		nil,           // StateRoot
 	}
 
 	// TestRules ...
@@ -184,6 +306,147 @@ type ChainConfig struct {
 
 	// ReceiptLogEpoch is the first epoch support receiptlog
 	ReceiptLogEpoch *big.Int `json:"receipt-log-epoch,omitempty"`
+
+	// AccessListEpoch is the first epoch where transactions may carry an
+	// EIP-2930 access list and the first access to accounts and storage slots
+	// is charged as cold (EIP-2929)
+	AccessListEpoch *big.Int `json:"access-list-epoch,omitempty"`
+
+	// CXReplayEpoch is the first epoch where the incoming cross-shard
+	// receipts applied to a shard are recorded in its state, and applying one
+	// again is rejected. Receipts applied before are not recorded, so
+	// existing state needs no migration, but they remain protected from
+	// replay only by the spent receipts kept in the database.
+	CXReplayEpoch *big.Int `json:"cx-replay-epoch,omitempty"`
+
+	// BaseFeeEpoch is the first epoch whose headers carry an EIP-1559 style
+	// base fee, exposed to contracts through the BASEFEE opcode. The base fee
+	// portion of the transaction fees is burned instead of being paid out.
+	BaseFeeEpoch *big.Int `json:"base-fee-epoch,omitempty"`
+
+	// FeeDelegationEpoch is the first epoch where the gas of a transaction
+	// may be paid by an account other than its sender, see
+	// core.ApplyTransactionWithFeePayer.
+	FeeDelegationEpoch *big.Int `json:"fee-delegation-epoch,omitempty"`
+
+	// VMLimitsEpoch is the first epoch where the EVM enforces MaxCallDepth
+	// and MaxStackSize instead of the protocol defaults.
+	VMLimitsEpoch *big.Int `json:"vm-limits-epoch,omitempty"`
+
+	// VRFEpoch is the first epoch where the DIFFICULTY opcode returns the
+	// VRF output of the block instead of zero, like PREVRANDAO.
+	VRFEpoch *big.Int `json:"vrf-epoch,omitempty"`
+
+	// RefundCapEpoch is the first epoch where refunds follow EIP-3529: the
+	// gas refunded to a transaction is capped to a fifth of the gas it used
+	// instead of half of it, SELFDESTRUCT refunds nothing and clearing a
+	// storage slot refunds SstoreClearRefundEIP3529.
+	RefundCapEpoch *big.Int `json:"refund-cap-epoch,omitempty"`
+
+	// CallStipendEpoch is the first epoch where calls transferring value
+	// are given CallStipend gas for free instead of the protocol default.
+	CallStipendEpoch *big.Int `json:"call-stipend-epoch,omitempty"`
+
+	// CodeSizeLimitEpoch is the first epoch where the code of contracts is
+	// limited to MaxCodeSize bytes instead of the EIP-170 limit.
+	CodeSizeLimitEpoch *big.Int `json:"code-size-limit-epoch,omitempty"`
+
+	// MinGasPriceEpoch is the first epoch where transactions priced below
+	// the minimum gas price of their shard in MinGasPrices are rejected.
+	MinGasPriceEpoch *big.Int `json:"min-gas-price-epoch,omitempty"`
+
+	// ModExpGasEpoch is the first epoch where the MODEXP precompile is
+	// priced following EIP-2565 instead of EIP-198.
+	ModExpGasEpoch *big.Int `json:"modexp-gas-epoch,omitempty"`
+
+	// StateClearingEpoch is the first epoch where the state is cleared of
+	// empty accounts following EIP-161: the accounts left empty by a
+	// transaction or an incoming cross-shard receipt are deleted, and calls
+	// transferring no value to a missing account do not create it. If nil,
+	// the state is cleared from S3Epoch on.
+	StateClearingEpoch *big.Int `json:"state-clearing-epoch,omitempty"`
+
+	// SlashOrderEpoch is the first epoch where the slashes of a block are
+	// applied by the groups of their signed blocks in a total order: by
+	// shard, height, view and epoch. Before it the groups are sorted by a
+	// comparator that is not a strict ordering, as they always were.
+	SlashOrderEpoch *big.Int `json:"slash-order-epoch,omitempty"`
+
+	// MaxCXReceiptsPerShard caps the number of cross-shard receipts a block
+	// may send to a single destination shard; 0 means no cap.
+	MaxCXReceiptsPerShard uint64 `json:"max-cx-receipts-per-shard,omitempty"`
+
+	// MaxCallDepth is the maximum depth of the EVM call/create stack from
+	// VMLimitsEpoch on; 0 keeps CallCreateDepth.
+	MaxCallDepth uint64 `json:"max-call-depth,omitempty"`
+
+	// MaxStackSize is the maximum size of the EVM stack from VMLimitsEpoch
+	// on; 0 keeps StackLimit.
+	MaxStackSize uint64 `json:"max-stack-size,omitempty"`
+
+	// CallStipend is the gas given for free to calls transferring value from
+	// CallStipendEpoch on; 0 keeps the protocol default. The part of it the
+	// callee does not use is returned to the caller, so it should not
+	// exceed the CallValueTransferGas the caller is charged.
+	CallStipend uint64 `json:"call-stipend,omitempty"`
+
+	// MaxCodeSize is the maximum size of the code of a contract from
+	// CodeSizeLimitEpoch on; 0 keeps the EIP-170 limit.
+	MaxCodeSize uint64 `json:"max-code-size,omitempty"`
+
+	// MinGasPrices are the minimum gas prices of transactions by shard from
+	// MinGasPriceEpoch on; shards without one accept any gas price.
+	MinGasPrices map[uint32]*big.Int `json:"min-gas-prices,omitempty"`
+
+	// RewardSchedule, if set, is the block reward by epoch, split evenly
+	// among the committee of the shard of each block by the consensus
+	// engine in place of its built-in reward scheme, e.g. for reward
+	// experiments on test networks. Its tiers are ordered by epoch; epochs
+	// before the first one keep the built-in scheme.
+	RewardSchedule []RewardTier `json:"reward-schedule,omitempty"`
+
+	// ExtraPrecompiles are precompiled contracts available in addition to
+	// the built-in ones of the epoch, e.g. for private deployments. They
+	// replace built-in contracts at the same address.
+	ExtraPrecompiles map[common.Address]PrecompiledContract `json:"-"`
+
+	// StateRoot, if set, settles the state after each transaction in place
+	// of the rule S3Epoch selects, e.g. to try out a new rule on
+	// experimental epochs.
+	StateRoot StateRootStrategy `json:"-"`
+}
+
+// RewardTier is the block reward of the epochs of a RewardSchedule from
+// Epoch on, up to the epoch of the next tier.
+type RewardTier struct {
+	Epoch       *big.Int `json:"epoch"`
+	BlockReward *big.Int `json:"block-reward"`
+}
+
+// PrecompiledContract is a native contract that can be registered in
+// ChainConfig.ExtraPrecompiles. It is the same as vm.PrecompiledContract,
+// which cannot be referred to here.
+type PrecompiledContract interface {
+	RequiredGas(input []byte) uint64  // RequiredPrice calculates the contract gas use
+	Run(input []byte) ([]byte, error) // Run runs the precompiled contract
+}
+
+// StateRootStrategy settles the pending changes of the state after each
+// transaction of a block, see ChainConfig.StateRoot.
+type StateRootStrategy interface {
+	// SettleState settles the pending changes of statedb after a transaction
+	// of a block of the given epoch of a chain with the given configuration,
+	// deleting empty accounts if config.IsStateClearing(epoch), and returns
+	// the intermediate state root to record in its receipt, or nil to record
+	// none.
+	SettleState(config *ChainConfig, epoch *big.Int, statedb StateSettler) []byte
+}
+
+// StateSettler is the part of core/state.DB a StateRootStrategy uses, which
+// cannot be referred to here.
+type StateSettler interface {
+	Finalise(deleteEmptyObjects bool)
+	IntermediateRoot(deleteEmptyObjects bool) common.Hash
 }
 
 // String implements the fmt.Stringer interface.
@@ -253,7 +516,144 @@ func (c *ChainConfig) IsReceiptLog(epoch *big.Int) bool {
 	return isForked(c.ReceiptLogEpoch, epoch)
 }
 
-// GasTable returns the gas table corresponding to the current phase (homestead or homestead reprice).
+// IsAccessList returns whether epoch is either equal to the AccessList fork epoch or greater.
+func (c *ChainConfig) IsAccessList(epoch *big.Int) bool {
+	return isForked(c.AccessListEpoch, epoch)
+}
+
+// IsCXReplay returns whether epoch is either equal to the CXReplay fork epoch or greater.
+func (c *ChainConfig) IsCXReplay(epoch *big.Int) bool {
+	return isForked(c.CXReplayEpoch, epoch)
+}
+
+// IsBaseFee returns whether epoch is either equal to the BaseFee fork epoch or greater.
+func (c *ChainConfig) IsBaseFee(epoch *big.Int) bool {
+	return isForked(c.BaseFeeEpoch, epoch)
+}
+
+// IsFeeDelegation returns whether epoch is either equal to the FeeDelegation fork epoch or greater.
+func (c *ChainConfig) IsFeeDelegation(epoch *big.Int) bool {
+	return isForked(c.FeeDelegationEpoch, epoch)
+}
+
+// IsVMLimits returns whether epoch is either equal to the VMLimits fork epoch or greater.
+func (c *ChainConfig) IsVMLimits(epoch *big.Int) bool {
+	return isForked(c.VMLimitsEpoch, epoch)
+}
+
+// IsVRF returns whether epoch is either equal to the VRF fork epoch or greater.
+func (c *ChainConfig) IsVRF(epoch *big.Int) bool {
+	return isForked(c.VRFEpoch, epoch)
+}
+
+// IsRefundCap returns whether epoch is either equal to the RefundCap fork epoch or greater.
+func (c *ChainConfig) IsRefundCap(epoch *big.Int) bool {
+	return isForked(c.RefundCapEpoch, epoch)
+}
+
+// IsCallStipend returns whether epoch is either equal to the CallStipend fork epoch or greater.
+func (c *ChainConfig) IsCallStipend(epoch *big.Int) bool {
+	return isForked(c.CallStipendEpoch, epoch)
+}
+
+// IsCodeSizeLimit returns whether epoch is either equal to the CodeSizeLimit fork epoch or greater.
+func (c *ChainConfig) IsCodeSizeLimit(epoch *big.Int) bool {
+	return isForked(c.CodeSizeLimitEpoch, epoch)
+}
+
+// IsMinGasPrice returns whether epoch is either equal to the MinGasPrice fork epoch or greater.
+func (c *ChainConfig) IsMinGasPrice(epoch *big.Int) bool {
+	return isForked(c.MinGasPriceEpoch, epoch)
+}
+
+// IsModExpGas returns whether epoch is either equal to the ModExpGas fork epoch or greater.
+func (c *ChainConfig) IsModExpGas(epoch *big.Int) bool {
+	return isForked(c.ModExpGasEpoch, epoch)
+}
+
+// IsStateClearing returns whether empty accounts are cleared from the state
+// in the given epoch, see StateClearingEpoch.
+func (c *ChainConfig) IsStateClearing(epoch *big.Int) bool {
+	if c.StateClearingEpoch == nil {
+		return c.IsS3(epoch)
+	}
+	return isForked(c.StateClearingEpoch, epoch)
+}
+
+// IsSlashOrder returns whether the slashes of a block are applied in a total
+// order in the given epoch, see SlashOrderEpoch.
+func (c *ChainConfig) IsSlashOrder(epoch *big.Int) bool {
+	return isForked(c.SlashOrderEpoch, epoch)
+}
+
+// RefundQuotient returns the quotient of the gas used by a transaction that
+// caps its refund in the given epoch.
+func (c *ChainConfig) RefundQuotient(epoch *big.Int) uint64 {
+	if c.IsRefundCap(epoch) {
+		return RefundQuotientEIP3529
+	}
+	return RefundQuotient
+}
+
+// CallDepthLimit returns the maximum depth of the EVM call/create stack in
+// the given epoch.
+func (c *ChainConfig) CallDepthLimit(epoch *big.Int) uint64 {
+	if c.IsVMLimits(epoch) && c.MaxCallDepth != 0 {
+		return c.MaxCallDepth
+	}
+	return CallCreateDepth
+}
+
+// StackSizeLimit returns the maximum size of the EVM stack in the given
+// epoch.
+func (c *ChainConfig) StackSizeLimit(epoch *big.Int) uint64 {
+	if c.IsVMLimits(epoch) && c.MaxStackSize != 0 {
+		return c.MaxStackSize
+	}
+	return StackLimit
+}
+
+// CallStipendGas returns the gas given for free to calls transferring value
+// in the given epoch.
+func (c *ChainConfig) CallStipendGas(epoch *big.Int) uint64 {
+	if c.IsCallStipend(epoch) && c.CallStipend != 0 {
+		return c.CallStipend
+	}
+	return CallStipend
+}
+
+// CodeSizeLimit returns the maximum size of the code of a contract in the
+// given epoch.
+func (c *ChainConfig) CodeSizeLimit(epoch *big.Int) uint64 {
+	if c.IsCodeSizeLimit(epoch) && c.MaxCodeSize != 0 {
+		return c.MaxCodeSize
+	}
+	return MaxCodeSize
+}
+
+// MinGasPrice returns the minimum gas price of transactions on the given
+// shard in the given epoch, or nil if there is none.
+func (c *ChainConfig) MinGasPrice(epoch *big.Int, shardID uint32) *big.Int {
+	if !c.IsMinGasPrice(epoch) {
+		return nil
+	}
+	return c.MinGasPrices[shardID]
+}
+
+// ScheduledBlockReward returns the block reward of the given epoch by the
+// RewardSchedule, or nil if it has none for the epoch.
+func (c *ChainConfig) ScheduledBlockReward(epoch *big.Int) *big.Int {
+	var reward *big.Int
+	for _, tier := range c.RewardSchedule {
+		if !isForked(tier.Epoch, epoch) {
+			break
+		}
+		reward = tier.BlockReward
+	}
+	return reward
+}
+
+// GasTable returns the gas table corresponding to the current phase (homestead, homestead reprice or access list).
 //
 // The returned GasTable's fields shouldn't, under any circumstances, be changed.
 func (c *ChainConfig) GasTable(epoch *big.Int) GasTable {
@@ -261,6 +661,8 @@ func (c *ChainConfig) GasTable(epoch *big.Int) GasTable {
 		return GasTableR3
 	}
 	switch {
+	case c.IsAccessList(epoch):
+		return GasTableAccessList
 	case c.IsS3(epoch):
 		return GasTableS3
 	default:
@@ -282,8 +684,10 @@ func isForked(s, epoch *big.Int) bool {
 // Rules is a one time interface meaning that it shouldn't be used in between transition
 // phases.
 type Rules struct {
-	ChainID                                   *big.Int
-	IsCrossLink, IsEIP155, IsS3, IsReceiptLog bool
+	ChainID                                                                   *big.Int
+	IsCrossLink, IsEIP155, IsS3, IsReceiptLog, IsAccessList, IsBaseFee, IsVRF bool
+	IsRefundCap                                                               bool
+	CallCreateDepth, StackLimit, CallStipend, MaxCodeSize                     uint64
 }
 
 // Rules ensures c's ChainID is not nil.
@@ -298,5 +702,14 @@ func (c *ChainConfig) Rules(epoch *big.Int) Rules {
 		IsEIP155:     c.IsEIP155(epoch),
 		IsS3:         c.IsS3(epoch),
 		IsReceiptLog: c.IsReceiptLog(epoch),
+		IsAccessList: c.IsAccessList(epoch),
+		IsBaseFee:    c.IsBaseFee(epoch),
+		IsVRF:        c.IsVRF(epoch),
+		IsRefundCap:  c.IsRefundCap(epoch),
+
+		CallCreateDepth: c.CallDepthLimit(epoch),
+		StackLimit:      c.StackSizeLimit(epoch),
+		CallStipend:     c.CallStipendGas(epoch),
+		MaxCodeSize:     c.CodeSizeLimit(epoch),
 	}
 }
@@ -5,6 +5,14 @@ const (
 	GasLimitBoundDivisor uint64 = 1024 // The bound divisor of the gas limit, used in update calculations.
 	// MinGasLimit ...
 	MinGasLimit uint64 = 5000 // Minimum the gas limit may ever be.
+	// MaxGasLimit ...
+	MaxGasLimit uint64 = 0x7fffffffffffffff // Maximum the gas limit may ever be (2^63-1).
+	// BaseFeeChangeDenominator bounds the amount the base fee can change between blocks.
+	BaseFeeChangeDenominator uint64 = 8
+	// ElasticityMultiplier bounds the gas limit of a block to a multiple of its gas target.
+	ElasticityMultiplier uint64 = 2
+	// InitialBaseFee is the base fee of the first block of BaseFeeEpoch.
+	InitialBaseFee uint64 = 1000000000
 	// GenesisGasLimit ...
 	GenesisGasLimit uint64 = 4712388 // Gas limit of the Genesis block.
 	// TestGenesisGasLimit ..
@@ -47,6 +55,13 @@ const (
 	SstoreClearGas uint64 = 5000 // Once per SSTORE operation if the zeroness doesn't change.
 	// SstoreRefundGas ...
 	SstoreRefundGas uint64 = 15000 // Once per SSTORE operation if the zeroness changes to zero.
+	// SstoreClearRefundEIP3529 ...
+	SstoreClearRefundEIP3529 uint64 = 4800 // Once per SSTORE operation clearing a slot from RefundCapEpoch on (EIP-3529).
+
+	// RefundQuotient ...
+	RefundQuotient uint64 = 2 // Maximum refund quotient; at most half of the gas used is refunded.
+	// RefundQuotientEIP3529 ...
+	RefundQuotientEIP3529 uint64 = 5 // Maximum refund quotient from RefundCapEpoch on (EIP-3529).
 
 	// NetSstoreNoopGas ...
 	NetSstoreNoopGas uint64 = 200 // Once per SSTORE operation if the value doesn't change.
@@ -97,6 +112,18 @@ const (
 	// TxDataNonZeroGas ...
 	TxDataNonZeroGas uint64 = 68 // Per byte of data attached to a transaction that is not equal to zero. NOTE: Not payable on data of calls between transactions.
 
+	// TxAccessListAddressGas ...
+	TxAccessListAddressGas uint64 = 2400 // Per address specified in an EIP-2930 access list
+	// TxAccessListStorageKeyGas ...
+	TxAccessListStorageKeyGas uint64 = 1900 // Per storage key specified in an EIP-2930 access list
+
+	// ColdAccountAccessCostEIP2929 ...
+	ColdAccountAccessCostEIP2929 uint64 = 2600 // Cost of the first access to an account within a transaction
+	// ColdSloadCostEIP2929 ...
+	ColdSloadCostEIP2929 uint64 = 2100 // Cost of the first access to a storage slot within a transaction
+	// WarmStorageReadCostEIP2929 ...
+	WarmStorageReadCostEIP2929 uint64 = 100 // Cost of accessing an already accessed account or storage slot
+
 	// MaxCodeSize ...
 	MaxCodeSize = 24576 // Maximum bytecode to permit for a contract
 
@@ -118,6 +145,10 @@ const (
 	IdentityPerWordGas uint64 = 3 // Per-work price for a data copy operation
 	// ModExpQuadCoeffDiv ...
 	ModExpQuadCoeffDiv uint64 = 20 // Divisor for the quadratic particle of the big int modular exponentiation
+	// ModExpQuadCoeffDivEIP2565 ...
+	ModExpQuadCoeffDivEIP2565 uint64 = 3 // Divisor for the multiplication complexity of the big int modular exponentiation (EIP-2565)
+	// ModExpMinGasEIP2565 ...
+	ModExpMinGasEIP2565 uint64 = 200 // Minimum price for a big int modular exponentiation (EIP-2565)
 	// Bn256AddGas ...
 	Bn256AddGas uint64 = 500 // Gas needed for an elliptic curve addition
 	// Bn256ScalarMulGas ...
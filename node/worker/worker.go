@@ -18,6 +18,7 @@ import (
 	"github.com/harmony-one/harmony/core/state"
 	"github.com/harmony-one/harmony/core/types"
 	"github.com/harmony-one/harmony/core/vm"
+	chain2 "github.com/harmony-one/harmony/internal/chain"
 	common2 "github.com/harmony-one/harmony/internal/common"
 	"github.com/harmony-one/harmony/internal/params"
 	"github.com/harmony-one/harmony/internal/utils"
@@ -95,6 +96,13 @@ func (w *Worker) CommitTransactions(
 			continue
 		}
 
+		if tx.ShardID() != tx.ToShardID() && w.cxReceiptsFull(tx.ToShardID()) {
+			// Leave the transactions of the account in the pool for a later block
+			utils.Logger().Info().Str("hash", tx.Hash().Hex()).Uint32("toShardID", tx.ToShardID()).Msg("Skipping account, cross-shard receipts for the destination shard are full")
+			txs.Pop()
+			continue
+		}
+
 		_, err := w.commitTransaction(tx, coinbase)
 
 		sender, _ := common2.AddressToBech32(from)
@@ -235,6 +243,21 @@ func (w *Worker) commitTransaction(
 	return receipt.Logs, nil
 }
 
+// cxReceiptsFull returns whether the current block already sends as many
+// cross-shard receipts to toShardID as the chain config allows.
+func (w *Worker) cxReceiptsFull(toShardID uint32) bool {
+	if w.config.MaxCXReceiptsPerShard == 0 {
+		return false
+	}
+	count := uint64(0)
+	for _, cx := range w.current.outcxs {
+		if cx.ToShardID == toShardID {
+			count++
+		}
+	}
+	return count >= w.config.MaxCXReceiptsPerShard
+}
+
 // CommitReceipts commits a list of already verified incoming cross shard receipts
 func (w *Worker) CommitReceipts(receiptsList []*types.CXReceiptsProof) error {
 	if w.current.gasPool == nil {
@@ -271,6 +294,7 @@ func (w *Worker) UpdateCurrent() error {
 		ParentHash(parent.Hash()).
 		Number(num.Add(num, common.Big1)).
 		GasLimit(core.CalcGasLimit(parent, w.gasFloor, w.gasCeil)).
+		BaseFee(chain2.CalcBaseFee(w.config, parent.Header(), epoch)).
 		Time(big.NewInt(timestamp)).
 		ShardID(w.chain.ShardID()).
 		Header()
@@ -525,6 +549,7 @@ func New(
 		ParentHash(parent.Hash()).
 		Number(num.Add(num, common.Big1)).
 		GasLimit(core.CalcGasLimit(parent, worker.gasFloor, worker.gasCeil)).
+		BaseFee(chain2.CalcBaseFee(worker.config, parent.Header(), epoch)).
 		Time(big.NewInt(timestamp)).
 		ShardID(worker.chain.ShardID()).
 		Header()
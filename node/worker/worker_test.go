@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"crypto/ecdsa"
 	"math/big"
 	"math/rand"
 	"testing"
@@ -8,13 +9,20 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/harmony-one/harmony/block"
 	blockfactory "github.com/harmony-one/harmony/block/factory"
 	"github.com/harmony-one/harmony/common/denominations"
+	consensus_engine "github.com/harmony-one/harmony/consensus/engine"
+	"github.com/harmony-one/harmony/consensus/reward"
 	"github.com/harmony-one/harmony/core"
+	"github.com/harmony-one/harmony/core/state"
 	"github.com/harmony-one/harmony/core/types"
 	"github.com/harmony-one/harmony/core/vm"
 	chain2 "github.com/harmony-one/harmony/internal/chain"
 	"github.com/harmony-one/harmony/internal/params"
+	"github.com/harmony-one/harmony/shard"
+	"github.com/harmony-one/harmony/staking/network"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -92,3 +100,251 @@ func TestCommitTransactions(t *testing.T) {
 		t.Error("Transaction is not committed")
 	}
 }
+
+func TestCommitTransactionsCXReceiptsPerShard(t *testing.T) {
+	config := *chainConfig
+	config.MaxCXReceiptsPerShard = 1
+	otherKey, _ := crypto.GenerateKey()
+	otherAddress := crypto.PubkeyToAddress(otherKey.PublicKey)
+	var (
+		database = ethdb.NewMemDatabase()
+		gspec    = core.Genesis{
+			Config:  &config,
+			Factory: blockFactory,
+			Alloc: core.GenesisAlloc{
+				testBankAddress: {Balance: testBankFunds},
+				otherAddress:    {Balance: testBankFunds},
+			},
+			ShardID: 0,
+		}
+	)
+
+	gspec.MustCommit(database)
+	chain, _ := core.NewBlockChain(database, nil, gspec.Config, chain2.Engine, vm.Config{}, nil)
+	worker := New(&config, chain, chain2.Engine)
+	// Cross-shard transactions are accepted from the epoch after CrossTxEpoch.
+	worker.current.header.SetEpoch(big.NewInt(1))
+
+	to := common.HexToAddress("0xbeef")
+	newTx := func(key *ecdsa.PrivateKey, nonce uint64, toShardID uint32) *types.Transaction {
+		tx, _ := types.SignTx(types.NewCrossShardTransaction(
+			nonce, &to, 0, toShardID, big.NewInt(1), params.TxGas, nil, nil,
+		), types.HomesteadSigner{}, key)
+		return tx
+	}
+	txs := map[common.Address]types.Transactions{
+		// The second one to shard 1 exceeds the limit and is left out.
+		testBankAddress: {newTx(testBankKey, 0, 1), newTx(testBankKey, 1, 1)},
+		otherAddress:    {newTx(otherKey, 0, 2)},
+	}
+	if err := worker.CommitTransactions(txs, nil, testBankAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(worker.current.txs) != 2 {
+		t.Fatalf("got %d committed transactions, want 2", len(worker.current.txs))
+	}
+	perShard := map[uint32]int{}
+	for _, cx := range worker.current.outcxs {
+		perShard[cx.ToShardID]++
+	}
+	if perShard[1] != 1 || perShard[2] != 1 {
+		t.Errorf("got cross-shard receipts per shard %v, want one each for shards 1 and 2", perShard)
+	}
+}
+
+// equalSplit pays the same amount to every slot of the committee.
+type equalSplit struct {
+	amount *big.Int
+}
+
+func (d equalSplit) DistributeRewards(
+	header *block.Header, statedb *state.DB, committee *shard.Committee,
+) (reward.Reader, error) {
+	payouts := []reward.Payout{}
+	total := big.NewInt(0)
+	for _, slot := range committee.Slots {
+		statedb.AddBalance(slot.EcdsaAddress, d.amount)
+		total.Add(total, d.amount)
+		payouts = append(payouts, reward.Payout{
+			ShardID:     committee.ShardID,
+			Addr:        slot.EcdsaAddress,
+			NewlyEarned: d.amount,
+			EarningKey:  slot.BLSPublicKey,
+		})
+	}
+	return network.NewStakingEraRewardForRound(total, nil, nil, payouts), nil
+}
+
+// newRewardChain returns a chain of the pre-staking era of config whose
+// genesis committee is made of the given slots.
+func newRewardChain(
+	t *testing.T, config *params.ChainConfig, slots shard.SlotList,
+) *core.BlockChain {
+	database := ethdb.NewMemDatabase()
+	gspec := core.Genesis{
+		Config:  config,
+		Factory: blockFactory,
+		Alloc:   core.GenesisAlloc{testBankAddress: {Balance: testBankFunds}},
+		ShardID: 0,
+		ShardState: shard.State{
+			Epoch:  big.NewInt(0),
+			Shards: []shard.Committee{{ShardID: 0, Slots: slots}},
+		},
+	}
+	gspec.MustCommit(database)
+	chain, err := core.NewBlockChain(database, nil, gspec.Config, chain2.Engine, vm.Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+// proposeBlock has a worker propose a block of a transfer on top of chain.
+func proposeBlock(t *testing.T, chain *core.BlockChain) *types.Block {
+	worker := New(chain.Config(), chain, chain2.Engine)
+	tx, _ := types.SignTx(types.NewTransaction(
+		0, testBankAddress, 0, big.NewInt(1), params.TxGas, nil, nil,
+	), types.HomesteadSigner{}, testBankKey)
+	txs := map[common.Address]types.Transactions{testBankAddress: {tx}}
+	if err := worker.CommitTransactions(txs, nil, testBankAddress); err != nil {
+		t.Fatal(err)
+	}
+	block, err := worker.FinalizeNewBlock(nil, nil, 0, testBankAddress, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// validateBlock processes block on top of the head of chain as a validator
+// does, checks its state against the one proposed, and returns it.
+func validateBlock(t *testing.T, chain *core.BlockChain, block *types.Block) *state.DB {
+	statedb, err := chain.StateAt(chain.CurrentBlock().Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipts, cxs, _, usedGas, _, err := chain.Processor().Process(block, statedb, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Validator().ValidateState(block, statedb, receipts, cxs, usedGas); err != nil {
+		t.Fatalf("proposed block does not validate: %v", err)
+	}
+	return statedb
+}
+
+func TestFinalizeNewBlockWithRewardDistributor(t *testing.T) {
+	config := *chainConfig
+	config.PreStakingEpoch = big.NewInt(10)
+	config.StakingEpoch = big.NewInt(10)
+	a, b := common.HexToAddress("0x1057"), common.HexToAddress("0x1058")
+	chain := newRewardChain(t, &config, shard.SlotList{
+		{EcdsaAddress: a, BLSPublicKey: shard.BLSPublicKey{1}},
+		{EcdsaAddress: b, BLSPublicKey: shard.BLSPublicKey{2}},
+		{EcdsaAddress: b, BLSPublicKey: shard.BLSPublicKey{3}},
+	})
+	chain2.Engine.SetRewardDistributor(equalSplit{big.NewInt(5)})
+	defer chain2.Engine.SetRewardDistributor(nil)
+
+	statedb := validateBlock(t, chain, proposeBlock(t, chain))
+	// The distributor pays out once, whether proposing or validating.
+	for addr, want := range map[common.Address]int64{a: 5, b: 10} {
+		if got := statedb.GetBalance(addr); got.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("%s: got balance %v, want %d", addr.Hex(), got, want)
+		}
+	}
+}
+
+func TestFinalizeNewBlockWithRewardSchedule(t *testing.T) {
+	config := *chainConfig
+	config.PreStakingEpoch = big.NewInt(10)
+	config.StakingEpoch = big.NewInt(10)
+	config.RewardSchedule = []params.RewardTier{
+		{Epoch: big.NewInt(0), BlockReward: big.NewInt(9)},
+		{Epoch: big.NewInt(2), BlockReward: big.NewInt(30)},
+	}
+	for epoch, want := range []int64{9, 9, 30, 30} {
+		if got := config.ScheduledBlockReward(big.NewInt(int64(epoch))); got.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("epoch %d: got block reward %v, want %d", epoch, got, want)
+		}
+	}
+	a, b := common.HexToAddress("0x1079"), common.HexToAddress("0x107a")
+	chain := newRewardChain(t, &config, shard.SlotList{
+		{EcdsaAddress: a, BLSPublicKey: shard.BLSPublicKey{1}},
+		{EcdsaAddress: b, BLSPublicKey: shard.BLSPublicKey{2}},
+	})
+
+	block := proposeBlock(t, chain)
+	if block.Epoch().Sign() != 0 {
+		t.Fatalf("proposed a block of epoch %v, want 0", block.Epoch())
+	}
+	statedb := validateBlock(t, chain, block)
+	// The reward of the first tier is split once, the remainder going to
+	// the last slot.
+	for addr, want := range map[common.Address]int64{a: 4, b: 5} {
+		if got := statedb.GetBalance(addr); got.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("%s: got balance %v, want %d", addr.Hex(), got, want)
+		}
+	}
+}
+
+func TestUpdateCurrentBaseFee(t *testing.T) {
+	var (
+		database = ethdb.NewMemDatabase()
+		gspec    = core.Genesis{
+			Config:  chainConfig,
+			Factory: blockFactory,
+			Alloc:   core.GenesisAlloc{testBankAddress: {Balance: testBankFunds}},
+			ShardID: 0,
+		}
+	)
+	genesis := gspec.MustCommit(database)
+	chain, _ := core.NewBlockChain(database, nil, gspec.Config, chain2.Engine, vm.Config{}, nil)
+	worker := New(chainConfig, chain, chain2.Engine)
+
+	header := worker.GetCurrentHeader()
+	want := chain2.CalcBaseFee(chainConfig, genesis.Header(), header.Epoch())
+	if got := header.BaseFee(); want == nil || got == nil || got.Cmp(want) != 0 {
+		t.Fatalf("proposed base fee %v, want %v", got, want)
+	}
+	if err := chain2.Engine.VerifyHeader(chain, header, false); err != nil {
+		t.Errorf("proposed header rejected: %v", err)
+	}
+	header.SetBaseFee(new(big.Int).Add(want, common.Big1))
+	if err := chain2.Engine.VerifyHeader(chain, header, false); errors.Cause(err) != consensus_engine.ErrInvalidBaseFee {
+		t.Errorf("got error %v for a wrong base fee, want %v", err, consensus_engine.ErrInvalidBaseFee)
+	}
+
+	// The first block of BaseFeeEpoch starts at the initial base fee, which
+	// then follows how full its parent is.
+	var (
+		preBaseFee  = blockFactory.NewHeader(big.NewInt(0))
+		config      = *chainConfig
+		parent      = blockFactory.NewHeader(big.NewInt(1))
+		initial     = new(big.Int).SetUint64(params.InitialBaseFee)
+		withBaseFee = func(gasUsed uint64) *block.Header {
+			return parent.With().GasLimit(1000).GasUsed(gasUsed).BaseFee(initial).Header()
+		}
+	)
+	config.BaseFeeEpoch = big.NewInt(1)
+	if got := chain2.CalcBaseFee(&config, preBaseFee, big.NewInt(0)); got != nil {
+		t.Errorf("got base fee %v before BaseFeeEpoch", got)
+	}
+	if got := chain2.CalcBaseFee(&config, preBaseFee, big.NewInt(1)); got.Cmp(initial) != 0 {
+		t.Errorf("got base fee %v for the first block of BaseFeeEpoch, want %v", got, initial)
+	}
+	for _, test := range []struct {
+		gasUsed uint64
+		want    int64
+	}{
+		{500, 1000000000},
+		{1000, 1125000000},
+		{0, 875000000},
+		{750, 1062500000},
+	} {
+		if got := chain2.CalcBaseFee(&config, withBaseFee(test.gasUsed), big.NewInt(1)); got.Cmp(big.NewInt(test.want)) != 0 {
+			t.Errorf("parent using %d gas: got base fee %v, want %d", test.gasUsed, got, test.want)
+		}
+	}
+}
@@ -51,6 +51,10 @@ func (noReward) ReadRoundResult() *reward.CompletedRound {
 	}
 }
 
+func (r noReward) ValidatorPayouts() []reward.ValidatorPayout {
+	return r.ReadRoundResult().ValidatorPayouts()
+}
+
 type preStakingEra struct {
 	ignoreMissing
 	payout *big.Int
@@ -69,6 +73,12 @@ func (p *preStakingEra) ReadRoundResult() *reward.CompletedRound {
 	}
 }
 
+// ValidatorPayouts is empty, the pre-staking block reward is split evenly
+// among the signers without being recorded per validator.
+func (p *preStakingEra) ValidatorPayouts() []reward.ValidatorPayout {
+	return p.ReadRoundResult().ValidatorPayouts()
+}
+
 type stakingEra struct {
 	reward.CompletedRound
 	missingSigners shard.SlotList